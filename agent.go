@@ -5,9 +5,13 @@ import (
 	"errors"
 	"log"
 	"os/exec"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/cloudfoundry/gibson"
 	"github.com/cloudfoundry/go_cfmessagebus"
+	"github.com/cloudfoundry/narc/protocol"
 	"github.com/nu7hatch/gouuid"
 )
 
@@ -15,10 +19,46 @@ type Agent struct {
 	ID       *uuid.UUID
 	Registry *Registry
 
+	Host               string
+	Capacity           CapacityConfig
+	HostKeyFingerprint string
+
+	// Images are the images a start message may ask for. Tasks that do
+	// not ask for one get the task backend's default.
+	Images []string
+
+	// BindMountRoots are the host directories start messages may bind
+	// mount paths from.
+	BindMountRoots []string
+
+	// DefaultLimits are the CPU, PID and file descriptor limits of tasks
+	// whose start message does not set them, and MaximumLimits the highest
+	// a start message may ask for.
+	DefaultLimits TaskLimits
+	MaximumLimits TaskLimits
+
+	// StopGracePeriod is how long a stopped task has to exit when its
+	// start message does not say.
+	StopGracePeriod time.Duration
+
+	// Snapshots stores archives taken by SnapshotTask. Snapshots are
+	// refused if it is nil.
+	Snapshots SnapshotStore
+
 	taskBackend TaskBackend
 
 	routerClient gibson.RouterClient
 	routerPort   int
+
+	reservations     map[string]TaskLimits
+	reservationsLock sync.RWMutex
+
+	finished      map[string]protocol.TaskStatus
+	finishedOrder []string
+	finishedLock  sync.RWMutex
+
+	draining     bool
+	drainingLock sync.RWMutex
 }
 
 type RouterRegistrar interface {
@@ -27,23 +67,33 @@ type RouterRegistrar interface {
 }
 
 type TaskBackend interface {
-	ProvideContainer(TaskLimits) (Container, error)
+	ProvideContainer(ContainerSpec) (Container, error)
 	ProvideCommand(Container) *exec.Cmd
 }
 
-type startMessage struct {
-	Task                   string `json:"task"`
-	SecureToken            string `json:"secure_token"`
-	MemoryLimitInMegabytes uint64 `json:"memory_limit"`
-	DiskLimitInMegabytes   uint64 `json:"disk_limit"`
+// ContainerLister is implemented by task backends that can find the
+// containers narc created, including those left behind by a previous run.
+type ContainerLister interface {
+	ListContainers() ([]Container, error)
 }
 
-type stopMessage struct {
-	Task string `json:"task"`
+// ContainerRestorer is implemented by task backends that can reconnect to a
+// container created by a previous run.
+type ContainerRestorer interface {
+	RestoreContainer(handle string) (Container, error)
 }
 
+// FinishedTaskHistory is how many finished tasks an agent remembers the
+// status of.
+const FinishedTaskHistory = 100
+
 var TaskNotRegistered = errors.New("task not registered")
 var TaskAlreadyRegistered = errors.New("task already registered")
+var InvalidTaskLimits = errors.New("must specify memory and disk limits")
+var AgentDraining = errors.New("agent is draining")
+var ImageNotAllowed = errors.New("image not allowed")
+var TaskLimitsTooHigh = errors.New("limits exceed the agent's maximums")
+var TaskSetupFailed = errors.New("task setup failed")
 
 func NewAgent(taskBackend TaskBackend, routerClient gibson.RouterClient, port int) (*Agent, error) {
 	id, err := uuid.NewV4()
@@ -57,116 +107,687 @@ func NewAgent(taskBackend TaskBackend, routerClient gibson.RouterClient, port in
 		taskBackend:  taskBackend,
 		routerClient: routerClient,
 		routerPort:   port,
+		reservations: make(map[string]TaskLimits),
+		finished:     make(map[string]protocol.TaskStatus),
 	}, nil
 }
 
+// QueueSubscriber is implemented by message buses that can deliver each
+// message on a subject to only one subscriber of a queue group.
+type QueueSubscriber interface {
+	QueueSubscribe(subject, queue string, callback func(payload []byte)) error
+}
+
+// StartQueueGroup is the queue group agents use to share broadcast starts
+// that are not placed on any agent.
+const StartQueueGroup = "narc.start"
+
+// HandleStarts subscribes to both the broadcast start subject and the start
+// subject directed at this agent. Broadcast starts that name a different
+// agent are ignored, so a scheduler can place tasks on a specific node.
+// Broadcast starts that name no agent are handed to one agent through a
+// queue group, if the message bus supports it.
 func (agent *Agent) HandleStarts(mbus cfmessagebus.MessageBus) error {
-	return mbus.Subscribe("task.start", func(payload []byte) {
-		var start startMessage
+	queue, queueing := mbus.(QueueSubscriber)
+	if !queueing {
+		log.Println("message bus has no queue groups; every agent will handle unplaced starts")
+	}
+
+	err := mbus.Subscribe(protocol.StartSubject, agent.startHandler(mbus, protocol.StartSubject, func(start protocol.StartMessage) bool {
+		if start.Agent == "" {
+			return !queueing
+		}
 
-		err := json.Unmarshal(payload, &start)
+		return start.Agent == agent.ID.String()
+	}))
+	if err != nil {
+		return err
+	}
+
+	if queueing {
+		err = queue.QueueSubscribe(protocol.StartSubject, StartQueueGroup, agent.startHandler(mbus, protocol.StartSubject, func(start protocol.StartMessage) bool {
+			return start.Agent == ""
+		}))
 		if err != nil {
-			log.Printf("Failed to unmarshal ssh start: %s\n", err)
-			return
+			return err
 		}
+	}
 
-		agent.handleStart(start)
-	})
+	directed := protocol.StartSubjectFor(agent.ID.String())
+
+	return mbus.Subscribe(directed, agent.startHandler(mbus, directed, func(protocol.StartMessage) bool {
+		return true
+	}))
 }
 
+// HandleStops subscribes to both the broadcast stop subject and the stop
+// subject directed at this agent. Broadcast stops for tasks this agent is
+// not running are ignored.
 func (agent *Agent) HandleStops(mbus cfmessagebus.MessageBus) error {
-	return mbus.Subscribe("task.stop", func(payload []byte) {
-		var stop stopMessage
+	err := mbus.Subscribe(protocol.StopSubject, agent.stopHandler(mbus, protocol.StopSubject, false))
+	if err != nil {
+		return err
+	}
+
+	directed := protocol.StopSubjectFor(agent.ID.String())
+
+	return mbus.Subscribe(directed, agent.stopHandler(mbus, directed, true))
+}
+
+// HandleDiscovers replies to discovery requests with the same advertisement
+// that is published periodically by AdvertisePeriodically.
+func (agent *Agent) HandleDiscovers(mbus cfmessagebus.MessageBus) error {
+	return mbus.ReplyToChannel(protocol.DiscoverSubject, func([]byte) []byte {
+		return marshalReply(agent.Advertisement())
+	})
+}
 
-		err := json.Unmarshal(payload, &stop)
+// HandleStatusRequests replies to status requests directed at this agent.
+// Broadcast status requests are answered on their reply_to subject, and
+// only by the agent that knows the task; every other agent stays silent.
+func (agent *Agent) HandleStatusRequests(mbus cfmessagebus.MessageBus) error {
+	err := mbus.Subscribe(protocol.StatusSubject, func(payload []byte) {
+		request, err := protocol.ParseStatusRequest(payload)
 		if err != nil {
-			log.Printf("Failed to unmarshal ssh start: %s\n", err)
+			log.Printf("invalid status request: %s\n", err)
 			return
 		}
 
-		agent.handleStop(stop)
+		if request.ReplyTo == "" {
+			log.Printf("ignoring status request without reply_to: %s\n", request.Task)
+			return
+		}
+
+		response := agent.statusResponse(request)
+		if response.Status == nil {
+			return
+		}
+
+		mbus.Publish(request.ReplyTo, marshalReply(response))
 	})
+	if err != nil {
+		return err
+	}
+
+	return mbus.ReplyToChannel(protocol.StatusSubjectFor(agent.ID.String()), func(payload []byte) []byte {
+		return marshalReply(agent.handleStatusRequest(payload))
+	})
+}
+
+func (agent *Agent) HandleListRequests(mbus cfmessagebus.MessageBus) error {
+	return mbus.ReplyToChannel(protocol.ListSubject, func(payload []byte) []byte {
+		return marshalReply(agent.handleListRequest(payload))
+	})
+}
+
+// TaskStatuses returns the status of every registered task, ordered by task
+// id.
+func (agent *Agent) TaskStatuses() []protocol.TaskStatus {
+	tasks := agent.Registry.Snapshot()
+
+	guids := make([]string, 0, len(tasks))
+	for guid := range tasks {
+		guids = append(guids, guid)
+	}
+
+	sort.Strings(guids)
+
+	statuses := make([]protocol.TaskStatus, len(guids))
+	for i, guid := range guids {
+		statuses[i] = taskStatus(guid, tasks[guid])
+	}
+
+	return statuses
+}
+
+// TaskStatus returns the status of a running task, including its container's
+// resource usage, or of one of the last FinishedTaskHistory tasks to finish.
+func (agent *Agent) TaskStatus(guid string) (protocol.TaskStatus, bool) {
+	task, found := agent.Registry.Lookup(guid)
+	if found {
+		status := taskStatus(guid, task)
+
+		if status.State != TaskStateCompleted {
+			status.Usage = taskUsage(task)
+		}
+
+		return status, true
+	}
+
+	agent.finishedLock.RLock()
+	defer agent.finishedLock.RUnlock()
+
+	status, found := agent.finished[guid]
+	return status, found
+}
+
+// AdvertisePeriodically publishes the agent's advertisement immediately and
+// then once every interval.
+func (agent *Agent) AdvertisePeriodically(mbus cfmessagebus.MessageBus, interval time.Duration) {
+	go func() {
+		for {
+			err := agent.Advertise(mbus)
+			if err != nil {
+				log.Printf("failed to advertise: %s\n", err)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (agent *Agent) Advertise(mbus cfmessagebus.MessageBus) error {
+	payload, err := json.Marshal(agent.Advertisement())
+	if err != nil {
+		return err
+	}
+
+	return mbus.Publish(protocol.AdvertiseSubject, payload)
+}
+
+// Advertisement describes the agent and its remaining capacity. A draining
+// agent advertises no available capacity.
+func (agent *Agent) Advertisement() protocol.AdvertiseMessage {
+	reserved, running := agent.reserved()
+
+	advertisement := protocol.AdvertiseMessage{
+		Version:            protocol.Version,
+		ID:                 agent.ID.String(),
+		Host:               agent.Host,
+		Port:               agent.routerPort,
+		HostKeyFingerprint: agent.HostKeyFingerprint,
+		TotalMemory:        agent.Capacity.MemoryInBytes / megabyte,
+		TotalDisk:          agent.Capacity.DiskInBytes / megabyte,
+		AvailableMemory:    remaining(agent.Capacity.MemoryInBytes, reserved.MemoryLimitInBytes) / megabyte,
+		AvailableDisk:      remaining(agent.Capacity.DiskInBytes, reserved.DiskLimitInBytes) / megabyte,
+		RunningTasks:       running,
+		Draining:           agent.Draining(),
+	}
+
+	pool, pooled := agent.taskBackend.(*ContainerPool)
+	if pooled {
+		advertisement.Pools = pool.Stats()
+	}
+
+	if advertisement.Draining {
+		advertisement.AvailableMemory = 0
+		advertisement.AvailableDisk = 0
+	}
+
+	return advertisement
+}
+
+func (agent *Agent) handleStatusRequest(payload []byte) protocol.StatusResponse {
+	request, err := protocol.ParseStatusRequest(payload)
+	if err != nil {
+		return protocol.StatusResponse{Version: protocol.Version, Error: err.Error()}
+	}
+
+	return agent.statusResponse(request)
+}
+
+func (agent *Agent) statusResponse(request protocol.StatusRequest) protocol.StatusResponse {
+	status, found := agent.TaskStatus(request.Task)
+	if !found {
+		return protocol.StatusResponse{Version: protocol.Version, Error: TaskNotRegistered.Error()}
+	}
+
+	return protocol.StatusResponse{Version: protocol.Version, Status: &status}
+}
+
+func (agent *Agent) handleListRequest(payload []byte) protocol.ListResponse {
+	response := protocol.ListResponse{
+		Version: protocol.Version,
+		Agent:   agent.ID.String(),
+		Tasks:   []protocol.TaskStatus{},
+	}
+
+	_, err := protocol.ParseListRequest(payload)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+
+	response.Tasks = agent.TaskStatuses()
+
+	return response
+}
+
+func (agent *Agent) startHandler(mbus cfmessagebus.MessageBus, subject string, handles func(protocol.StartMessage) bool) func([]byte) {
+	return func(payload []byte) {
+		start, err := protocol.ParseStartMessage(payload)
+		if !handles(start) {
+			return
+		}
+
+		if err != nil {
+			log.Printf("invalid task start: %s\n", err)
+			agent.reportError(mbus, subject, start.Task, err)
+			return
+		}
+
+		err = agent.handleStart(start)
+		if err != nil {
+			agent.reportError(mbus, subject, start.Task, err)
+		}
+	}
+}
+
+func (agent *Agent) stopHandler(mbus cfmessagebus.MessageBus, subject string, directed bool) func([]byte) {
+	return func(payload []byte) {
+		stop, err := protocol.ParseStopMessage(payload)
+		if err != nil {
+			log.Printf("invalid task stop: %s\n", err)
+			agent.reportError(mbus, subject, stop.Task, err)
+			return
+		}
+
+		if !directed && !agent.isPlacedHere(stop.Agent) {
+			return
+		}
+
+		err = agent.handleStop(stop)
+		if err == TaskNotRegistered && !directed && stop.Agent == "" {
+			return
+		}
+
+		if err != nil {
+			agent.reportError(mbus, subject, stop.Task, err)
+		}
+	}
+}
+
+func (agent *Agent) imageAllowed(image string) bool {
+	for _, allowed := range agent.Images {
+		if image == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (agent *Agent) isPlacedHere(agentID string) bool {
+	return agentID == "" || agentID == agent.ID.String()
 }
 
-func (agent *Agent) handleStart(start startMessage) {
+func (agent *Agent) handleStart(start protocol.StartMessage) error {
 	log.Printf("creating task %s\n", start.Task)
 	limits := TaskLimits{
 		MemoryLimitInBytes: start.MemoryLimitInMegabytes * 1024 * 1024,
 		DiskLimitInBytes:   start.DiskLimitInMegabytes * 1024 * 1024,
-	}
+		CPUShares:          start.CPUShares,
+		CPUQuotaInPercent:  start.CPUQuota,
+		PIDLimit:           start.PIDLimit,
+		FDLimit:            start.FDLimit,
+		InboundBandwidth:   start.InboundBandwidth,
+		OutboundBandwidth:  start.OutboundBandwidth,
+	}.WithDefaults(agent.DefaultLimits)
 	if !limits.IsValid() {
-		log.Printf("Must specify memory and disk: %s\n", limits)
-		return
+		log.Printf("Must specify memory and disk: %#v\n", limits)
+		return InvalidTaskLimits
 	}
 
-	_, err := agent.startTask(start.Task, start.SecureToken, limits)
+	if limits.Exceeds(agent.MaximumLimits) {
+		log.Printf("limits too high: %#v\n", limits)
+		return TaskLimitsTooHigh
+	}
+
+	if start.Image != "" && !agent.imageAllowed(start.Image) {
+		log.Printf("image not allowed: %s\n", start.Image)
+		return ImageNotAllowed
+	}
+
+	bindMounts, setupScripts, err := agent.bindMountsFor(start)
+	if err != nil {
+		log.Printf("invalid bind mounts: %s\n", err)
+		return err
+	}
+
+	_, err = agent.startTask(start.SecureToken, ContainerSpec{
+		Task:       start.Task,
+		Limits:     limits,
+		Image:      start.Image,
+		BindMounts: bindMounts,
+		Network:    networkPolicyFor(start.Network),
+	}, append(setupScripts, start.Setup...), agent.stopPolicyFor(start))
 	if err != nil {
 		log.Printf("failed to create task: %s\n", err)
 	}
+
+	return err
+}
+
+func (agent *Agent) stopPolicyFor(start protocol.StartMessage) StopPolicy {
+	policy := StopPolicy{
+		PreStop:     start.PreStop,
+		GracePeriod: agent.StopGracePeriod,
+	}
+
+	if start.GracePeriod > 0 {
+		policy.GracePeriod = time.Duration(start.GracePeriod) * time.Second
+	}
+
+	return policy
 }
 
-func (agent *Agent) handleStop(stop stopMessage) {
+// handleStop unregisters the task right away, but stops it in the
+// background, so that its grace period does not hold up later messages.
+func (agent *Agent) handleStop(stop protocol.StopMessage) error {
 	log.Printf("stopping task %s\n", stop.Task)
 
-	err := agent.stopTask(stop.Task)
+	task, err := agent.unregisterTask(stop.Task)
 	if err != nil {
 		log.Printf("failed to stop task: %s\n", err)
+		return err
+	}
+
+	go func() {
+		err := agent.stopUnregisteredTask(stop.Task, task)
+		if err != nil {
+			log.Printf("failed to stop task %s: %s\n", stop.Task, err)
+		}
+	}()
+
+	return nil
+}
+
+func (agent *Agent) reportError(mbus cfmessagebus.MessageBus, subject, task string, cause error) {
+	payload, err := json.Marshal(protocol.NewErrorMessage(subject, task, cause))
+	if err != nil {
+		log.Printf("failed to marshal error: %s\n", err)
+		return
+	}
+
+	err = mbus.Publish(protocol.ErrorSubject, payload)
+	if err != nil {
+		log.Printf("failed to publish error: %s\n", err)
 	}
 }
 
-func (agent *Agent) startTask(guid, secureToken string, limits TaskLimits) (*Task, error) {
-	_, present := agent.Registry.Lookup(guid)
+// startTask creates a container for a task, runs the setup scripts in it in
+// order, and only then registers and routes the task. The container is
+// destroyed if a script fails to run or exits non-zero.
+func (agent *Agent) startTask(secureToken string, spec ContainerSpec, setupScripts []string, stop StopPolicy) (*Task, error) {
+	if agent.Draining() {
+		return nil, AgentDraining
+	}
+
+	_, present := agent.Registry.Lookup(spec.Task)
 	if present {
 		return nil, TaskAlreadyRegistered
 	}
 
-	container, err := agent.createTaskContainer(limits)
+	container, err := agent.createTaskContainer(spec)
 	if err != nil {
 		return nil, err
 	}
 
-	task, err := NewTask(container, secureToken, agent.taskBackend.ProvideCommand(container))
+	task, err := agent.newTaskIn(container, secureToken, setupScripts)
 	if err != nil {
+		// pooled containers are not returned to the pool either: they were
+		// resized for the task and may have run its setup scripts
+		destroyErr := container.Destroy()
+		if destroyErr != nil {
+			log.Printf("failed to destroy container %s: %s\n", container.ID(), destroyErr)
+		}
+
 		return nil, err
 	}
 
+	task.Limits = spec.Limits
+	task.StopPolicy = stop
+
+	agent.registerTask(spec.Task, task)
+
+	return task, nil
+}
+
+func (agent *Agent) registerTask(guid string, task *Task) {
 	agent.Registry.Register(guid, task)
+	agent.reserve(guid, task.Limits)
 
 	agent.routerClient.Register(agent.routerPort, guid)
 
 	task.OnComplete(func() {
-		log.Println("task completed:", guid)
-		agent.cleanUpGuid(guid)
-	})
+		// a stopped task was already cleaned up, and its guid may have
+		// been started again since
+		if !agent.cleanUpTask(guid, task) {
+			return
+		}
 
-	return task, nil
+		reason := task.ExitReason()
+		if reason != "" {
+			log.Printf("task completed: %s (%s)\n", guid, reason)
+		} else {
+			log.Println("task completed:", guid)
+		}
+
+		agent.recordFinished(guid, task)
+	})
 }
 
+// stopTask unregisters a task and stops it, waiting for its grace period.
 func (a *Agent) stopTask(guid string) error {
+	task, err := a.unregisterTask(guid)
+	if err != nil {
+		return err
+	}
+
+	return a.stopUnregisteredTask(guid, task)
+}
+
+func (a *Agent) unregisterTask(guid string) (*Task, error) {
 	task, present := a.Registry.Lookup(guid)
 	if !present {
-		return TaskNotRegistered
+		return nil, TaskNotRegistered
+	}
+
+	if !a.cleanUpTask(guid, task) {
+		return nil, TaskNotRegistered
 	}
 
-	a.cleanUpGuid(guid)
+	a.recordFinished(guid, task)
+
+	return task, nil
+}
 
+func (a *Agent) stopUnregisteredTask(guid string, task *Task) error {
 	err := task.Stop()
 	if err != nil {
 		return err
 	}
 
+	a.recordFinished(guid, task)
+
 	return nil
 }
 
-func (a *Agent) cleanUpGuid(guid string) {
+func (a *Agent) recordFinished(guid string, task *Task) {
+	a.finishedLock.Lock()
+	defer a.finishedLock.Unlock()
+
+	_, seen := a.finished[guid]
+	if !seen {
+		a.finishedOrder = append(a.finishedOrder, guid)
+	}
+
+	a.finished[guid] = taskStatus(guid, task)
+
+	for len(a.finishedOrder) > FinishedTaskHistory {
+		delete(a.finished, a.finishedOrder[0])
+		a.finishedOrder = a.finishedOrder[1:]
+	}
+}
+
+// cleanUpTask unregisters, unroutes and releases a task, unless another
+// task has been registered under its guid. It returns whether it did.
+func (a *Agent) cleanUpTask(guid string, task *Task) bool {
+	if !a.Registry.UnregisterIf(guid, task) {
+		return false
+	}
+
 	a.routerClient.Unregister(a.routerPort, guid)
-	a.Registry.Unregister(guid)
+	a.release(guid)
+
+	return true
+}
+
+func (a *Agent) reserve(guid string, limits TaskLimits) {
+	a.reservationsLock.Lock()
+	defer a.reservationsLock.Unlock()
+
+	a.reservations[guid] = limits
+}
+
+func (a *Agent) release(guid string) {
+	a.reservationsLock.Lock()
+	defer a.reservationsLock.Unlock()
+
+	delete(a.reservations, guid)
+}
+
+func (a *Agent) reserved() (TaskLimits, int) {
+	a.reservationsLock.RLock()
+	defer a.reservationsLock.RUnlock()
+
+	total := TaskLimits{}
+
+	for _, limits := range a.reservations {
+		total.MemoryLimitInBytes += limits.MemoryLimitInBytes
+		total.DiskLimitInBytes += limits.DiskLimitInBytes
+	}
+
+	pooled := a.pooled()
+
+	total.MemoryLimitInBytes += pooled.MemoryLimitInBytes
+	total.DiskLimitInBytes += pooled.DiskLimitInBytes
+
+	return total, len(a.reservations)
 }
 
-func (agent *Agent) createTaskContainer(limits TaskLimits) (Container, error) {
-	container, err := agent.taskBackend.ProvideContainer(limits)
+// pooled returns the limits of the containers the task backend keeps ready.
+func (a *Agent) pooled() TaskLimits {
+	pool, ok := a.taskBackend.(*ContainerPool)
+	if !ok {
+		return TaskLimits{}
+	}
+
+	return pool.Reserved()
+}
+
+func taskStatus(guid string, task *Task) protocol.TaskStatus {
+	limits := task.CurrentLimits()
+
+	status := protocol.TaskStatus{
+		Task:             guid,
+		State:            task.State(),
+		StartedAt:        task.StartedAt,
+		ContainerHandle:  task.container.ID(),
+		MemoryLimit:      limits.MemoryLimitInBytes / megabyte,
+		DiskLimit:        limits.DiskLimitInBytes / megabyte,
+		AttachedSessions: task.AttachedSessions(),
+	}
+
+	exitStatus, exited := task.ExitStatus()
+	if exited {
+		status.ExitStatus = &exitStatus
+		status.ExitReason = task.ExitReason()
+	}
+
+	return status
+}
+
+func networkPolicyFor(network *protocol.Network) NetworkPolicy {
+	if network == nil {
+		return NetworkPolicy{}
+	}
+
+	policy := NetworkPolicy{Mode: NetworkMode(network.Mode)}
+
+	for _, rule := range network.Allow {
+		policy.Allow = append(policy.Allow, NetworkRule{
+			Network: rule.Network,
+			Ports:   rule.Ports,
+		})
+	}
+
+	return policy
+}
+
+// taskUsage returns nil if the task's container cannot report its usage.
+func taskUsage(task *Task) *protocol.TaskUsage {
+	info, err := task.container.Info()
+	if err != nil {
+		log.Printf("failed to get info for container %s: %s\n", task.container.ID(), err)
+		return nil
+	}
+
+	return &protocol.TaskUsage{
+		Memory:    info.MemoryUsageInBytes / megabyte,
+		Disk:      info.DiskUsageInBytes / megabyte,
+		CPUTime:   info.CPUTime.Seconds(),
+		Processes: info.Processes,
+		NetworkRx: info.NetworkRxBytes,
+		NetworkTx: info.NetworkTxBytes,
+	}
+}
+
+func marshalReply(reply interface{}) []byte {
+	payload, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("failed to marshal reply: %s\n", err)
+		return nil
+	}
+
+	return payload
+}
+
+func remaining(capacity, reserved uint64) uint64 {
+	if reserved > capacity {
+		return 0
+	}
+
+	return capacity - reserved
+}
+
+func (agent *Agent) createTaskContainer(spec ContainerSpec) (Container, error) {
+	container, err := agent.taskBackend.ProvideContainer(spec)
 	if err != nil {
 		return nil, err
 	}
 	return container, nil
 }
+
+// newTaskIn sets up a freshly created container and returns a task for it.
+func (agent *Agent) newTaskIn(container Container, secureToken string, setupScripts []string) (*Task, error) {
+	err := setUpContainer(container, setupScripts)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTask(container, secureToken, agent.taskBackend.ProvideCommand(container))
+}
+
+func setUpContainer(container Container, scripts []string) error {
+	for _, script := range scripts {
+		info, err := container.Run(script)
+		if err != nil {
+			return err
+		}
+
+		if info.ExitStatus != 0 {
+			log.Printf(
+				"setup script exited with status %d: %s\nstdout: %s\nstderr: %s\n",
+				info.ExitStatus,
+				script,
+				info.Stdout,
+				info.Stderr,
+			)
+
+			return TaskSetupFailed
+		}
+	}
+
+	return nil
+}
@@ -1,9 +1,15 @@
 package narc
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/cloudfoundry/gibson/fake_router_client"
 	"github.com/cloudfoundry/go_cfmessagebus/mock_cfmessagebus"
+	"github.com/cloudfoundry/narc/protocol"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
+	"os/exec"
+	"path/filepath"
 	"time"
 )
 
@@ -45,6 +51,26 @@ func (s *ASuite) SetUpTest(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *ASuite) TestAgentSetsTheStopPolicy(c *C) {
+	s.Agent.StopGracePeriod = 10 * time.Second
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1,"pre_stop":"some-cleanup"}
+	`))
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"other-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1,"grace_period":3}
+	`))
+
+	task, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(task.StopPolicy, Equals, StopPolicy{PreStop: "some-cleanup", GracePeriod: 10 * time.Second})
+
+	task, found = s.Agent.Registry.Lookup("other-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(task.StopPolicy, Equals, StopPolicy{GracePeriod: 3 * time.Second})
+}
+
 func (s *ASuite) TestAgentIDIsUnique(c *C) {
 	agent1, err := NewAgent(WardenTaskBackend{}, nil, 0)
 	c.Assert(err, IsNil)
@@ -73,9 +99,106 @@ func (s *ASuite) TestAgentTaskLifecycle(c *C) {
 	_, found = s.Agent.Registry.Lookup("some-guid")
 	c.Assert(found, Equals, false)
 
+	waitForDestroy(container)
+
 	c.Assert(container.IsDestroyed(), Equals, true)
 }
 
+func (s *ASuite) TestAgentStopsTasksInTheBackground(c *C) {
+	agent, err := NewAgent(FakeTaskBackend{Command: exec.Command("bash", "-c", `trap "" HUP TERM; sleep 100`)}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	agent.StopGracePeriod = 2 * time.Second
+
+	err = agent.HandleStops(s.MessageBus)
+	c.Assert(err, IsNil)
+
+	start, err := protocol.ParseStartMessage([]byte(`{"task":"some-guid","secure_token":"some-token","memory_limit":1,"disk_limit":1}`))
+	c.Assert(err, IsNil)
+
+	err = agent.handleStart(start)
+	c.Assert(err, IsNil)
+
+	task, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+
+	_, _, err = task.Start()
+	c.Assert(err, IsNil)
+
+	// give bash time to set up its trap
+	time.Sleep(100 * time.Millisecond)
+
+	started := time.Now()
+
+	s.MessageBus.PublishSync("task.stop."+agent.ID.String(), []byte(`{"task":"some-guid"}`))
+
+	c.Assert(time.Since(started) < 1*time.Second, Equals, true)
+
+	_, found = agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+
+	c.Assert(task.State(), Not(Equals), TaskStateCompleted)
+}
+
+func (s *ASuite) TestAgentKeepsATaskRestartedWhileTheOldOneStops(c *C) {
+	agent, err := NewAgent(FakeTaskBackend{Command: exec.Command("bash", "-c", `trap "" HUP TERM; sleep 100`)}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	agent.StopGracePeriod = 500 * time.Millisecond
+
+	start, err := protocol.ParseStartMessage([]byte(`{"task":"some-guid","secure_token":"some-token","memory_limit":1,"disk_limit":1}`))
+	c.Assert(err, IsNil)
+
+	err = agent.handleStart(start)
+	c.Assert(err, IsNil)
+
+	old, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+
+	_, _, err = old.Start()
+	c.Assert(err, IsNil)
+
+	// give bash time to set up its trap
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan bool, 1)
+
+	old.OnComplete(func() {
+		stopped <- true
+	})
+
+	err = agent.handleStop(protocol.StopMessage{Task: "some-guid"})
+	c.Assert(err, IsNil)
+
+	// restart the guid during the old task's grace period
+	err = agent.handleStart(start)
+	c.Assert(err, IsNil)
+
+	restarted, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(restarted, Not(Equals), old)
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		c.Fatal("old task never stopped")
+	}
+
+	// let the old task's completion be handled
+	time.Sleep(50 * time.Millisecond)
+
+	task, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(task, Equals, restarted)
+
+	c.Assert(s.RouterClient.IsRegistered(42, "some-guid"), Equals, true)
+	c.Assert(agent.Advertisement().RunningTasks, Equals, 1)
+
+	status, found := agent.TaskStatus("some-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(status.State, Not(Equals), TaskStateCompleted)
+}
+
 func (s *ASuite) TestAgentIgnoresDuplicateStarts(c *C) {
 	s.MessageBus.PublishSync("task.start", []byte(`
 	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
@@ -182,6 +305,100 @@ func (s *ASuite) TestAgentTaskCreationDoesMemoryLimits(c *C) {
 	c.Assert(*container.LimitedMemory, Equals, uint64(3*1024*1024))
 }
 
+func (s *ASuite) TestAgentTaskCreationUsesAllowedImages(c *C) {
+	s.Agent.Images = []string{"some-image"}
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":1,"disk_limit":1,"image":"some-image"}
+	`))
+
+	container := s.FakeContainerForGuid(c, "some-guid")
+	c.Assert(container.Image, Equals, "some-image")
+}
+
+func (s *ASuite) TestAgentTaskCreationUsesTheNetworkPolicy(c *C) {
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":1,"disk_limit":1,
+	     "outbound_bandwidth":1024,
+	     "network":{"mode":"allow","allow":[{"network":"10.0.0.0/8","ports":"80"}]}}
+	`))
+
+	container := s.FakeContainerForGuid(c, "some-guid")
+	c.Assert(container.Network, DeepEquals, NetworkPolicy{
+		Mode:  NetworkAllowList,
+		Allow: []NetworkRule{{Network: "10.0.0.0/8", Ports: "80"}},
+	})
+
+	task, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(task.Limits.OutboundBandwidth, Equals, uint64(1024))
+}
+
+func (s *ASuite) TestAgentNewTaskDoesNotCreateATaskWithAnImageNotAllowed(c *C) {
+	s.Agent.Images = []string{"some-image"}
+
+	reported := make(chan []byte, 1)
+
+	s.MessageBus.Subscribe(protocol.ErrorSubject, func(payload []byte) {
+		reported <- payload
+	})
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":1,"disk_limit":1,"image":"some-other-image"}
+	`))
+
+	_, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+
+	var message protocol.ErrorMessage
+
+	err := json.Unmarshal(waitReceive(reported, 1*time.Second), &message)
+	c.Assert(err, IsNil)
+	c.Assert(message.Error, Equals, ImageNotAllowed.Error())
+}
+
+func (s *ASuite) TestAgentTaskCreationAppliesDefaultLimits(c *C) {
+	s.Agent.DefaultLimits = TaskLimits{CPUShares: 256, PIDLimit: 512, FDLimit: 1024}
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":1,"disk_limit":1,"cpu_quota":50,"pid_limit":64}
+	`))
+
+	task, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(task.Limits, Equals, TaskLimits{
+		MemoryLimitInBytes: 1024 * 1024,
+		DiskLimitInBytes:   1024 * 1024,
+		CPUShares:          256,
+		CPUQuotaInPercent:  50,
+		PIDLimit:           64,
+		FDLimit:            1024,
+	})
+}
+
+func (s *ASuite) TestAgentNewTaskDoesNotCreateATaskAboveTheMaximumLimits(c *C) {
+	s.Agent.MaximumLimits = TaskLimits{PIDLimit: 1024}
+
+	reported := make(chan []byte, 1)
+
+	s.MessageBus.Subscribe(protocol.ErrorSubject, func(payload []byte) {
+		reported <- payload
+	})
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":1,"disk_limit":1,"pid_limit":2048}
+	`))
+
+	_, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+
+	var message protocol.ErrorMessage
+
+	err := json.Unmarshal(waitReceive(reported, 1*time.Second), &message)
+	c.Assert(err, IsNil)
+	c.Assert(message.Error, Equals, TaskLimitsTooHigh.Error())
+}
+
 func (s *ASuite) TestAgentNewTaskDoesNotCreateATaskWhenNoMemoryLimit(c *C) {
 	s.MessageBus.PublishSync("task.start", []byte(`
 	    {"task":"some-guid","secure_token":"some-token","disk_limit":4}
@@ -191,3 +408,405 @@ func (s *ASuite) TestAgentNewTaskDoesNotCreateATaskWhenNoMemoryLimit(c *C) {
 	c.Assert(found, Equals, false)
 	c.Assert(task, IsNil)
 }
+
+func (s *ASuite) TestAgentRunsSetupScriptsAfterUnpackingTheDroplet(c *C) {
+	root := c.MkDir()
+
+	err := ioutil.WriteFile(filepath.Join(root, "droplet.tgz"), nil, 0644)
+	c.Assert(err, IsNil)
+
+	container := &FakeContainer{Handle: "narc-some-guid"}
+
+	agent, err := NewAgent(FakeTaskBackend{Container: container}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	agent.BindMountRoots = []string{root}
+
+	start, err := protocol.ParseStartMessage([]byte(`{"task":"some-guid","secure_token":"some-token",
+		"memory_limit":1,"disk_limit":1,"droplet":"` + root + `/droplet.tgz","setup":["cd app && bundle install"]}`))
+	c.Assert(err, IsNil)
+
+	err = agent.handleStart(start)
+	c.Assert(err, IsNil)
+
+	c.Assert(container.LastCommand, Equals, "cd app && bundle install")
+
+	_, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+}
+
+func (s *ASuite) TestAgentFailsTheStartWhenASetupScriptExitsNonZero(c *C) {
+	container := &FakeContainer{Handle: "narc-some-guid", ExitStatus: 1}
+
+	agent, err := NewAgent(FakeTaskBackend{Container: container}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	start, err := protocol.ParseStartMessage([]byte(`{"task":"some-guid","secure_token":"some-token",
+		"memory_limit":1,"disk_limit":1,"setup":["false"]}`))
+	c.Assert(err, IsNil)
+
+	err = agent.handleStart(start)
+	c.Assert(err, Equals, TaskSetupFailed)
+
+	c.Assert(container.IsDestroyed(), Equals, true)
+	c.Assert(s.RouterClient.IsRegistered(42, "some-guid"), Equals, false)
+
+	_, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+}
+
+func (s *ASuite) TestAgentDestroysTheContainerWhenSetupFails(c *C) {
+	container := &FakeContainer{Handle: "narc-some-guid", ShouldError: true}
+
+	agent, err := NewAgent(FakeTaskBackend{Container: container}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	_, err = agent.startTask("some-token", ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 1},
+	}, []string{"exit 1"}, StopPolicy{})
+	c.Assert(err, NotNil)
+
+	c.Assert(container.IsDestroyed(), Equals, true)
+
+	_, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+}
+
+func (s *ASuite) TestAgentReportsInvalidStarts(c *C) {
+	reported := make(chan []byte, 1)
+
+	s.MessageBus.Subscribe("task.error", func(payload []byte) {
+		reported <- payload
+	})
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":1}
+	`))
+
+	select {
+	case payload := <-reported:
+		var message protocol.ErrorMessage
+		err := json.Unmarshal(payload, &message)
+		c.Assert(err, IsNil)
+
+		c.Assert(message, DeepEquals, protocol.ErrorMessage{
+			Version: protocol.Version,
+			Subject: "task.start",
+			Task:    "some-guid",
+			Error:   "disk_limit: must be greater than zero",
+		})
+	case <-time.After(1 * time.Second):
+		c.Error("Invalid start was not reported.")
+	}
+}
+
+func (s *ASuite) TestAgentReportsMalformedStops(c *C) {
+	reported := make(chan []byte, 1)
+
+	s.MessageBus.Subscribe("task.error", func(payload []byte) {
+		reported <- payload
+	})
+
+	s.MessageBus.PublishSync("task.stop", []byte(`{"task":`))
+
+	select {
+	case payload := <-reported:
+		var message protocol.ErrorMessage
+		err := json.Unmarshal(payload, &message)
+		c.Assert(err, IsNil)
+
+		c.Assert(message.Subject, Equals, "task.stop")
+		c.Assert(message.Error, Matches, "malformed payload: .*")
+	case <-time.After(1 * time.Second):
+		c.Error("Malformed stop was not reported.")
+	}
+}
+
+func (s *ASuite) TestAgentHandlesDirectedStartsAndStops(c *C) {
+	s.MessageBus.PublishSync("task.start."+s.Agent.ID.String(), []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+
+	container := s.FakeContainerForGuid(c, "some-guid")
+
+	s.MessageBus.PublishSync("task.stop."+s.Agent.ID.String(), []byte(`{"task":"some-guid"}`))
+
+	_, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+
+	waitForDestroy(container)
+
+	c.Assert(container.IsDestroyed(), Equals, true)
+}
+
+func (s *ASuite) TestAgentIgnoresStartsPlacedOnOtherAgents(c *C) {
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"agent":"some-other-agent","task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+
+	_, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+
+	s.MessageBus.PublishSync("task.start", []byte(fmt.Sprintf(`
+	    {"agent":"%s","task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`, s.Agent.ID.String())))
+
+	_, found = s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+}
+
+func (s *ASuite) TestAgentHandlesUnplacedStartsWithoutAQueueGroup(c *C) {
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+
+	_, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+}
+
+func (s *ASuite) TestOneAgentInTheQueueGroupHandlesUnplacedStarts(c *C) {
+	mbus := newQueueMessageBus()
+
+	reported := make(chan []byte, 2)
+
+	mbus.Subscribe("task.error", func(payload []byte) {
+		reported <- payload
+	})
+
+	agents := []*Agent{}
+
+	for i := 0; i < 2; i++ {
+		agent, err := NewAgent(FakeTaskBackend{}, s.RouterClient, 42)
+		c.Assert(err, IsNil)
+
+		err = agent.HandleStarts(mbus)
+		c.Assert(err, IsNil)
+
+		agents = append(agents, agent)
+	}
+
+	mbus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+
+	started := 0
+
+	for _, agent := range agents {
+		task, found := agent.Registry.Lookup("some-guid")
+		if found {
+			started++
+			task.Stop()
+		}
+	}
+
+	c.Assert(started, Equals, 1)
+
+	mbus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":1}
+	`))
+
+	waitReceive(reported, 1*time.Second)
+
+	select {
+	case payload := <-reported:
+		c.Errorf("Invalid start was reported twice: %s", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (s *ASuite) TestAgentIgnoresDirectedStartsForOtherAgents(c *C) {
+	s.MessageBus.PublishSync("task.start.some-other-agent", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+
+	_, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+}
+
+func (s *ASuite) TestAgentAdvertisementReflectsRunningTasks(c *C) {
+	s.Agent.Host = "1.2.3.4"
+	s.Agent.Capacity = CapacityConfig{
+		MemoryInBytes: 128 * 1024 * 1024,
+		DiskInBytes:   64 * 1024 * 1024,
+	}
+	s.Agent.HostKeyFingerprint = "some-fingerprint"
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+
+	c.Assert(s.Agent.Advertisement(), DeepEquals, protocol.AdvertiseMessage{
+		Version:            protocol.Version,
+		ID:                 s.Agent.ID.String(),
+		Host:               "1.2.3.4",
+		Port:               42,
+		HostKeyFingerprint: "some-fingerprint",
+		TotalMemory:        128,
+		TotalDisk:          64,
+		AvailableMemory:    96,
+		AvailableDisk:      63,
+		RunningTasks:       1,
+	})
+
+	s.MessageBus.PublishSync("task.stop", []byte(`{"task":"some-guid"}`))
+
+	advertisement := s.Agent.Advertisement()
+	c.Assert(advertisement.AvailableMemory, Equals, uint64(128))
+	c.Assert(advertisement.AvailableDisk, Equals, uint64(64))
+	c.Assert(advertisement.RunningTasks, Equals, 0)
+}
+
+func (s *ASuite) TestAgentReportsTaskStatus(c *C) {
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+
+	task, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+
+	status, found := s.Agent.TaskStatus("some-guid")
+	c.Assert(found, Equals, true)
+
+	c.Assert(status, DeepEquals, protocol.TaskStatus{
+		Task:            "some-guid",
+		State:           "pending",
+		StartedAt:       task.StartedAt,
+		ContainerHandle: task.container.ID(),
+		MemoryLimit:     32,
+		DiskLimit:       1,
+		Usage:           &protocol.TaskUsage{},
+	})
+
+	s.MessageBus.PublishSync("task.stop", []byte(`{"task":"some-guid"}`))
+
+	status, found = s.Agent.TaskStatus("some-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(status.Task, Equals, "some-guid")
+}
+
+func (s *ASuite) TestAgentReportsTaskUsage(c *C) {
+	container := &FakeContainer{
+		Handle: "narc-some-guid",
+		Usage: ContainerInfo{
+			MemoryUsageInBytes: 12 * 1024 * 1024,
+			DiskUsageInBytes:   3 * 1024 * 1024,
+			CPUTime:            1500 * time.Millisecond,
+			Processes:          4,
+			NetworkRxBytes:     100,
+			NetworkTxBytes:     200,
+		},
+	}
+
+	s.Agent.taskBackend = FakeTaskBackend{Container: container}
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+
+	status, found := s.Agent.TaskStatus("some-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(status.Usage, DeepEquals, &protocol.TaskUsage{
+		Memory:    12,
+		Disk:      3,
+		CPUTime:   1.5,
+		Processes: 4,
+		NetworkRx: 100,
+		NetworkTx: 200,
+	})
+
+	container.ShouldError = true
+
+	status, found = s.Agent.TaskStatus("some-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(status.Usage, IsNil)
+}
+
+func (s *ASuite) TestAgentStatusRequestForUnknownTask(c *C) {
+	response := s.Agent.handleStatusRequest([]byte(`{"task":"bogus-guid"}`))
+	c.Assert(response, DeepEquals, protocol.StatusResponse{
+		Version: protocol.Version,
+		Error:   "task not registered",
+	})
+
+	response = s.Agent.handleStatusRequest([]byte(`{}`))
+	c.Assert(response.Error, Equals, "task: must be present")
+}
+
+func (s *ASuite) TestOnlyTheAgentRunningATaskAnswersBroadcastStatusRequests(c *C) {
+	other, err := NewAgent(FakeTaskBackend{}, fake_gibson.NewFakeRouterClient(), 42)
+	c.Assert(err, IsNil)
+
+	err = s.Agent.HandleStatusRequests(s.MessageBus)
+	c.Assert(err, IsNil)
+
+	err = other.HandleStatusRequests(s.MessageBus)
+	c.Assert(err, IsNil)
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+
+	replies := make(chan []byte, 2)
+
+	s.MessageBus.Subscribe("some-inbox", func(payload []byte) {
+		replies <- payload
+	})
+
+	s.MessageBus.PublishSync("task.status", []byte(`{"task":"some-guid","reply_to":"some-inbox"}`))
+	c.Assert(replies, HasLen, 1)
+
+	var response protocol.StatusResponse
+	err = json.Unmarshal(<-replies, &response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Error, Equals, "")
+	c.Assert(response.Status.Task, Equals, "some-guid")
+
+	s.MessageBus.PublishSync("task.status", []byte(`{"task":"bogus-guid","reply_to":"some-inbox"}`))
+	c.Assert(replies, HasLen, 0)
+}
+
+func (s *ASuite) TestAgentAnswersDirectedStatusRequestsForUnknownTasks(c *C) {
+	err := s.Agent.HandleStatusRequests(s.MessageBus)
+	c.Assert(err, IsNil)
+
+	replies := make(chan []byte, 1)
+
+	s.MessageBus.Request(protocol.StatusSubjectFor(s.Agent.ID.String()), []byte(`{"task":"bogus-guid"}`), func(payload []byte) {
+		replies <- payload
+	})
+
+	var response protocol.StatusResponse
+	err = json.Unmarshal(waitReceive(replies, 1*time.Second), &response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Error, Equals, "task not registered")
+}
+
+func (s *ASuite) TestAgentListsTasks(c *C) {
+	response := s.Agent.handleListRequest([]byte{})
+	c.Assert(response.Agent, Equals, s.Agent.ID.String())
+	c.Assert(response.Tasks, HasLen, 0)
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"guid-b","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"guid-a","secure_token":"some-token","memory_limit":16,"disk_limit":2}
+	`))
+
+	response = s.Agent.handleListRequest([]byte(`{"version":1}`))
+	c.Assert(response.Error, Equals, "")
+	c.Assert(response.Tasks, HasLen, 2)
+
+	c.Assert(response.Tasks[0].Task, Equals, "guid-a")
+	c.Assert(response.Tasks[0].MemoryLimit, Equals, uint64(16))
+	c.Assert(response.Tasks[1].Task, Equals, "guid-b")
+	c.Assert(response.Tasks[1].MemoryLimit, Equals, uint64(32))
+
+	s.MessageBus.PublishSync("task.stop", []byte(`{"task":"guid-a"}`))
+
+	response = s.Agent.handleListRequest([]byte{})
+	c.Assert(response.Tasks, HasLen, 1)
+	c.Assert(response.Tasks[0].Task, Equals, "guid-b")
+}
@@ -0,0 +1,77 @@
+package narc
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/narc/protocol"
+)
+
+// DropletMountPath is where a task's droplet is mounted in its container,
+// and DropletDirectory where it is unpacked.
+const DropletMountPath = "/tmp/droplet.tgz"
+const DropletDirectory = "/home/vcap"
+
+var BindMountNotAllowed = errors.New("bind mount source not allowed")
+
+// bindMountsFor returns the bind mounts a start message asks for, and the
+// setup scripts that unpack its droplet. Every source must be within one of
+// the agent's BindMountRoots once symlinks are resolved.
+func (agent *Agent) bindMountsFor(start protocol.StartMessage) ([]BindMount, []string, error) {
+	mounts := []BindMount{}
+	scripts := []string{}
+
+	for _, mount := range start.BindMounts {
+		src, err := agent.allowedBindMountSource(mount.SrcPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		mounts = append(mounts, BindMount{
+			SrcPath:  src,
+			DstPath:  filepath.Clean(mount.DstPath),
+			ReadOnly: mount.ReadOnly(),
+		})
+	}
+
+	if start.Droplet != "" {
+		src, err := agent.allowedBindMountSource(start.Droplet)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		mounts = append(mounts, BindMount{
+			SrcPath:  src,
+			DstPath:  DropletMountPath,
+			ReadOnly: true,
+		})
+
+		scripts = append(scripts, fmt.Sprintf(
+			"mkdir -p %s && tar -xzf %s -C %s",
+			DropletDirectory,
+			DropletMountPath,
+			DropletDirectory,
+		))
+	}
+
+	return mounts, scripts, nil
+}
+
+func (agent *Agent) allowedBindMountSource(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, root := range agent.BindMountRoots {
+		root = filepath.Clean(root)
+
+		if resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+			return resolved, nil
+		}
+	}
+
+	return "", BindMountNotAllowed
+}
@@ -0,0 +1,89 @@
+package narc
+
+import (
+	"github.com/cloudfoundry/gibson/fake_router_client"
+	"github.com/cloudfoundry/narc/protocol"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+)
+
+type BMSuite struct {
+	Root  string
+	Agent *Agent
+}
+
+func init() {
+	Suite(&BMSuite{})
+}
+
+func (s *BMSuite) SetUpTest(c *C) {
+	s.Root = c.MkDir()
+
+	err := os.MkdirAll(filepath.Join(s.Root, "droplets", "app"), 0755)
+	c.Assert(err, IsNil)
+
+	err = ioutil.WriteFile(filepath.Join(s.Root, "droplets", "droplet.tgz"), nil, 0644)
+	c.Assert(err, IsNil)
+
+	err = os.Symlink("/etc", filepath.Join(s.Root, "droplets", "escape"))
+	c.Assert(err, IsNil)
+
+	s.Agent, err = NewAgent(FakeTaskBackend{}, fake_gibson.NewFakeRouterClient(), 42)
+	c.Assert(err, IsNil)
+
+	s.Agent.BindMountRoots = []string{filepath.Join(s.Root, "droplets")}
+}
+
+func (s *BMSuite) start(c *C, payload string) error {
+	start, err := protocol.ParseStartMessage([]byte(payload))
+	c.Assert(err, IsNil)
+
+	return s.Agent.handleStart(start)
+}
+
+func (s *BMSuite) TestStartsWithAllowedBindMounts(c *C) {
+	err := s.start(c, `{"task":"some-guid","secure_token":"some-token","memory_limit":1,"disk_limit":1,
+		"bind_mounts":[
+			{"src_path":"`+s.Root+`/droplets/app","dst_path":"/home/vcap/app"},
+			{"src_path":"`+s.Root+`/droplets/app","dst_path":"/tmp/app/","mode":"rw"}
+		]}`)
+	c.Assert(err, IsNil)
+
+	task, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+
+	c.Assert(task.container.(*FakeContainer).BindMounts, DeepEquals, []BindMount{
+		{SrcPath: s.Root + "/droplets/app", DstPath: "/home/vcap/app", ReadOnly: true},
+		{SrcPath: s.Root + "/droplets/app", DstPath: "/tmp/app", ReadOnly: false},
+	})
+}
+
+func (s *BMSuite) TestRejectsBindMountsOutsideTheRoots(c *C) {
+	for _, src := range []string{"/etc", s.Root + "/droplets/escape", s.Root + "/droplets/../droplets-not"} {
+		err := s.start(c, `{"task":"some-guid","secure_token":"some-token","memory_limit":1,"disk_limit":1,
+			"bind_mounts":[{"src_path":"`+src+`","dst_path":"/home/vcap/app"}]}`)
+		c.Assert(err, NotNil)
+	}
+
+	_, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+}
+
+func (s *BMSuite) TestUnpacksDroplets(c *C) {
+	err := s.start(c, `{"task":"some-guid","secure_token":"some-token","memory_limit":1,"disk_limit":1,
+		"droplet":"`+s.Root+`/droplets/droplet.tgz"}`)
+	c.Assert(err, IsNil)
+
+	task, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+
+	container := task.container.(*FakeContainer)
+
+	c.Assert(container.BindMounts, DeepEquals, []BindMount{
+		{SrcPath: s.Root + "/droplets/droplet.tgz", DstPath: DropletMountPath, ReadOnly: true},
+	})
+
+	c.Assert(container.LastCommand, Equals, "mkdir -p /home/vcap && tar -xzf /tmp/droplet.tgz -C /home/vcap")
+}
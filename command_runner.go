@@ -6,10 +6,33 @@ import (
 )
 
 type CreateContainerMessage struct {
-	WardenSocketPath string `json:"warden_socket_path"`
-	DiskLimit        uint64 `json:"disk_limit"`
-	MemoryLimit      uint64 `json:"memory_limit"`
-	Network          bool   `json:"network"`
+	WardenSocketPath  string               `json:"warden_socket_path"`
+	Handle            string               `json:"handle"`
+	Properties        map[string]string    `json:"properties"`
+	Image             string               `json:"image,omitempty"`
+	BindMounts        []BindMountMessage   `json:"bind_mounts,omitempty"`
+	DiskLimit         uint64               `json:"disk_limit"`
+	MemoryLimit       uint64               `json:"memory_limit"`
+	CPUShares         uint64               `json:"cpu_shares"`
+	CPUQuota          uint64               `json:"cpu_quota"`
+	PIDLimit          uint64               `json:"pid_limit"`
+	FDLimit           uint64               `json:"fd_limit"`
+	InboundBandwidth  uint64               `json:"inbound_bandwidth"`
+	OutboundBandwidth uint64               `json:"outbound_bandwidth"`
+	Network           bool                 `json:"network"`
+	NetworkMode       string               `json:"network_mode,omitempty"`
+	NetworkAllow      []NetworkRuleMessage `json:"network_allow,omitempty"`
+}
+
+type NetworkRuleMessage struct {
+	Network string `json:"network"`
+	Ports   string `json:"ports,omitempty"`
+}
+
+type BindMountMessage struct {
+	SrcPath string `json:"src_path"`
+	DstPath string `json:"dst_path"`
+	Mode    string `json:"mode"`
 }
 
 type CreateContainerResponse struct {
@@ -24,29 +47,43 @@ type ContainerCreationRunner interface {
 	Run(request *CreateContainerMessage, response *CreateContainerResponse, cmd string) error
 }
 
-type ContainerCreationRunnerInJson struct {}
+type ContainerCreationRunnerInJson struct{}
 
 func (runner *ContainerCreationRunnerInJson) Run(request *CreateContainerMessage, response *CreateContainerResponse, executable string) error {
 	cmd := exec.Command(executable)
-	stdin, _ := cmd.StdinPipe()
-	stdout, _ := cmd.StdoutPipe()
 
-	err := cmd.Start()
+	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return err
 	}
 
-	json.NewEncoder(stdin).Encode(request)
-	stdin.Close()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
 
-	err = json.NewDecoder(stdout).Decode(response)
+	err = cmd.Start()
 	if err != nil {
 		return err
 	}
 
-	err = cmd.Wait()
+	err = json.NewEncoder(stdin).Encode(request)
+	if err == nil {
+		err = stdin.Close()
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	err = json.NewDecoder(stdout).Decode(response)
 	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
 		return err
 	}
-	return nil
+
+	return cmd.Wait()
 }
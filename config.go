@@ -1,6 +1,7 @@
 package narc
 
 import (
+	"fmt"
 	"github.com/kylelemons/go-gypsy/yaml"
 	"strconv"
 	"time"
@@ -8,11 +9,31 @@ import (
 
 type Config struct {
 	Host                 string
+	Name                 string
 	MessageBus           MessageBusConfig
 	Capacity             CapacityConfig
 	AdvertiseInterval    time.Duration
+	Backend              string
 	WardenSocketPath     string
 	WardenContainersPath string
+	WardenConfigPath     string
+	WardenCreateScript   string
+	DockerSocketPath     string
+	DockerImage          string
+	DockerUser           string
+	DockerDiskLimits     bool
+	ProcessRoot          string
+	ProcessUnshare       bool
+	Linux                LinuxConfig
+	ReconcilePolicy      ReconcilePolicy
+	StatePath            string
+	SnapshotPath         string
+	DrainTimeout         time.Duration
+	StopGracePeriod      time.Duration
+	Pool                 PoolConfig
+	Limits               LimitsConfig
+	Images               []string
+	BindMountRoots       []string
 }
 
 type MessageBusConfig struct {
@@ -22,6 +43,28 @@ type MessageBusConfig struct {
 	Password string
 }
 
+// PoolConfig configures how many containers are kept ready per limits
+// class, and which classes to fill on startup. A size of zero disables the
+// pool.
+type PoolConfig struct {
+	Size    int
+	Classes []TaskLimits
+}
+
+// LimitsConfig holds the CPU, PID and file descriptor limits tasks get when
+// their start message does not set them, and the most they may ask for.
+// Zero leaves a limit to the backend, or a maximum unenforced.
+type LimitsConfig struct {
+	Defaults TaskLimits
+	Maximums TaskLimits
+}
+
+type LinuxConfig struct {
+	Paths LinuxPaths
+	UID   int
+	GID   int
+}
+
 type CapacityConfig struct {
 	MemoryInBytes uint64
 	DiskInBytes   uint64
@@ -44,10 +87,33 @@ var DefaultConfig = Config{
 		DiskInBytes:   1 * gigabyte,
 	},
 
+	Backend: "warden",
+
 	WardenSocketPath:     "/tmp/warden.sock",
 	WardenContainersPath: "/opt/warden/containers",
 
+	DockerSocketPath: "/var/run/docker.sock",
+	DockerImage:      "ubuntu",
+
+	ProcessRoot: "/tmp/narc",
+
+	Linux: LinuxConfig{
+		Paths: LinuxPaths{
+			Containers: "/var/vcap/data/narc/containers",
+			RootFS:     "/var/vcap/data/narc/rootfs",
+			Cgroup:     "/sys/fs/cgroup/narc",
+		},
+		UID: 10000,
+		GID: 10000,
+	},
+
 	AdvertiseInterval: 10 * time.Second,
+
+	ReconcilePolicy: ReconcileDestroy,
+
+	DrainTimeout: 30 * time.Second,
+
+	StopGracePeriod: 10 * time.Second,
 }
 
 func LoadConfig(configFilePath string) Config {
@@ -55,6 +121,11 @@ func LoadConfig(configFilePath string) Config {
 
 	host := file.Require("host")
 
+	name, _ := file.Get("name")
+	if name == "" {
+		name = host
+	}
+
 	mbusHost := file.Require("message_bus.host")
 	mbusPort, err := strconv.Atoi(file.Require("message_bus.port"))
 	if err != nil {
@@ -64,8 +135,63 @@ func LoadConfig(configFilePath string) Config {
 	mbusUsername, _ := file.Get("message_bus.username")
 	mbusPassword, _ := file.Get("message_bus.password")
 
-	wardenContainersPath := file.Require("warden.containers")
-	wardenSocketPath := file.Require("warden.socket")
+	backend := DefaultConfig.Backend
+
+	configuredBackend, err := file.Get("backend")
+	if err == nil && configuredBackend != "" {
+		backend = configuredBackend
+	}
+
+	wardenContainersPath := DefaultConfig.WardenContainersPath
+	wardenSocketPath := DefaultConfig.WardenSocketPath
+
+	if backend == "warden" {
+		wardenContainersPath = file.Require("warden.containers")
+		wardenSocketPath = file.Require("warden.socket")
+	}
+
+	wardenConfigPath, _ := file.Get("warden.config")
+	wardenCreateScript, _ := file.Get("warden.create_script")
+
+	dockerSocketPath := DefaultConfig.DockerSocketPath
+	dockerImage := DefaultConfig.DockerImage
+
+	if backend == "docker" {
+		dockerSocketPath = file.Require("docker.socket")
+		dockerImage = file.Require("docker.image")
+	}
+
+	dockerUser, _ := file.Get("docker.user")
+	dockerDiskLimits, _ := file.Get("docker.disk_limits")
+
+	processRoot := DefaultConfig.ProcessRoot
+
+	configuredProcessRoot, err := file.Get("process.root")
+	if err == nil && configuredProcessRoot != "" {
+		processRoot = configuredProcessRoot
+	}
+
+	processUnshare, _ := file.Get("process.unshare")
+
+	linux := DefaultConfig.Linux
+
+	if backend == "linux" {
+		linux.Paths = LinuxPaths{
+			Containers: file.Require("linux.containers"),
+			RootFS:     file.Require("linux.rootfs"),
+			Cgroup:     file.Require("linux.cgroup"),
+		}
+
+		linux.UID, err = strconv.Atoi(file.Require("linux.uid"))
+		if err != nil {
+			panic("non-numeric linux uid")
+		}
+
+		linux.GID, err = strconv.Atoi(file.Require("linux.gid"))
+		if err != nil {
+			panic("non-numeric linux gid")
+		}
+	}
 
 	capacityMemory, err := strconv.Atoi(file.Require("capacity.memory"))
 	if err != nil {
@@ -82,8 +208,100 @@ func LoadConfig(configFilePath string) Config {
 		panic("non-numeric advertise interval")
 	}
 
+	reconcilePolicy := DefaultConfig.ReconcilePolicy
+
+	policy, err := file.Get("reconcile")
+	if err == nil && policy != "" {
+		reconcilePolicy, err = ParseReconcilePolicy(policy)
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+
+	statePath, _ := file.Get("state_file")
+
+	snapshotPath, _ := file.Get("snapshot_dir")
+
+	drainTimeout := DefaultConfig.DrainTimeout
+
+	drainTimeoutSeconds, err := file.Get("drain_timeout")
+	if err == nil && drainTimeoutSeconds != "" {
+		seconds, err := strconv.Atoi(drainTimeoutSeconds)
+		if err != nil {
+			panic("non-numeric drain timeout")
+		}
+
+		drainTimeout = time.Duration(seconds) * time.Second
+	}
+
+	stopGracePeriod := DefaultConfig.StopGracePeriod
+
+	stopGracePeriodSeconds, err := file.Get("stop_grace_period")
+	if err == nil && stopGracePeriodSeconds != "" {
+		seconds, err := strconv.Atoi(stopGracePeriodSeconds)
+		if err != nil {
+			panic("non-numeric stop grace period")
+		}
+
+		stopGracePeriod = time.Duration(seconds) * time.Second
+	}
+
+	pool := PoolConfig{}
+
+	poolSize, err := file.Get("pool.size")
+	if err == nil && poolSize != "" {
+		pool.Size, err = strconv.Atoi(poolSize)
+		if err != nil {
+			panic("non-numeric pool size")
+		}
+	}
+
+	poolClasses, err := file.Count("pool.classes")
+	if err == nil {
+		for i := 0; i < poolClasses; i++ {
+			memory, err := strconv.Atoi(file.Require(fmt.Sprintf("pool.classes[%d].memory", i)))
+			if err != nil {
+				panic("non-numeric pool class memory")
+			}
+
+			disk, err := strconv.Atoi(file.Require(fmt.Sprintf("pool.classes[%d].disk", i)))
+			if err != nil {
+				panic("non-numeric pool class disk")
+			}
+
+			pool.Classes = append(pool.Classes, TaskLimits{
+				MemoryLimitInBytes: uint64(memory) * megabyte,
+				DiskLimitInBytes:   uint64(disk) * megabyte,
+			})
+		}
+	}
+
+	limits := LimitsConfig{
+		Defaults: loadTaskLimits(file, "limits.defaults"),
+		Maximums: loadTaskLimits(file, "limits.maximums"),
+	}
+
+	images := []string{}
+
+	imageCount, err := file.Count("images")
+	if err == nil {
+		for i := 0; i < imageCount; i++ {
+			images = append(images, file.Require(fmt.Sprintf("images[%d]", i)))
+		}
+	}
+
+	bindMountRoots := []string{}
+
+	bindMountRootCount, err := file.Count("bind_mount_roots")
+	if err == nil {
+		for i := 0; i < bindMountRootCount; i++ {
+			bindMountRoots = append(bindMountRoots, file.Require(fmt.Sprintf("bind_mount_roots[%d]", i)))
+		}
+	}
+
 	return Config{
 		Host: host,
+		Name: name,
 
 		MessageBus: MessageBusConfig{
 			Host:     mbusHost,
@@ -99,7 +317,108 @@ func LoadConfig(configFilePath string) Config {
 
 		AdvertiseInterval: time.Duration(advertiseInterval) * time.Second,
 
+		Backend: backend,
+
 		WardenSocketPath:     wardenSocketPath,
 		WardenContainersPath: wardenContainersPath,
+		WardenConfigPath:     wardenConfigPath,
+		WardenCreateScript:   wardenCreateScript,
+
+		DockerSocketPath: dockerSocketPath,
+		DockerImage:      dockerImage,
+		DockerUser:       dockerUser,
+		DockerDiskLimits: dockerDiskLimits == "true",
+
+		ProcessRoot:    processRoot,
+		ProcessUnshare: processUnshare == "true",
+
+		Linux: linux,
+
+		ReconcilePolicy: reconcilePolicy,
+		StatePath:       statePath,
+		SnapshotPath:    snapshotPath,
+		DrainTimeout:    drainTimeout,
+		StopGracePeriod: stopGracePeriod,
+
+		Pool:   pool,
+		Limits: limits,
+		Images: images,
+
+		BindMountRoots: bindMountRoots,
+	}
+}
+
+// loadTaskLimits reads the optional CPU, PID and file descriptor limits
+// under the given key.
+func loadTaskLimits(file *yaml.File, key string) TaskLimits {
+	limits := TaskLimits{}
+
+	for name, limit := range map[string]*uint64{
+		"cpu_shares": &limits.CPUShares,
+		"cpu_quota":  &limits.CPUQuotaInPercent,
+		"pid_limit":  &limits.PIDLimit,
+		"fd_limit":   &limits.FDLimit,
+	} {
+		value, err := file.Get(key + "." + name)
+		if err != nil || value == "" {
+			continue
+		}
+
+		*limit, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("non-numeric %s.%s", key, name))
+		}
+	}
+
+	return limits
+}
+
+// TaskBackend returns the task backend the config selects.
+func (config Config) TaskBackend() (TaskBackend, error) {
+	switch config.Backend {
+	case "warden":
+		deniesOutbound := false
+
+		if config.WardenConfigPath != "" {
+			var err error
+
+			deniesOutbound, err = WardenDeniesOutbound(config.WardenConfigPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return WardenTaskBackend{
+			WardenSocketPath:     config.WardenSocketPath,
+			WardenContainersPath: config.WardenContainersPath,
+			DeniesOutbound:       deniesOutbound,
+			Owner:                config.Name,
+
+			ContainerCreationScript: config.WardenCreateScript,
+		}, nil
+
+	case "docker":
+		return DockerTaskBackend{
+			SocketPath: config.DockerSocketPath,
+			Image:      config.DockerImage,
+			User:       config.DockerUser,
+			DiskLimits: config.DockerDiskLimits,
+			Owner:      config.Name,
+		}, nil
+
+	case "process":
+		return ProcessTaskBackend{
+			Root:    config.ProcessRoot,
+			Unshare: config.ProcessUnshare,
+		}, nil
+
+	case "linux":
+		return LinuxTaskBackend{
+			Paths: config.Linux.Paths,
+			UID:   config.Linux.UID,
+			GID:   config.Linux.GID,
+		}, nil
 	}
+
+	return nil, fmt.Errorf("unknown backend: %s", config.Backend)
 }
@@ -1,17 +1,372 @@
 package narc
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var DiskLimitNotChangeable = errors.New("the disk limit of an existing container cannot be changed")
+var NetworkPolicyNotSupported = errors.New("network policy not supported by the task backend")
+var DiskLimitNotSupported = errors.New("disk limits not enforced by the task backend")
+
 type MappedPort uint32
 
 type JobInfo struct {
 	ExitStatus uint32
+	Stdout     []byte
+	Stderr     []byte
 }
 
+var JobStreamInterrupted = errors.New("job stream ended before the job exited")
+
+// JobStream is the output of a running job. Stdout and Stderr must both be
+// read, concurrently, for the job's output to keep flowing; they reach EOF
+// when the job exits.
+type JobStream struct {
+	Stdout io.Reader
+	Stderr io.Reader
+
+	exited chan jobExit
+}
+
+type jobExit struct {
+	status uint32
+	err    error
+}
+
+func newJobStream() (*JobStream, *io.PipeWriter, *io.PipeWriter) {
+	stdout, stdoutWriter := io.Pipe()
+	stderr, stderrWriter := io.Pipe()
+
+	return &JobStream{
+		Stdout: stdout,
+		Stderr: stderr,
+		exited: make(chan jobExit, 1),
+	}, stdoutWriter, stderrWriter
+}
+
+// Wait returns the job's exit status once it has exited.
+func (s *JobStream) Wait() (uint32, error) {
+	exit := <-s.exited
+	s.exited <- exit
+
+	return exit.status, exit.err
+}
+
+// ContainerInfo is a container's current resource usage and limits.
+// Backends leave zero what they cannot report.
 type ContainerInfo struct {
 	MemoryLimitInBytes uint64
+	DiskLimitInBytes   uint64
+	MemoryUsageInBytes uint64
+	DiskUsageInBytes   uint64
+	CPUTime            time.Duration
+
+	// Processes is the number of processes in the container. Warden only
+	// reports the number of jobs it is running.
+	Processes int
+
+	NetworkRxBytes uint64
+	NetworkTxBytes uint64
+
+	// OutOfMemory is set once a process in the container has been killed
+	// for exceeding its memory limit.
+	OutOfMemory bool
+
+	// DiskQuotaExceeded is set if the container's disk is full.
+	DiskQuotaExceeded bool
+}
+
+// ContainerSpec describes the container a TaskBackend should provide for a
+// task. Handle defaults to ContainerHandleFor(Task), Image to the backend's
+// default image, and Network to the backend's default network.
+type ContainerSpec struct {
+	Task       string
+	Owner      string
+	Handle     string
+	Limits     TaskLimits
+	Image      string
+	BindMounts []BindMount
+	Network    NetworkPolicy
+}
+
+// NetworkMode says what a container may reach over the network.
+type NetworkMode string
+
+const (
+	// NetworkDefault leaves the network as the backend sets it up: warden
+	// maps a port into the container and applies its own outbound rules,
+	// docker attaches it to the default bridge, and linux containers have
+	// no network.
+	NetworkDefault NetworkMode = ""
+
+	// NetworkNone allows no traffic.
+	NetworkNone NetworkMode = "none"
+
+	// NetworkEgress allows outbound traffic anywhere, and no inbound
+	// traffic.
+	NetworkEgress NetworkMode = "egress"
+
+	// NetworkAllowList allows outbound traffic to the policy's allowed
+	// networks only, and no inbound traffic.
+	NetworkAllowList NetworkMode = "allow"
+)
+
+type NetworkPolicy struct {
+	Mode  NetworkMode
+	Allow []NetworkRule
+}
+
+// NetworkRule allows traffic to a network in CIDR notation, on a port or
+// range of ports such as "8000-9000", or on every port if Ports is empty.
+type NetworkRule struct {
+	Network string
+	Ports   string
+}
+
+type BindMount struct {
+	SrcPath  string
+	DstPath  string
+	ReadOnly bool
+}
+
+// ContainerHandlePrefix marks containers created by narc, so that they can
+// be found again after a restart.
+const ContainerHandlePrefix = "narc-"
+
+// PooledContainerHandlePrefix marks containers narc created ahead of time
+// for a ContainerPool. They are not tied to a task until checked out, and
+// keep their handle afterwards.
+const PooledContainerHandlePrefix = ContainerHandlePrefix + "pool-"
+
+func ContainerHandleFor(task string) string {
+	return ContainerHandlePrefix + task
+}
+
+func (spec ContainerSpec) ContainerHandle() string {
+	if spec.Handle != "" {
+		return spec.Handle
+	}
+
+	return ContainerHandleFor(spec.Task)
+}
+
+// TaskForContainerHandle returns the task a container was created for, and
+// false if the container was not created by narc for a task.
+func TaskForContainerHandle(handle string) (string, bool) {
+	if !strings.HasPrefix(handle, ContainerHandlePrefix) {
+		return "", false
+	}
+
+	if strings.HasPrefix(handle, PooledContainerHandlePrefix) {
+		return "", false
+	}
+
+	task := strings.TrimPrefix(handle, ContainerHandlePrefix)
+
+	return task, task != ""
 }
 
 type Container interface {
 	ID() string
 	Destroy() error
 	Run(command string) (*JobInfo, error)
+	Info() (*ContainerInfo, error)
+}
+
+// StreamingContainer is implemented by containers that can run jobs in the
+// background and stream their output.
+type StreamingContainer interface {
+	Container
+
+	// Spawn starts a job and returns its id without waiting for it.
+	Spawn(command string) (uint32, error)
+
+	// Stream streams a job's output as it runs.
+	Stream(jobID uint32) (*JobStream, error)
+
+	// Link waits for a job to exit and returns its status and output.
+	Link(jobID uint32) (*JobInfo, error)
+}
+
+// StreamOutContainer is implemented by containers that can stream paths
+// inside them out as a tar archive.
+type StreamOutContainer interface {
+	Container
+
+	// StreamOut streams a tar archive of the given absolute paths. The last
+	// read fails if the archive could not be completely written.
+	StreamOut(paths []string) (io.ReadCloser, error)
+}
+
+// LimitableContainer is implemented by containers whose limits can be
+// changed after they are created.
+type LimitableContainer interface {
+	Container
+
+	LimitMemory(limitInBytes uint64) error
+	LimitDisk(limitInBytes uint64) error
+}
+
+// LimitsKeepingContainer is implemented by containers that keep the limits
+// they were created with, e.g. to apply some of them to sessions. A restored
+// container does not know them, so they are given back from the task's
+// record.
+type LimitsKeepingContainer interface {
+	Container
+
+	RestoreLimits(limits TaskLimits)
+}
+
+// runJob runs a command to completion, collecting its output. A non-zero
+// exit status is not an error.
+func runJob(cmd *exec.Cmd) (*JobInfo, error) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return &JobInfo{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}, nil
+	}
+
+	status, err := exitStatusOf(err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JobInfo{
+		ExitStatus: status,
+		Stdout:     stdout.Bytes(),
+		Stderr:     stderr.Bytes(),
+	}, nil
+}
+
+// streamJob starts a command and streams its output like a job's.
+func streamJob(cmd *exec.Cmd) (*JobStream, error) {
+	stream, stdout, stderr := newJobStream()
+
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		exit := jobExit{}
+
+		err := cmd.Wait()
+		if err != nil {
+			exit.status, exit.err = exitStatusOf(err)
+		}
+
+		stdout.Close()
+		stderr.Close()
+
+		stream.exited <- exit
+	}()
+
+	return stream, nil
+}
+
+func exitStatusOf(err error) (uint32, error) {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, err
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 0, err
+	}
+
+	return uint32(status.ExitStatus()), nil
+}
+
+// tarArgs are the arguments to tar for archiving absolute paths relative to
+// root, so that the archive's entries are relative.
+func tarArgs(root string, paths []string) []string {
+	// paths after -- are never taken for options
+	args := []string{"-C", root, "-cf", "-", "--"}
+
+	for _, path := range paths {
+		args = append(args, strings.TrimLeft(path, "/"))
+	}
+
+	return args
+}
+
+// tarScript is tarArgs as a shell command, for backends that run scripts.
+func tarScript(paths []string) string {
+	script := "tar"
+
+	for _, arg := range tarArgs("/", paths) {
+		script += " " + shellQuote(arg)
+	}
+
+	return script
+}
+
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// archiveStream is a tar archive read from a job's stdout. The job's
+// stderr is kept to explain why it failed.
+type archiveStream struct {
+	job *JobStream
+
+	stderr     *bytes.Buffer
+	stderrDone chan struct{}
+}
+
+func newArchiveStream(job *JobStream) *archiveStream {
+	archive := &archiveStream{
+		job:        job,
+		stderr:     new(bytes.Buffer),
+		stderrDone: make(chan struct{}),
+	}
+
+	go func() {
+		io.Copy(archive.stderr, job.Stderr)
+		close(archive.stderrDone)
+	}()
+
+	return archive
+}
+
+func (a *archiveStream) Read(p []byte) (int, error) {
+	n, err := a.job.Stdout.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+
+	status, err := a.job.Wait()
+	if err != nil {
+		return n, err
+	}
+
+	if status != 0 {
+		<-a.stderrDone
+		return n, fmt.Errorf("tar exited with status %d: %s", status, strings.TrimSpace(a.stderr.String()))
+	}
+
+	return n, io.EOF
+}
+
+// Close discards the rest of the archive, so that the job can exit.
+func (a *archiveStream) Close() error {
+	_, err := io.Copy(ioutil.Discard, a.job.Stdout)
+	return err
 }
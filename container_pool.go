@@ -0,0 +1,285 @@
+package narc
+
+import (
+	"errors"
+	"log"
+	"os/exec"
+	"sort"
+	"sync"
+
+	"github.com/cloudfoundry/narc/protocol"
+	"github.com/nu7hatch/gouuid"
+)
+
+var ContainerNotLimitable = errors.New("container limits cannot be changed")
+var ContainerNotRestorable = errors.New("task backend cannot restore containers")
+
+// ContainerPool is a TaskBackend that keeps containers ready ahead of time,
+// so that starting a task does not wait for one to be created.
+//
+// Containers are pooled per limits class: requested memory is rounded up to
+// the next power of two megabytes, and only classes that were warmed are
+// pooled. A checked out container has the requested memory limit applied to
+// it, and the class is refilled in the background. Ready containers count
+// against the agent's capacity like running tasks.
+// Requests with bind mounts, for a specific image or with a network policy
+// always get a new container from the backend.
+type ContainerPool struct {
+	Backend TaskBackend
+	Size    int
+
+	ready   map[TaskLimits][]LimitableContainer
+	filling map[TaskLimits]int
+	closed  bool
+	lock    sync.Mutex
+}
+
+func NewContainerPool(backend TaskBackend, size int) *ContainerPool {
+	return &ContainerPool{
+		Backend: backend,
+		Size:    size,
+		ready:   make(map[TaskLimits][]LimitableContainer),
+		filling: make(map[TaskLimits]int),
+	}
+}
+
+// PoolClassFor returns the class of limits a container for the given limits
+// is pooled under.
+// Most backends cannot change disk limits, and none can change CPU, PID,
+// file descriptor or bandwidth limits, so they are part of the class as they
+// are.
+func PoolClassFor(limits TaskLimits) TaskLimits {
+	class := limits
+
+	class.MemoryLimitInBytes = roundUpToPowerOfTwoMegabytes(limits.MemoryLimitInBytes)
+
+	return class
+}
+
+// Warm starts pooling the class of the given limits, and fills it.
+func (p *ContainerPool) Warm(limits TaskLimits) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	class := PoolClassFor(limits)
+
+	if _, pooled := p.ready[class]; !pooled {
+		p.ready[class] = []LimitableContainer{}
+	}
+
+	p.refill(class)
+}
+
+func (p *ContainerPool) ProvideContainer(spec ContainerSpec) (Container, error) {
+	if p.Size <= 0 || spec.Image != "" || len(spec.BindMounts) > 0 || spec.Network.Mode != NetworkDefault {
+		return p.Backend.ProvideContainer(spec)
+	}
+
+	class := PoolClassFor(spec.Limits)
+
+	container, found := p.checkout(class)
+	if !found {
+		return p.Backend.ProvideContainer(spec)
+	}
+
+	err := resizeContainer(container, class, spec.Limits)
+	if err != nil {
+		log.Printf("failed to limit pooled container %s: %s\n", container.ID(), err)
+
+		destroyPooledContainer(container)
+
+		return p.Backend.ProvideContainer(spec)
+	}
+
+	log.Printf("checked out pooled container %s for task %s\n", container.ID(), spec.Task)
+
+	return container, nil
+}
+
+func (p *ContainerPool) ProvideCommand(container Container) *exec.Cmd {
+	return p.Backend.ProvideCommand(container)
+}
+
+func (p *ContainerPool) ListContainers() ([]Container, error) {
+	lister, ok := p.Backend.(ContainerLister)
+	if !ok {
+		return nil, nil
+	}
+
+	return lister.ListContainers()
+}
+
+func (p *ContainerPool) RestoreContainer(handle string) (Container, error) {
+	restorer, ok := p.Backend.(ContainerRestorer)
+	if !ok {
+		return nil, ContainerNotRestorable
+	}
+
+	return restorer.RestoreContainer(handle)
+}
+
+// Stats returns the number of ready containers for every pooled class.
+func (p *ContainerPool) Stats() []protocol.PoolStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stats := []protocol.PoolStats{}
+
+	for class, containers := range p.ready {
+		stats = append(stats, protocol.PoolStats{
+			MemoryLimit: class.MemoryLimitInBytes / megabyte,
+			DiskLimit:   class.DiskLimitInBytes / megabyte,
+			Ready:       len(containers),
+			Size:        p.Size,
+		})
+	}
+
+	sort.Sort(poolStatsByClass(stats))
+
+	return stats
+}
+
+// Reserved returns the limits of the containers that are ready or being
+// created.
+func (p *ContainerPool) Reserved() TaskLimits {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	total := TaskLimits{}
+
+	for class, containers := range p.ready {
+		count := uint64(len(containers) + p.filling[class])
+
+		total.MemoryLimitInBytes += class.MemoryLimitInBytes * count
+		total.DiskLimitInBytes += class.DiskLimitInBytes * count
+	}
+
+	return total
+}
+
+// Close stops refilling the pool and destroys the containers in it.
+func (p *ContainerPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+
+	for class, containers := range p.ready {
+		for _, container := range containers {
+			destroyPooledContainer(container)
+		}
+
+		p.ready[class] = nil
+	}
+}
+
+func (p *ContainerPool) checkout(class TaskLimits) (LimitableContainer, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil, false
+	}
+
+	containers, pooled := p.ready[class]
+	if !pooled {
+		return nil, false
+	}
+
+	defer p.refill(class)
+
+	if len(containers) == 0 {
+		return nil, false
+	}
+
+	p.ready[class] = containers[1:]
+
+	return containers[0], true
+}
+
+// refill must be called with the lock held.
+func (p *ContainerPool) refill(class TaskLimits) {
+	if p.closed {
+		return
+	}
+
+	missing := p.Size - len(p.ready[class]) - p.filling[class]
+
+	for i := 0; i < missing; i++ {
+		p.filling[class]++
+		go p.fill(class)
+	}
+}
+
+func (p *ContainerPool) fill(class TaskLimits) {
+	container, err := p.create(class)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.filling[class]--
+
+	if err != nil {
+		log.Printf("failed to create pooled container: %s\n", err)
+		return
+	}
+
+	if p.closed {
+		destroyPooledContainer(container)
+		return
+	}
+
+	p.ready[class] = append(p.ready[class], container)
+}
+
+func (p *ContainerPool) create(class TaskLimits) (LimitableContainer, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	container, err := p.Backend.ProvideContainer(ContainerSpec{
+		Handle: PooledContainerHandlePrefix + id.String(),
+		Limits: class,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	limitable, ok := container.(LimitableContainer)
+	if !ok {
+		destroyPooledContainer(container)
+		return nil, ContainerNotLimitable
+	}
+
+	return limitable, nil
+}
+
+func destroyPooledContainer(container Container) {
+	err := container.Destroy()
+	if err != nil {
+		log.Printf("failed to destroy pooled container %s: %s\n", container.ID(), err)
+	}
+}
+
+func roundUpToPowerOfTwoMegabytes(bytes uint64) uint64 {
+	rounded := megabyte
+
+	for rounded < bytes {
+		rounded *= 2
+	}
+
+	return rounded
+}
+
+type poolStatsByClass []protocol.PoolStats
+
+func (s poolStatsByClass) Len() int      { return len(s) }
+func (s poolStatsByClass) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s poolStatsByClass) Less(i, j int) bool {
+	if s[i].MemoryLimit != s[j].MemoryLimit {
+		return s[i].MemoryLimit < s[j].MemoryLimit
+	}
+
+	return s[i].DiskLimit < s[j].DiskLimit
+}
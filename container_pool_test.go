@@ -0,0 +1,262 @@
+package narc
+
+import (
+	"github.com/cloudfoundry/gibson/fake_router_client"
+	. "launchpad.net/gocheck"
+	"strings"
+	"time"
+)
+
+type CPSuite struct{}
+
+func init() {
+	Suite(&CPSuite{})
+}
+
+func (s *CPSuite) TestPoolClassForRoundsUpMemoryToPowersOfTwo(c *C) {
+	class := PoolClassFor(TaskLimits{
+		MemoryLimitInBytes: 200 * megabyte,
+		DiskLimitInBytes:   1000 * megabyte,
+	})
+
+	c.Assert(class, Equals, TaskLimits{
+		MemoryLimitInBytes: 256 * megabyte,
+		DiskLimitInBytes:   1000 * megabyte,
+	})
+
+	c.Assert(PoolClassFor(TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 1}), Equals, TaskLimits{
+		MemoryLimitInBytes: megabyte,
+		DiskLimitInBytes:   1,
+	})
+
+	c.Assert(PoolClassFor(TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 1, CPUShares: 3, PIDLimit: 5}), Equals, TaskLimits{
+		MemoryLimitInBytes: megabyte,
+		DiskLimitInBytes:   1,
+		CPUShares:          3,
+		PIDLimit:           5,
+	})
+}
+
+func (s *CPSuite) TestWarmFillsThePool(c *C) {
+	pool := NewContainerPool(FakeTaskBackend{}, 2)
+	defer pool.Close()
+
+	pool.Warm(TaskLimits{MemoryLimitInBytes: 200 * megabyte, DiskLimitInBytes: 1000 * megabyte})
+
+	waitForPool(c, pool, 2)
+
+	c.Assert(pool.Stats()[0].MemoryLimit, Equals, uint64(256))
+	c.Assert(pool.Stats()[0].DiskLimit, Equals, uint64(1000))
+	c.Assert(pool.Stats()[0].Size, Equals, 2)
+}
+
+func (s *CPSuite) TestProvideContainerChecksOutAndLimitsPooledContainers(c *C) {
+	pool := NewContainerPool(FakeTaskBackend{}, 1)
+	defer pool.Close()
+
+	limits := TaskLimits{MemoryLimitInBytes: 200 * megabyte, DiskLimitInBytes: 1000 * megabyte}
+
+	pool.Warm(limits)
+	waitForPool(c, pool, 1)
+
+	container, err := pool.ProvideContainer(ContainerSpec{Task: "some-guid", Limits: limits})
+	c.Assert(err, IsNil)
+
+	c.Assert(strings.HasPrefix(container.ID(), PooledContainerHandlePrefix), Equals, true)
+	c.Assert(*container.(*FakeContainer).LimitedMemory, Equals, 200*megabyte)
+	c.Assert(*container.(*FakeContainer).LimitedDisk, Equals, 1000*megabyte)
+
+	waitForPool(c, pool, 1)
+}
+
+func (s *CPSuite) TestProvideContainerOnlyChangesLimitsOutsideTheClass(c *C) {
+	pool := NewContainerPool(FakeTaskBackend{}, 1)
+	defer pool.Close()
+
+	limits := TaskLimits{MemoryLimitInBytes: 256 * megabyte, DiskLimitInBytes: 1000 * megabyte}
+
+	pool.Warm(limits)
+	waitForPool(c, pool, 1)
+
+	pool.ready[PoolClassFor(limits)][0].(*FakeContainer).DiskNotChangeable = true
+
+	container, err := pool.ProvideContainer(ContainerSpec{Task: "some-guid", Limits: limits})
+	c.Assert(err, IsNil)
+
+	c.Assert(strings.HasPrefix(container.ID(), PooledContainerHandlePrefix), Equals, true)
+	c.Assert(container.(*FakeContainer).IsDestroyed(), Equals, false)
+}
+
+func (s *CPSuite) TestProvideContainerFallsBackToTheBackendWhenEmpty(c *C) {
+	pool := NewContainerPool(FakeTaskBackend{}, 1)
+	defer pool.Close()
+
+	container, err := pool.ProvideContainer(ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: megabyte, DiskLimitInBytes: megabyte},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(container.ID(), Equals, "narc-some-guid")
+}
+
+func (s *CPSuite) TestProvideContainerOnlyPoolsWarmedClasses(c *C) {
+	pool := NewContainerPool(FakeTaskBackend{}, 1)
+	defer pool.Close()
+
+	pool.Warm(TaskLimits{MemoryLimitInBytes: megabyte, DiskLimitInBytes: megabyte})
+	waitForPool(c, pool, 1)
+
+	container, err := pool.ProvideContainer(ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 4 * megabyte, DiskLimitInBytes: megabyte},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(container.ID(), Equals, "narc-some-guid")
+
+	time.Sleep(50 * time.Millisecond)
+
+	c.Assert(pool.Stats(), HasLen, 1)
+}
+
+func (s *CPSuite) TestPooledContainersReserveCapacity(c *C) {
+	pool := NewContainerPool(FakeTaskBackend{}, 2)
+	defer pool.Close()
+
+	pool.Warm(TaskLimits{MemoryLimitInBytes: 8 * megabyte, DiskLimitInBytes: 4 * megabyte})
+	waitForPool(c, pool, 2)
+
+	agent, err := NewAgent(pool, fake_gibson.NewFakeRouterClient(), 42)
+	c.Assert(err, IsNil)
+
+	agent.Capacity = CapacityConfig{MemoryInBytes: 64 * megabyte, DiskInBytes: 64 * megabyte}
+
+	advertisement := agent.Advertisement()
+	c.Assert(advertisement.AvailableMemory, Equals, uint64(48))
+	c.Assert(advertisement.AvailableDisk, Equals, uint64(56))
+	c.Assert(advertisement.RunningTasks, Equals, 0)
+}
+
+func (s *CPSuite) TestPooledContainersAreDestroyedWhenSetupFails(c *C) {
+	pool := NewContainerPool(FakeTaskBackend{}, 1)
+	defer pool.Close()
+
+	limits := TaskLimits{MemoryLimitInBytes: megabyte, DiskLimitInBytes: megabyte}
+
+	pool.Warm(limits)
+	waitForPool(c, pool, 1)
+
+	pooled := pool.ready[PoolClassFor(limits)][0].(*FakeContainer)
+	pooled.ShouldError = true
+
+	agent, err := NewAgent(pool, fake_gibson.NewFakeRouterClient(), 42)
+	c.Assert(err, IsNil)
+
+	_, err = agent.startTask("some-token", ContainerSpec{
+		Task:   "some-guid",
+		Limits: limits,
+	}, []string{"exit 1"}, StopPolicy{})
+	c.Assert(err, NotNil)
+
+	c.Assert(pooled.IsDestroyed(), Equals, true)
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for _, ready := range pool.ready[PoolClassFor(limits)] {
+		c.Assert(ready, Not(Equals), Container(pooled))
+	}
+}
+
+func (s *CPSuite) TestProvideContainerWithBindMountsBypassesThePool(c *C) {
+	pool := NewContainerPool(FakeTaskBackend{}, 1)
+	defer pool.Close()
+
+	limits := TaskLimits{MemoryLimitInBytes: megabyte, DiskLimitInBytes: megabyte}
+
+	pool.Warm(limits)
+	waitForPool(c, pool, 1)
+
+	container, err := pool.ProvideContainer(ContainerSpec{
+		Task:       "some-guid",
+		Limits:     limits,
+		BindMounts: []BindMount{{SrcPath: "/a", DstPath: "/b"}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(container.ID(), Equals, "narc-some-guid")
+
+	c.Assert(pool.Stats()[0].Ready, Equals, 1)
+}
+
+func (s *CPSuite) TestPooledContainersAreNotTiedToTasks(c *C) {
+	_, ok := TaskForContainerHandle(PooledContainerHandlePrefix + "abc")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *CPSuite) TestReconcileKeepsPooledContainersBackingTasks(c *C) {
+	pooled := &FakeContainer{Handle: PooledContainerHandlePrefix + "abc"}
+	orphan := &FakeContainer{Handle: PooledContainerHandlePrefix + "def"}
+
+	agent, err := NewAgent(
+		FakeTaskBackend{Containers: []Container{pooled, orphan}},
+		fake_gibson.NewFakeRouterClient(),
+		42,
+	)
+	c.Assert(err, IsNil)
+
+	task, err := NewTask(pooled, "", FakeTaskBackend{}.ProvideCommand(pooled))
+	c.Assert(err, IsNil)
+
+	agent.registerTask("some-guid", task)
+
+	err = agent.ReconcileContainers(ReconcileAdopt)
+	c.Assert(err, IsNil)
+
+	c.Assert(pooled.IsDestroyed(), Equals, false)
+	c.Assert(orphan.IsDestroyed(), Equals, true)
+}
+
+func (s *CPSuite) TestAdvertisementIncludesPoolStats(c *C) {
+	pool := NewContainerPool(FakeTaskBackend{}, 1)
+	defer pool.Close()
+
+	pool.Warm(TaskLimits{MemoryLimitInBytes: megabyte, DiskLimitInBytes: megabyte})
+	waitForPool(c, pool, 1)
+
+	agent, err := NewAgent(pool, fake_gibson.NewFakeRouterClient(), 42)
+	c.Assert(err, IsNil)
+
+	advertisement := agent.Advertisement()
+	c.Assert(advertisement.Pools, HasLen, 1)
+	c.Assert(advertisement.Pools[0].Ready, Equals, 1)
+}
+
+func (s *CPSuite) TestCloseDestroysReadyContainers(c *C) {
+	pool := NewContainerPool(FakeTaskBackend{}, 1)
+
+	limits := TaskLimits{MemoryLimitInBytes: megabyte, DiskLimitInBytes: megabyte}
+
+	pool.Warm(limits)
+	waitForPool(c, pool, 1)
+
+	ready := pool.ready[PoolClassFor(limits)][0].(*FakeContainer)
+
+	pool.Close()
+
+	c.Assert(ready.IsDestroyed(), Equals, true)
+	c.Assert(pool.Stats()[0].Ready, Equals, 0)
+}
+
+func waitForPool(c *C, pool *ContainerPool, ready int) {
+	deadline := time.Now().Add(1 * time.Second)
+
+	for time.Now().Before(deadline) {
+		stats := pool.Stats()
+		if len(stats) == 1 && stats[0].Ready == ready {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Fatalf("pool never had %d ready containers: %#v", ready, pool.Stats())
+}
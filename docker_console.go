@@ -0,0 +1,201 @@
+package narc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// DockerConsoleEnv holds the config of a narc process started as the
+// console of a docker container, see RunDockerConsole.
+const DockerConsoleEnv = "NARC_DOCKER_CONSOLE"
+
+type dockerConsoleConfig struct {
+	SocketPath string   `json:"socket_path"`
+	Container  string   `json:"container"`
+	User       string   `json:"user,omitempty"`
+	Cmd        []string `json:"cmd"`
+}
+
+// dockerConsoleCommand re-executes narc as the console of a docker
+// container, so that sessions need nothing but the Engine API socket.
+func dockerConsoleCommand(socketPath, container, user string) *exec.Cmd {
+	config, _ := json.Marshal(dockerConsoleConfig{
+		SocketPath: socketPath,
+		Container:  container,
+		User:       user,
+		Cmd:        []string{"/bin/sh", "-l"},
+	})
+
+	binary, err := os.Executable()
+	if err != nil {
+		log.Println("failed to find the narc binary:", err)
+		binary = os.Args[0]
+	}
+
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(), DockerConsoleEnv+"="+string(config))
+
+	return cmd
+}
+
+// RunDockerConsole is the docker console started by dockerConsoleCommand.
+// It runs a shell in the container through the Engine API, relaying its
+// terminal and size, and returns the shell's exit status.
+func RunDockerConsole() (int, error) {
+	var config dockerConsoleConfig
+
+	err := json.Unmarshal([]byte(os.Getenv(DockerConsoleEnv)), &config)
+	if err != nil {
+		return 0, err
+	}
+
+	// the shell's terminal in the container does the line editing and echo
+	makeRaw(os.Stdin)
+
+	sizes := make(chan ttySize, 1)
+
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+
+	go func() {
+		for {
+			size, err := getWinSize(os.Stdin)
+			if err == nil {
+				sizes <- size
+			}
+
+			<-resized
+		}
+	}()
+
+	container := &DockerContainer{
+		Handle: config.Container,
+		client: newDockerClient(config.SocketPath),
+	}
+
+	return container.Console(config.User, config.Cmd, os.Stdin, os.Stdout, sizes)
+}
+
+// Console runs a command in the container with a terminal, copying stdin
+// to it and its output to stdout, and resizing it to the sizes received. It
+// returns the command's exit status.
+func (c *DockerContainer) Console(user string, cmd []string, stdin io.Reader, stdout io.Writer, sizes <-chan ttySize) (int, error) {
+	var exec dockerID
+
+	err := c.client.do(
+		"POST",
+		c.path("/exec"),
+		dockerExecRequest{
+			Cmd:          cmd,
+			User:         user,
+			AttachStdin:  true,
+			AttachStdout: true,
+			AttachStderr: true,
+			Tty:          true,
+		},
+		&exec,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, output, err := c.client.hijack("POST", "/exec/"+exec.Id+"/start", dockerExecStartRequest{Tty: true})
+	if err != nil {
+		return 0, err
+	}
+
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, stdin)
+		conn.CloseWrite()
+	}()
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := io.Copy(stdout, output)
+		done <- err
+	}()
+
+	for {
+		select {
+		case size := <-sizes:
+			err := c.client.do("POST", fmt.Sprintf("/exec/%s/resize?h=%d&w=%d", exec.Id, size.Rows, size.Cols), nil, nil)
+			if err != nil {
+				log.Println("failed to resize console:", err)
+			}
+
+		case err := <-done:
+			if err != nil {
+				return 0, err
+			}
+
+			status, err := c.execExitStatus(exec.Id)
+
+			return int(status), err
+		}
+	}
+}
+
+// hijack sends a request and takes over its connection once the daemon
+// switches protocols, for attaching to an exec's terminal. Output that was
+// read along with the response is returned in the reader.
+func (d *dockerClient) hijack(method, path string, request interface{}) (*net.UnixConn, *bufio.Reader, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequest(method, "http://docker"+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: d.socketPath, Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols && res.StatusCode != http.StatusOK {
+		defer conn.Close()
+
+		var message struct {
+			Message string `json:"message"`
+		}
+
+		json.NewDecoder(res.Body).Decode(&message)
+
+		return nil, nil, DockerError{res.StatusCode, message.Message}
+	}
+
+	return conn, reader, nil
+}
@@ -0,0 +1,570 @@
+package narc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DockerError is returned when the Docker Engine API responds with an
+// error status.
+type DockerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e DockerError) Error() string {
+	return fmt.Sprintf("docker: %s (status %d)", e.Message, e.StatusCode)
+}
+
+// DockerContainer is a container created through the Docker Engine API. Its
+// handle is the container's name.
+type DockerContainer struct {
+	Handle string
+
+	client *dockerClient
+}
+
+type dockerCreateRequest struct {
+	Image      string
+	Cmd        []string
+	Labels     map[string]string
+	HostConfig dockerHostConfig
+}
+
+type dockerHostConfig struct {
+	Memory      uint64
+	MemorySwap  uint64
+	CpuShares   uint64            `json:",omitempty"`
+	CpuPeriod   uint64            `json:",omitempty"`
+	CpuQuota    uint64            `json:",omitempty"`
+	PidsLimit   uint64            `json:",omitempty"`
+	NetworkMode string            `json:",omitempty"`
+	Ulimits     []dockerUlimit    `json:",omitempty"`
+	StorageOpt  map[string]string `json:",omitempty"`
+	Binds       []string          `json:",omitempty"`
+}
+
+type dockerUlimit struct {
+	Name string
+	Soft uint64
+	Hard uint64
+}
+
+// dockerCPUPeriod is the period, in microseconds, CPU quotas are enforced
+// over.
+const dockerCPUPeriod = 100000
+
+type dockerContainerSummary struct {
+	Names []string
+}
+
+type dockerContainerState struct {
+	State struct {
+		Running bool
+	}
+}
+
+type dockerExecRequest struct {
+	Cmd          []string
+	User         string `json:",omitempty"`
+	AttachStdin  bool   `json:",omitempty"`
+	AttachStdout bool
+	AttachStderr bool
+	Tty          bool `json:",omitempty"`
+}
+
+type dockerExecStartRequest struct {
+	Detach bool
+	Tty    bool
+}
+
+type dockerID struct {
+	Id string
+}
+
+type dockerExecState struct {
+	ExitCode int
+}
+
+type dockerContainerSize struct {
+	SizeRw uint64
+	State  struct {
+		OOMKilled bool
+	}
+	HostConfig struct {
+		StorageOpt map[string]string
+	}
+}
+
+type dockerStats struct {
+	MemoryStats struct {
+		Usage uint64 `json:"usage"`
+		Limit uint64 `json:"limit"`
+	} `json:"memory_stats"`
+
+	CPUStats struct {
+		CPUUsage struct {
+			TotalUsage uint64 `json:"total_usage"`
+		} `json:"cpu_usage"`
+	} `json:"cpu_stats"`
+
+	PidsStats struct {
+		Current int `json:"current"`
+	} `json:"pids_stats"`
+
+	Networks map[string]struct {
+		RxBytes uint64 `json:"rx_bytes"`
+		TxBytes uint64 `json:"tx_bytes"`
+	} `json:"networks"`
+}
+
+// NewDockerContainer creates and starts a container from the spec's image,
+// or the given default image, limiting its memory and disk. The container's
+// main process does nothing; tasks are run in it with exec.
+//
+// Docker cannot limit bandwidth or restrict outbound traffic to an allow
+// list, so specs asking for either are refused. Its default bridge network
+// allows outbound traffic and maps no ports, which is also the egress
+// policy.
+//
+// The disk limit is passed on as the "size" storage option, which makes
+// creating containers fail on storage drivers that do not support it, e.g.
+// overlay2 without xfs project quotas. Unless diskLimits says the driver
+// supports it, specs with a disk limit are refused rather than left
+// unenforced.
+func NewDockerContainer(socketPath, defaultImage string, diskLimits bool, spec ContainerSpec) (*DockerContainer, error) {
+	if spec.Network.Mode == NetworkAllowList || spec.Limits.InboundBandwidth > 0 || spec.Limits.OutboundBandwidth > 0 {
+		return nil, NetworkPolicyNotSupported
+	}
+
+	if spec.Limits.DiskLimitInBytes > 0 && !diskLimits {
+		return nil, DiskLimitNotSupported
+	}
+
+	image := spec.Image
+	if image == "" {
+		image = defaultImage
+	}
+
+	container := &DockerContainer{
+		Handle: spec.ContainerHandle(),
+		client: newDockerClient(socketPath),
+	}
+
+	err := container.client.do(
+		"POST",
+		"/containers/create?name="+url.QueryEscape(container.Handle),
+		dockerCreateRequest{
+			Image:      image,
+			Cmd:        []string{"tail", "-f", "/dev/null"},
+			Labels:     containerProperties(spec),
+			HostConfig: dockerHostConfigFor(spec, diskLimits),
+		},
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = container.start()
+	if err != nil {
+		destroyErr := container.Destroy()
+		if destroyErr != nil {
+			log.Printf("failed to destroy container %s: %s\n", container.Handle, destroyErr)
+		}
+
+		return nil, err
+	}
+
+	return container, nil
+}
+
+// RestoreDockerContainer reconnects to an existing container, starting it
+// again if it was stopped, e.g. by a reboot.
+func RestoreDockerContainer(socketPath, handle string) (*DockerContainer, error) {
+	container := &DockerContainer{
+		Handle: handle,
+		client: newDockerClient(socketPath),
+	}
+
+	var state dockerContainerState
+
+	err := container.client.do("GET", container.path("/json"), nil, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	if !state.State.Running {
+		err = container.start()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return container, nil
+}
+
+// ListDockerContainers returns the containers the given agent created,
+// running or not.
+func ListDockerContainers(socketPath, owner string) ([]*DockerContainer, error) {
+	client := newDockerClient(socketPath)
+
+	filters, err := json.Marshal(map[string][]string{"label": {"owner=narc", "agent=" + owner}})
+	if err != nil {
+		return nil, err
+	}
+
+	var summaries []dockerContainerSummary
+
+	err = client.do("GET", "/containers/json?all=1&filters="+url.QueryEscape(string(filters)), nil, &summaries)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := []*DockerContainer{}
+
+	for _, summary := range summaries {
+		for _, name := range summary.Names {
+			handle := strings.TrimPrefix(name, "/")
+
+			if strings.HasPrefix(handle, ContainerHandlePrefix) {
+				containers = append(containers, &DockerContainer{
+					Handle: handle,
+					client: client,
+				})
+
+				break
+			}
+		}
+	}
+
+	return containers, nil
+}
+
+func (c *DockerContainer) ID() string {
+	return c.Handle
+}
+
+func (c *DockerContainer) Destroy() error {
+	return c.client.do("DELETE", c.path("?force=1&v=1"), nil, nil)
+}
+
+// Run runs a script in the container with /bin/sh and waits for it to exit.
+func (c *DockerContainer) Run(script string) (*JobInfo, error) {
+	execID, body, err := c.startExec(script)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+
+	err = demuxDockerStream(body, stdout, stderr)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	exitStatus, err := c.execExitStatus(execID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JobInfo{
+		ExitStatus: exitStatus,
+		Stdout:     stdout.Bytes(),
+		Stderr:     stderr.Bytes(),
+	}, nil
+}
+
+// StreamOut runs tar in the container, streaming its output as it is
+// written.
+func (c *DockerContainer) StreamOut(paths []string) (io.ReadCloser, error) {
+	execID, body, err := c.startExec(tarScript(paths))
+	if err != nil {
+		return nil, err
+	}
+
+	job, stdout, stderr := newJobStream()
+
+	go func() {
+		exit := jobExit{}
+
+		exit.err = demuxDockerStream(body, stdout, stderr)
+		body.Close()
+
+		if exit.err == nil {
+			exit.status, exit.err = c.execExitStatus(execID)
+		}
+
+		stdout.Close()
+		stderr.Close()
+
+		job.exited <- exit
+	}()
+
+	return newArchiveStream(job), nil
+}
+
+// startExec starts a script in the container, returning the exec's id and
+// its multiplexed output.
+func (c *DockerContainer) startExec(script string) (string, io.ReadCloser, error) {
+	var exec dockerID
+
+	err := c.client.do(
+		"POST",
+		c.path("/exec"),
+		dockerExecRequest{
+			Cmd:          []string{"/bin/sh", "-c", script},
+			AttachStdout: true,
+			AttachStderr: true,
+		},
+		&exec,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	body, err := c.client.stream("POST", "/exec/"+exec.Id+"/start", dockerExecStartRequest{})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return exec.Id, body, nil
+}
+
+func (c *DockerContainer) execExitStatus(execID string) (uint32, error) {
+	var state dockerExecState
+
+	err := c.client.do("GET", "/exec/"+execID+"/json", nil, &state)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(state.ExitCode), nil
+}
+
+func (c *DockerContainer) Info() (*ContainerInfo, error) {
+	var stats dockerStats
+
+	err := c.client.do("GET", c.path("/stats?stream=0"), nil, &stats)
+	if err != nil {
+		return nil, err
+	}
+
+	var size dockerContainerSize
+
+	err = c.client.do("GET", c.path("/json?size=1"), nil, &size)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ContainerInfo{
+		MemoryLimitInBytes: stats.MemoryStats.Limit,
+		MemoryUsageInBytes: stats.MemoryStats.Usage,
+		DiskUsageInBytes:   size.SizeRw,
+		CPUTime:            time.Duration(stats.CPUStats.CPUUsage.TotalUsage),
+		Processes:          stats.PidsStats.Current,
+		OutOfMemory:        size.State.OOMKilled,
+	}
+
+	// the size is only set if the storage driver can limit disk usage
+	info.DiskLimitInBytes, _ = strconv.ParseUint(size.HostConfig.StorageOpt["size"], 10, 64)
+
+	for _, network := range stats.Networks {
+		info.NetworkRxBytes += network.RxBytes
+		info.NetworkTxBytes += network.TxBytes
+	}
+
+	return info, nil
+}
+
+func (c *DockerContainer) LimitMemory(limitInBytes uint64) error {
+	return c.client.do(
+		"POST",
+		c.path("/update"),
+		dockerHostConfig{Memory: limitInBytes, MemorySwap: limitInBytes},
+		nil,
+	)
+}
+
+func (c *DockerContainer) LimitDisk(limitInBytes uint64) error {
+	return DiskLimitNotChangeable
+}
+
+func (c *DockerContainer) start() error {
+	return c.client.do("POST", c.path("/start"), nil, nil)
+}
+
+func (c *DockerContainer) path(suffix string) string {
+	return "/containers/" + c.Handle + suffix
+}
+
+func dockerHostConfigFor(spec ContainerSpec, diskLimits bool) dockerHostConfig {
+	config := dockerHostConfig{
+		Memory:     spec.Limits.MemoryLimitInBytes,
+		MemorySwap: spec.Limits.MemoryLimitInBytes,
+		CpuShares:  spec.Limits.CPUShares,
+		PidsLimit:  spec.Limits.PIDLimit,
+		Binds:      dockerBinds(spec.BindMounts),
+	}
+
+	if diskLimits {
+		config.StorageOpt = map[string]string{
+			"size": fmt.Sprintf("%d", spec.Limits.DiskLimitInBytes),
+		}
+	}
+
+	if spec.Limits.CPUQuotaInPercent > 0 {
+		config.CpuPeriod = dockerCPUPeriod
+		config.CpuQuota = dockerCPUPeriod * spec.Limits.CPUQuotaInPercent / 100
+	}
+
+	if spec.Network.Mode == NetworkNone {
+		config.NetworkMode = "none"
+	}
+
+	if spec.Limits.FDLimit > 0 {
+		config.Ulimits = []dockerUlimit{
+			{Name: "nofile", Soft: spec.Limits.FDLimit, Hard: spec.Limits.FDLimit},
+		}
+	}
+
+	return config
+}
+
+func dockerBinds(mounts []BindMount) []string {
+	binds := []string{}
+
+	for _, mount := range mounts {
+		mode := "rw"
+		if mount.ReadOnly {
+			mode = "ro"
+		}
+
+		binds = append(binds, fmt.Sprintf("%s:%s:%s", mount.SrcPath, mount.DstPath, mode))
+	}
+
+	return binds
+}
+
+// demuxDockerStream splits the multiplexed output of an exec without a tty.
+// Each frame has an 8 byte header: the stream (1 for stdout, 2 for stderr),
+// three bytes of padding and the big endian size of the payload.
+func demuxDockerStream(stream io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+
+	for {
+		_, err := io.ReadFull(stream, header)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		dst := ioutil.Discard
+
+		switch header[0] {
+		case 1:
+			dst = stdout
+		case 2:
+			dst = stderr
+		}
+
+		_, err = io.CopyN(dst, stream, int64(binary.BigEndian.Uint32(header[4:])))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dockerClient speaks the Docker Engine API over a Unix socket.
+type dockerClient struct {
+	http       *http.Client
+	socketPath string
+}
+
+func newDockerClient(socketPath string) *dockerClient {
+	return &dockerClient{
+		socketPath: socketPath,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into response, if given.
+func (d *dockerClient) do(method, path string, request, response interface{}) error {
+	body, err := d.stream(method, path, request)
+	if err != nil {
+		return err
+	}
+
+	defer body.Close()
+
+	if response == nil {
+		return nil
+	}
+
+	return json.NewDecoder(body).Decode(response)
+}
+
+func (d *dockerClient) stream(method, path string, request interface{}) (io.ReadCloser, error) {
+	var body io.Reader
+
+	if request != nil {
+		payload, err := json.Marshal(request)
+		if err != nil {
+			return nil, err
+		}
+
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, "http://docker"+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := d.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// 304 means there was nothing to do, e.g. starting a running container.
+	if res.StatusCode >= 300 && res.StatusCode != http.StatusNotModified {
+		defer res.Body.Close()
+
+		var message struct {
+			Message string `json:"message"`
+		}
+
+		json.NewDecoder(res.Body).Decode(&message)
+
+		return nil, DockerError{res.StatusCode, message.Message}
+	}
+
+	return res.Body, nil
+}
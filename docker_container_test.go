@@ -0,0 +1,360 @@
+package narc
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DKSuite struct {
+	SocketPath string
+	Docker     *FakeDocker
+
+	listener net.Listener
+}
+
+func init() {
+	Suite(&DKSuite{})
+}
+
+// FakeDocker answers Docker Engine API requests with canned responses,
+// keyed by method and path, and records the requests it received. Requests
+// with a hijack handler get the raw connection after switching protocols.
+type FakeDocker struct {
+	Responses map[string]string
+	Hijacks   map[string]func(net.Conn)
+	Requests  []FakeDockerRequest
+
+	sync.Mutex
+}
+
+func (d *FakeDocker) requested(uri string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, request := range d.Requests {
+		if request.URI == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+type FakeDockerRequest struct {
+	Method string
+	URI    string
+	Body   string
+}
+
+func (d *FakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.Requests = append(d.Requests, FakeDockerRequest{r.Method, r.URL.RequestURI(), string(body)})
+
+	hijack, found := d.Hijacks[r.Method+" "+r.URL.Path]
+	if found {
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+
+		buf.WriteString("HTTP/1.1 101 UPGRADED\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		buf.Flush()
+
+		go func() {
+			hijack(conn)
+			conn.Close()
+		}()
+
+		return
+	}
+
+	response, found := d.Responses[r.Method+" "+r.URL.Path]
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"no such thing"}`))
+		return
+	}
+
+	w.Write([]byte(response))
+}
+
+func (s *DKSuite) SetUpTest(c *C) {
+	s.SocketPath = filepath.Join(c.MkDir(), "docker.sock")
+	s.Docker = &FakeDocker{Responses: map[string]string{}, Hijacks: map[string]func(net.Conn){}}
+
+	listener, err := net.Listen("unix", s.SocketPath)
+	c.Assert(err, IsNil)
+
+	s.listener = listener
+
+	go http.Serve(listener, s.Docker)
+}
+
+func (s *DKSuite) TearDownTest(c *C) {
+	s.listener.Close()
+}
+
+func (s *DKSuite) TestNewDockerContainerCreatesAndStartsAContainer(c *C) {
+	s.Docker.Responses["POST /containers/create"] = `{"Id":"abc"}`
+	s.Docker.Responses["POST /containers/narc-some-guid/start"] = ``
+
+	container, err := NewDockerContainer(s.SocketPath, "ubuntu", true, ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20},
+		BindMounts: []BindMount{
+			{SrcPath: "/var/droplets/app", DstPath: "/home/vcap/app", ReadOnly: true},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(container.ID(), Equals, "narc-some-guid")
+
+	c.Assert(s.Docker.Requests, HasLen, 2)
+	c.Assert(s.Docker.Requests[0].URI, Equals, "/containers/create?name=narc-some-guid")
+	c.Assert(s.Docker.Requests[1].URI, Equals, "/containers/narc-some-guid/start")
+
+	var create dockerCreateRequest
+
+	err = json.Unmarshal([]byte(s.Docker.Requests[0].Body), &create)
+	c.Assert(err, IsNil)
+
+	c.Assert(create.Image, Equals, "ubuntu")
+	c.Assert(create.Labels, DeepEquals, map[string]string{"owner": "narc", "task": "some-guid"})
+	c.Assert(create.HostConfig.Memory, Equals, uint64(10))
+	c.Assert(create.HostConfig.StorageOpt, DeepEquals, map[string]string{"size": "20"})
+	c.Assert(create.HostConfig.Binds, DeepEquals, []string{"/var/droplets/app:/home/vcap/app:ro"})
+}
+
+func (s *DKSuite) TestNewDockerContainerUsesTheSpecsImage(c *C) {
+	s.Docker.Responses["POST /containers/create"] = `{"Id":"abc"}`
+	s.Docker.Responses["POST /containers/narc-some-guid/start"] = ``
+
+	_, err := NewDockerContainer(s.SocketPath, "ubuntu", true, ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20},
+		Image:  "golang:1.22",
+	})
+	c.Assert(err, IsNil)
+
+	var create dockerCreateRequest
+
+	err = json.Unmarshal([]byte(s.Docker.Requests[0].Body), &create)
+	c.Assert(err, IsNil)
+	c.Assert(create.Image, Equals, "golang:1.22")
+}
+
+func (s *DKSuite) TestNewDockerContainerDestroysContainersThatFailToStart(c *C) {
+	s.Docker.Responses["POST /containers/create"] = `{"Id":"abc"}`
+	s.Docker.Responses["DELETE /containers/narc-some-guid"] = ``
+
+	_, err := NewDockerContainer(s.SocketPath, "ubuntu", true, ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20},
+	})
+	c.Assert(err, DeepEquals, DockerError{404, "no such thing"})
+
+	c.Assert(s.Docker.Requests, HasLen, 3)
+	c.Assert(s.Docker.Requests[2].Method, Equals, "DELETE")
+}
+
+func (s *DKSuite) TestHostConfigCarriesCPUPIDAndFileLimits(c *C) {
+	config := dockerHostConfigFor(ContainerSpec{
+		Limits: TaskLimits{
+			MemoryLimitInBytes: 10,
+			DiskLimitInBytes:   20,
+			CPUShares:          512,
+			CPUQuotaInPercent:  150,
+			PIDLimit:           64,
+			FDLimit:            1024,
+		},
+	}, true)
+
+	c.Assert(config.CpuShares, Equals, uint64(512))
+	c.Assert(config.CpuPeriod, Equals, uint64(100000))
+	c.Assert(config.CpuQuota, Equals, uint64(150000))
+	c.Assert(config.PidsLimit, Equals, uint64(64))
+	c.Assert(config.Ulimits, DeepEquals, []dockerUlimit{{Name: "nofile", Soft: 1024, Hard: 1024}})
+}
+
+func (s *DKSuite) TestNewDockerContainerRefusesUnenforcedDiskLimits(c *C) {
+	_, err := NewDockerContainer(s.SocketPath, "ubuntu", false, ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20},
+	})
+	c.Assert(err, Equals, DiskLimitNotSupported)
+
+	c.Assert(s.Docker.Requests, HasLen, 0)
+}
+
+func (s *DKSuite) TestHostConfigOnlyLimitsDiskIfAsked(c *C) {
+	spec := ContainerSpec{Limits: TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20}}
+
+	c.Assert(dockerHostConfigFor(spec, true).StorageOpt, DeepEquals, map[string]string{"size": "20"})
+	c.Assert(dockerHostConfigFor(spec, false).StorageOpt, IsNil)
+}
+
+func (s *DKSuite) TestContainersWithoutNetworkGetNoneNetworkMode(c *C) {
+	config := dockerHostConfigFor(ContainerSpec{Network: NetworkPolicy{Mode: NetworkNone}}, true)
+	c.Assert(config.NetworkMode, Equals, "none")
+
+	config = dockerHostConfigFor(ContainerSpec{Network: NetworkPolicy{Mode: NetworkEgress}}, true)
+	c.Assert(config.NetworkMode, Equals, "")
+}
+
+func (s *DKSuite) TestNewDockerContainerRefusesAllowListsAndBandwidthLimits(c *C) {
+	_, err := NewDockerContainer(s.SocketPath, "ubuntu", true, ContainerSpec{
+		Task:    "some-guid",
+		Network: NetworkPolicy{Mode: NetworkAllowList},
+	})
+	c.Assert(err, Equals, NetworkPolicyNotSupported)
+
+	_, err = NewDockerContainer(s.SocketPath, "ubuntu", true, ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20, InboundBandwidth: 1024},
+	})
+	c.Assert(err, Equals, NetworkPolicyNotSupported)
+
+	c.Assert(s.Docker.Requests, HasLen, 0)
+}
+
+func (s *DKSuite) TestRunExecsAndReturnsTheExitStatusAndOutput(c *C) {
+	s.Docker.Responses["POST /containers/narc-some-guid/exec"] = `{"Id":"exec-id"}`
+	s.Docker.Responses["POST /exec/exec-id/start"] =
+		"\x01\x00\x00\x00\x00\x00\x00\x04out\n" +
+			"\x02\x00\x00\x00\x00\x00\x00\x04err\n" +
+			"\x01\x00\x00\x00\x00\x00\x00\x05more\n"
+	s.Docker.Responses["GET /exec/exec-id/json"] = `{"ExitCode":42}`
+
+	container := &DockerContainer{Handle: "narc-some-guid", client: newDockerClient(s.SocketPath)}
+
+	info, err := container.Run("exit 42")
+	c.Assert(err, IsNil)
+	c.Assert(info.ExitStatus, Equals, uint32(42))
+	c.Assert(string(info.Stdout), Equals, "out\nmore\n")
+	c.Assert(string(info.Stderr), Equals, "err\n")
+
+	var exec dockerExecRequest
+
+	err = json.Unmarshal([]byte(s.Docker.Requests[0].Body), &exec)
+	c.Assert(err, IsNil)
+	c.Assert(exec.Cmd, DeepEquals, []string{"/bin/sh", "-c", "exit 42"})
+}
+
+func (s *DKSuite) TestConsoleAttachesToAnExecWithATerminal(c *C) {
+	s.Docker.Responses["POST /containers/narc-some-guid/exec"] = `{"Id":"exec-id"}`
+	s.Docker.Responses["POST /exec/exec-id/resize"] = ``
+	s.Docker.Responses["GET /exec/exec-id/json"] = `{"ExitCode":3}`
+
+	s.Docker.Hijacks["POST /exec/exec-id/start"] = func(conn net.Conn) {
+		for i := 0; i < 100 && !s.Docker.requested("/exec/exec-id/resize?h=24&w=80"); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		io.Copy(conn, conn)
+	}
+
+	container := &DockerContainer{Handle: "narc-some-guid", client: newDockerClient(s.SocketPath)}
+
+	sizes := make(chan ttySize, 1)
+	sizes <- ttySize{Rows: 24, Cols: 80}
+
+	stdout := new(bytes.Buffer)
+
+	status, err := container.Console("vcap", []string{"/bin/sh", "-l"}, strings.NewReader("echo hi\n"), stdout, sizes)
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, 3)
+	c.Assert(stdout.String(), Equals, "echo hi\n")
+
+	c.Assert(s.Docker.requested("/exec/exec-id/resize?h=24&w=80"), Equals, true)
+
+	var exec dockerExecRequest
+
+	err = json.Unmarshal([]byte(s.Docker.Requests[0].Body), &exec)
+	c.Assert(err, IsNil)
+	c.Assert(exec, DeepEquals, dockerExecRequest{
+		Cmd:          []string{"/bin/sh", "-l"},
+		User:         "vcap",
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+	})
+}
+
+func (s *DKSuite) TestInfoReportsStatsAndSize(c *C) {
+	s.Docker.Responses["GET /containers/narc-some-guid/stats"] = `{
+		"memory_stats": {"usage": 1024, "limit": 4096},
+		"cpu_stats": {"cpu_usage": {"total_usage": 2000000000}},
+		"pids_stats": {"current": 3},
+		"networks": {
+			"eth0": {"rx_bytes": 10, "tx_bytes": 20},
+			"eth1": {"rx_bytes": 1, "tx_bytes": 2}
+		}
+	}`
+	s.Docker.Responses["GET /containers/narc-some-guid/json"] = `{"SizeRw":512,"HostConfig":{"StorageOpt":{"size":"2048"}}}`
+
+	container := &DockerContainer{Handle: "narc-some-guid", client: newDockerClient(s.SocketPath)}
+
+	info, err := container.Info()
+	c.Assert(err, IsNil)
+	c.Assert(*info, DeepEquals, ContainerInfo{
+		MemoryLimitInBytes: 4096,
+		DiskLimitInBytes:   2048,
+		MemoryUsageInBytes: 1024,
+		DiskUsageInBytes:   512,
+		CPUTime:            2 * time.Second,
+		Processes:          3,
+		NetworkRxBytes:     11,
+		NetworkTxBytes:     22,
+	})
+}
+
+func (s *DKSuite) TestListDockerContainersOnlyListsNarcContainers(c *C) {
+	s.Docker.Responses["GET /containers/json"] = `[
+		{"Names":["/narc-some-guid"]},
+		{"Names":["/something-else"]}
+	]`
+
+	containers, err := ListDockerContainers(s.SocketPath, "some-agent")
+	c.Assert(err, IsNil)
+
+	c.Assert(s.Docker.Requests[0].URI, Equals, "/containers/json?all=1&filters="+url.QueryEscape(`{"label":["owner=narc","agent=some-agent"]}`))
+
+	c.Assert(containers, HasLen, 1)
+	c.Assert(containers[0].ID(), Equals, "narc-some-guid")
+}
+
+func (s *DKSuite) TestRestoreDockerContainerStartsStoppedContainers(c *C) {
+	s.Docker.Responses["GET /containers/narc-some-guid/json"] = `{"State":{"Running":false}}`
+	s.Docker.Responses["POST /containers/narc-some-guid/start"] = ``
+
+	container, err := RestoreDockerContainer(s.SocketPath, "narc-some-guid")
+	c.Assert(err, IsNil)
+	c.Assert(container.ID(), Equals, "narc-some-guid")
+
+	c.Assert(s.Docker.Requests, HasLen, 2)
+	c.Assert(s.Docker.Requests[1].URI, Equals, "/containers/narc-some-guid/start")
+}
+
+func (s *DKSuite) TestLimitMemoryUpdatesTheContainer(c *C) {
+	s.Docker.Responses["POST /containers/narc-some-guid/update"] = `{}`
+
+	container := &DockerContainer{Handle: "narc-some-guid", client: newDockerClient(s.SocketPath)}
+
+	err := container.LimitMemory(1024)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.Docker.Requests[0].Body, Equals, `{"Memory":1024,"MemorySwap":1024}`)
+
+	c.Assert(container.LimitDisk(1024), Equals, DiskLimitNotChangeable)
+}
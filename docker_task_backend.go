@@ -0,0 +1,53 @@
+package narc
+
+import (
+	"os/exec"
+)
+
+// DockerTaskBackend runs tasks in containers created through a Docker
+// Engine compatible API. Sessions are attached through the same API, by a
+// narc process started as the container's console.
+type DockerTaskBackend struct {
+	SocketPath string
+	Image      string
+
+	// User is who sessions run as in the container; the image's default
+	// user if empty.
+	User string
+
+	// DiskLimits limits containers' disk with the "size" storage option,
+	// which needs a storage driver that supports it.
+	DiskLimits bool
+
+	// Owner is recorded on the containers this backend creates, and only
+	// containers recorded with it are listed.
+	Owner string
+}
+
+func (p DockerTaskBackend) ProvideContainer(spec ContainerSpec) (Container, error) {
+	spec.Owner = p.Owner
+
+	return NewDockerContainer(p.SocketPath, p.Image, p.DiskLimits, spec)
+}
+
+func (p DockerTaskBackend) RestoreContainer(handle string) (Container, error) {
+	return RestoreDockerContainer(p.SocketPath, handle)
+}
+
+func (p DockerTaskBackend) ListContainers() ([]Container, error) {
+	dockerContainers, err := ListDockerContainers(p.SocketPath, p.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := make([]Container, len(dockerContainers))
+	for i, container := range dockerContainers {
+		containers[i] = container
+	}
+
+	return containers, nil
+}
+
+func (p DockerTaskBackend) ProvideCommand(container Container) *exec.Cmd {
+	return dockerConsoleCommand(p.SocketPath, container.ID(), p.User)
+}
@@ -0,0 +1,78 @@
+package narc
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Drain stops the agent from accepting new tasks, withdraws the routes of
+// its running tasks and warns their attached users. Running tasks are left
+// alone.
+func (agent *Agent) Drain() {
+	agent.drainingLock.Lock()
+	alreadyDraining := agent.draining
+	agent.draining = true
+	agent.drainingLock.Unlock()
+
+	if alreadyDraining {
+		return
+	}
+
+	log.Println("draining")
+
+	for guid, task := range agent.Registry.Snapshot() {
+		agent.routerClient.Unregister(agent.routerPort, guid)
+		task.Broadcast("\r\nnarc: this node is draining and will be shut down soon\r\n")
+	}
+}
+
+func (agent *Agent) Draining() bool {
+	agent.drainingLock.RLock()
+	defer agent.drainingLock.RUnlock()
+
+	return agent.draining
+}
+
+// Shutdown drains the agent, waits up to the timeout for its tasks to
+// complete, and then stops whatever is still running.
+func (agent *Agent) Shutdown(timeout time.Duration) {
+	agent.Drain()
+
+	warning := fmt.Sprintf("\r\nnarc: this node is shutting down; this session will end in %s\r\n", timeout)
+
+	for _, task := range agent.Registry.Snapshot() {
+		task.Broadcast(warning)
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		if len(agent.Registry.Snapshot()) == 0 {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// tasks are stopped together, so that their grace periods overlap
+	stopped := &sync.WaitGroup{}
+
+	for guid := range agent.Registry.Snapshot() {
+		log.Println("stopping task after drain:", guid)
+
+		stopped.Add(1)
+
+		go func(guid string) {
+			defer stopped.Done()
+
+			err := agent.stopTask(guid)
+			if err != nil {
+				log.Printf("failed to stop task %s: %s\n", guid, err)
+			}
+		}(guid)
+	}
+
+	stopped.Wait()
+}
@@ -0,0 +1,116 @@
+package narc
+
+import (
+	"code.google.com/p/go.crypto/ssh"
+	"github.com/cloudfoundry/gibson/fake_router_client"
+	"github.com/cloudfoundry/go_cfmessagebus/mock_cfmessagebus"
+	"io"
+	. "launchpad.net/gocheck"
+	"os/exec"
+	"time"
+)
+
+type DSuite struct {
+	Agent *Agent
+
+	RouterClient *fake_gibson.FakeRouterClient
+	MessageBus   *mock_cfmessagebus.MockMessageBus
+}
+
+func init() {
+	Suite(&DSuite{})
+}
+
+func (s *DSuite) SetUpTest(c *C) {
+	s.RouterClient = fake_gibson.NewFakeRouterClient()
+
+	agent, err := NewAgent(FakeTaskBackend{Command: exec.Command("sleep", "100")}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	agent.Capacity = CapacityConfig{MemoryInBytes: 64 * 1024 * 1024, DiskInBytes: 64 * 1024 * 1024}
+
+	s.Agent = agent
+
+	s.MessageBus = mock_cfmessagebus.NewMockMessageBus()
+
+	err = agent.HandleStarts(s.MessageBus)
+	c.Assert(err, IsNil)
+}
+
+func (s *DSuite) TestDrainingAgentRejectsStarts(c *C) {
+	s.Agent.Drain()
+
+	c.Assert(s.Agent.Draining(), Equals, true)
+
+	s.MessageBus.PublishSync("task.start", []byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+
+	_, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+
+	_, err := s.Agent.startTask("some-token", ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 1},
+	}, nil, StopPolicy{})
+	c.Assert(err, Equals, AgentDraining)
+}
+
+func (s *DSuite) TestDrainingAgentAdvertisesNoCapacity(c *C) {
+	c.Assert(s.Agent.Advertisement().AvailableMemory, Equals, uint64(64))
+
+	s.Agent.Drain()
+
+	advertisement := s.Agent.Advertisement()
+	c.Assert(advertisement.Draining, Equals, true)
+	c.Assert(advertisement.AvailableMemory, Equals, uint64(0))
+	c.Assert(advertisement.AvailableDisk, Equals, uint64(0))
+}
+
+func (s *DSuite) TestDrainUnregistersRoutesAndWarnsUsers(c *C) {
+	task, err := s.Agent.startTask("some-token", ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 1},
+	}, nil, StopPolicy{})
+	c.Assert(err, IsNil)
+
+	defer task.Stop()
+
+	channel := NewFakeChannel([]ssh.ChannelRequest{})
+
+	reader := NewExpector(channel.readPipe, 1*time.Second)
+
+	c.Assert(s.RouterClient.IsRegistered(42, "some-guid"), Equals, true)
+
+	// attach without consuming the fake channel's input, which would detach it
+	task.lock.Lock()
+	task.sessions = []io.Writer{channel}
+	task.lock.Unlock()
+
+	go s.Agent.Drain()
+
+	expect(c, reader, `this node is draining`)
+
+	c.Assert(s.RouterClient.IsRegistered(42, "some-guid"), Equals, false)
+
+	_, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+}
+
+func (s *DSuite) TestShutdownStopsRemainingTasks(c *C) {
+	task, err := s.Agent.startTask("some-token", ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 1},
+	}, nil, StopPolicy{})
+	c.Assert(err, IsNil)
+
+	_, _, err = task.Start()
+	c.Assert(err, IsNil)
+
+	s.Agent.Shutdown(100 * time.Millisecond)
+
+	_, found := s.Agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+
+	c.Assert(task.container.(*FakeContainer).IsDestroyed(), Equals, true)
+}
@@ -1,22 +1,48 @@
 package narc
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"io/ioutil"
 	"os/exec"
 	"sync"
 )
 
 type FakeTaskBackend struct {
-	Command *exec.Cmd
+	Container    *FakeContainer
+	Command      *exec.Cmd
+	Containers   []Container
+	RestoreError error
 }
 
-func (b FakeTaskBackend) ProvideContainer(limits TaskLimits) (Container, error) {
+func (b FakeTaskBackend) ProvideContainer(spec ContainerSpec) (Container, error) {
+	if b.Container != nil {
+		return b.Container, nil
+	}
+
 	return &FakeContainer{
-		LimitedDisk:   &limits.DiskLimitInBytes,
-		LimitedMemory: &limits.MemoryLimitInBytes,
+		Handle:        spec.ContainerHandle(),
+		Image:         spec.Image,
+		BindMounts:    spec.BindMounts,
+		Network:       spec.Network,
+		LimitedDisk:   &spec.Limits.DiskLimitInBytes,
+		LimitedMemory: &spec.Limits.MemoryLimitInBytes,
 	}, nil
 }
 
+func (b FakeTaskBackend) RestoreContainer(handle string) (Container, error) {
+	if b.RestoreError != nil {
+		return nil, b.RestoreError
+	}
+
+	return &FakeContainer{Handle: handle}, nil
+}
+
+func (b FakeTaskBackend) ListContainers() ([]Container, error) {
+	return b.Containers, nil
+}
+
 func (b FakeTaskBackend) ProvideCommand(container Container) *exec.Cmd {
 	if b.Command != nil {
 		return b.Command
@@ -27,13 +53,23 @@ func (b FakeTaskBackend) ProvideCommand(container Container) *exec.Cmd {
 
 type FakeContainer struct {
 	Handle      string
+	Image       string
+	BindMounts  []BindMount
+	Network     NetworkPolicy
 	LastCommand string
 	ShouldError bool
+	ExitStatus  uint32
+	Usage       ContainerInfo
+
+	LimitedMemory     *uint64
+	LimitedDisk       *uint64
+	DiskNotChangeable bool
 
-	LimitedMemory *uint64
-	LimitedDisk   *uint64
+	Archive       []byte
+	StreamedPaths []string
 
 	destroyed bool
+	destroys  int
 
 	sync.RWMutex
 }
@@ -47,10 +83,18 @@ func (c *FakeContainer) Destroy() error {
 	defer c.Unlock()
 
 	c.destroyed = true
+	c.destroys++
 
 	return nil
 }
 
+func (c *FakeContainer) Destroys() int {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.destroys
+}
+
 func (c *FakeContainer) IsDestroyed() bool {
 	c.RLock()
 	defer c.RUnlock()
@@ -65,7 +109,17 @@ func (c *FakeContainer) Run(command string) (*JobInfo, error) {
 
 	c.LastCommand = command
 
-	return &JobInfo{}, nil
+	return &JobInfo{ExitStatus: c.ExitStatus}, nil
+}
+
+func (c *FakeContainer) StreamOut(paths []string) (io.ReadCloser, error) {
+	if c.ShouldError {
+		return nil, errors.New("uh oh")
+	}
+
+	c.StreamedPaths = paths
+
+	return ioutil.NopCloser(bytes.NewReader(c.Archive)), nil
 }
 
 func (c *FakeContainer) NetIn() (MappedPort, error) {
@@ -78,10 +132,19 @@ func (c *FakeContainer) LimitMemory(limit uint64) error {
 }
 
 func (c *FakeContainer) LimitDisk(limit uint64) error {
+	if c.DiskNotChangeable {
+		return DiskLimitNotChangeable
+	}
+
 	c.LimitedDisk = &limit
 	return nil
 }
 
 func (c *FakeContainer) Info() (*ContainerInfo, error) {
-	return &ContainerInfo{}, nil
+	if c.ShouldError {
+		return nil, errors.New("uh oh")
+	}
+
+	usage := c.Usage
+	return &usage, nil
 }
@@ -0,0 +1,334 @@
+package narc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/nu7hatch/gouuid"
+)
+
+// HandoffEnv is the environment variable a re-executed narc process finds
+// its handoff in.
+const HandoffEnv = "NARC_HANDOFF"
+
+// Handoff is what a narc process passes to the process replacing it: the
+// console relay, the SSH host key, and every task with the pty of its
+// running process and its relayed sessions.
+//
+// The host key is not part of the payload in the environment, where it
+// would stay readable for the life of the process, but is read from an
+// inherited pipe.
+//
+// The replacement is exec'd in place, so it keeps the PID and remains the
+// parent of the tasks' processes and of the relay. SSH connections are
+// held by the relay, so they are kept, as are their sessions.
+type Handoff struct {
+	AgentID   string        `json:"agent_id"`
+	HostKey   []byte        `json:"-"`
+	HostKeyFD uintptr       `json:"host_key_fd,omitempty"`
+	RelayFD   uintptr       `json:"relay_fd"`
+	RelayPID  int           `json:"relay_pid,omitempty"`
+	Tasks     []HandoffTask `json:"tasks"`
+
+	// duplicated descriptors, kept open until exec
+	files []*os.File
+
+	// descriptors that were marked to be inherited in place
+	inherited []uintptr
+}
+
+// HandoffTask is a task record plus, for started tasks, the descriptor of
+// its pty, the PID of its process and the descriptors of its sessions.
+type HandoffTask struct {
+	TaskRecord
+
+	PtyFD      uintptr   `json:"pty_fd,omitempty"`
+	PID        int       `json:"pid,omitempty"`
+	SessionFDs []uintptr `json:"session_fds,omitempty"`
+}
+
+// handoffSession is implemented by sessions that can be handed off, i.e.
+// those of the console relay. Sessions of SSH connections served in process
+// cannot be.
+type handoffSession interface {
+	File() (*os.File, error)
+}
+
+// LoadHandoff returns the handoff from the previous process, and false if
+// this process was not started by a handoff.
+func LoadHandoff() (*Handoff, bool, error) {
+	payload := os.Getenv(HandoffEnv)
+	if payload == "" {
+		return nil, false, nil
+	}
+
+	os.Unsetenv(HandoffEnv)
+
+	var handoff Handoff
+
+	err := json.Unmarshal([]byte(payload), &handoff)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if handoff.HostKeyFD != 0 {
+		pipe := os.NewFile(handoff.HostKeyFD, "narc-host-key")
+
+		handoff.HostKey, err = ioutil.ReadAll(pipe)
+		pipe.Close()
+
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return &handoff, true, nil
+}
+
+// NewHandoff collects the console relay and the agent's tasks, and marks
+// their descriptors to be inherited across exec.
+func NewHandoff(agent *Agent, relay *Relay) (*Handoff, error) {
+	handoff := &Handoff{
+		AgentID:  agent.ID.String(),
+		HostKey:  relay.HostKey(),
+		RelayPID: relay.PID(),
+		Tasks:    []HandoffTask{},
+	}
+
+	err := handoff.collect(agent, relay)
+	if err != nil {
+		handoff.release()
+		return nil, err
+	}
+
+	return handoff, nil
+}
+
+func (h *Handoff) collect(agent *Agent, relay *Relay) error {
+	err := h.passHostKey()
+	if err != nil {
+		return err
+	}
+
+	control, err := relay.File()
+	if err != nil {
+		return err
+	}
+
+	h.RelayFD, err = h.inheritFile(control)
+	if err != nil {
+		return err
+	}
+
+	for guid, task := range agent.Registry.Snapshot() {
+		handoffTask := HandoffTask{TaskRecord: NewTaskRecord(guid, task)}
+
+		pty, process := task.running()
+		if pty != nil && process != nil {
+			handoffTask.PtyFD = pty.Fd()
+			handoffTask.PID = process.Pid
+
+			err := h.inherit(handoffTask.PtyFD)
+			if err != nil {
+				return err
+			}
+
+			for _, attached := range task.attached() {
+				session, ok := attached.(handoffSession)
+				if !ok {
+					continue
+				}
+
+				file, err := session.File()
+				if err != nil {
+					return err
+				}
+
+				fd, err := h.inheritFile(file)
+				if err != nil {
+					return err
+				}
+
+				handoffTask.SessionFDs = append(handoffTask.SessionFDs, fd)
+			}
+		}
+
+		h.Tasks = append(h.Tasks, handoffTask)
+	}
+
+	return nil
+}
+
+// passHostKey writes the host key into a pipe, whose reading end is
+// inherited. The key is small enough to fit in the pipe's buffer.
+func (h *Handoff) passHostKey() error {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(h.HostKey)
+	writer.Close()
+
+	if err != nil {
+		reader.Close()
+		return err
+	}
+
+	h.HostKeyFD, err = h.inheritFile(reader)
+
+	return err
+}
+
+// inheritFile keeps a duplicated descriptor open until exec, and marks it
+// to be inherited.
+func (h *Handoff) inheritFile(file *os.File) (uintptr, error) {
+	h.files = append(h.files, file)
+
+	fd := file.Fd()
+
+	return fd, inheritable(fd)
+}
+
+func (h *Handoff) inherit(fd uintptr) error {
+	h.inherited = append(h.inherited, fd)
+
+	return inheritable(fd)
+}
+
+// release closes the duplicated descriptors and marks the others to be
+// closed on exec again, so that they do not leak into the processes and
+// containers narc starts after a failed handoff.
+func (h *Handoff) release() {
+	for _, file := range h.files {
+		file.Close()
+	}
+
+	for _, fd := range h.inherited {
+		syscall.CloseOnExec(int(fd))
+	}
+
+	h.files = nil
+	h.inherited = nil
+}
+
+// Exec replaces the current process with a fresh copy of the narc binary,
+// passing it the handoff. It only returns if that fails, after releasing
+// the handed off descriptors.
+func (h *Handoff) Exec() error {
+	defer h.release()
+
+	payload, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, HandoffEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	env = append(env, fmt.Sprintf("%s=%s", HandoffEnv, payload))
+
+	return syscall.Exec(binary, os.Args, env)
+}
+
+// Resume takes over the identity and tasks of the agent that handed off.
+func (agent *Agent) Resume(handoff *Handoff) error {
+	id, err := uuid.ParseHex(handoff.AgentID)
+	if err != nil {
+		return err
+	}
+
+	agent.ID = id
+
+	return agent.ResumeTasks(handoff.Tasks)
+}
+
+// ResumeTasks registers the handed off tasks again. Started tasks are
+// reattached to their pty, process and sessions; pending tasks get a fresh
+// command.
+func (agent *Agent) ResumeTasks(tasks []HandoffTask) error {
+	restorer, ok := agent.taskBackend.(ContainerRestorer)
+	if !ok {
+		return fmt.Errorf("task backend cannot restore containers")
+	}
+
+	for _, handoffTask := range tasks {
+		task, err := agent.resumeTask(restorer, handoffTask)
+		if err != nil {
+			log.Printf("failed to resume task %s: %s\n", handoffTask.Task, err)
+
+			// ends the sessions in the console relay
+			for _, fd := range handoffTask.SessionFDs {
+				syscall.Close(int(fd))
+			}
+
+			continue
+		}
+
+		task.SecureTokenHash = handoffTask.SecureTokenHash
+		task.Limits = handoffTask.Limits
+		task.StopPolicy = handoffTask.StopPolicy
+		task.StartedAt = handoffTask.StartedAt
+
+		agent.registerTask(handoffTask.Task, task)
+
+		for _, fd := range handoffTask.SessionFDs {
+			session, err := unixConn(os.NewFile(fd, "narc-relay"))
+			if err != nil {
+				log.Printf("failed to resume a session of task %s: %s\n", handoffTask.Task, err)
+				continue
+			}
+
+			task.follow(session)
+		}
+
+		if handoffTask.PID != 0 {
+			task.Watch()
+		}
+
+		log.Printf("resumed task %s\n", handoffTask.Task)
+	}
+
+	return nil
+}
+
+func (agent *Agent) resumeTask(restorer ContainerRestorer, handoffTask HandoffTask) (*Task, error) {
+	container, err := restoreContainer(restorer, handoffTask.TaskRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	if handoffTask.PID == 0 {
+		return NewTask(container, "", agent.taskBackend.ProvideCommand(container))
+	}
+
+	process, err := os.FindProcess(handoffTask.PID)
+	if err != nil {
+		return nil, err
+	}
+
+	return ResumeTask(container, os.NewFile(handoffTask.PtyFD, "pty"), process), nil
+}
+
+func inheritable(fd uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package narc
+
+import (
+	"encoding/json"
+	"github.com/cloudfoundry/gibson/fake_router_client"
+	"github.com/kr/pty"
+	. "launchpad.net/gocheck"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+type HSuite struct{}
+
+func init() {
+	Suite(&HSuite{})
+}
+
+func (s *HSuite) TestLoadHandoffWithoutHandoff(c *C) {
+	os.Setenv(HandoffEnv, "")
+
+	_, found, err := LoadHandoff()
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+}
+
+func (s *HSuite) TestLoadHandoff(c *C) {
+	os.Setenv(HandoffEnv, `{"agent_id":"some-agent","relay_fd":3,"relay_pid":41,"tasks":[{"task":"some-guid","pty_fd":4,"pid":42,"session_fds":[5,6]}]}`)
+
+	handoff, found, err := LoadHandoff()
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+
+	c.Assert(handoff.AgentID, Equals, "some-agent")
+	c.Assert(handoff.RelayFD, Equals, uintptr(3))
+	c.Assert(handoff.RelayPID, Equals, 41)
+	c.Assert(handoff.Tasks, HasLen, 1)
+	c.Assert(handoff.Tasks[0].Task, Equals, "some-guid")
+	c.Assert(handoff.Tasks[0].PtyFD, Equals, uintptr(4))
+	c.Assert(handoff.Tasks[0].PID, Equals, 42)
+	c.Assert(handoff.Tasks[0].SessionFDs, DeepEquals, []uintptr{5, 6})
+
+	c.Assert(os.Getenv(HandoffEnv), Equals, "")
+}
+
+func (s *HSuite) TestLoadHandoffReadsTheHostKeyFromAPipe(c *C) {
+	handoff := &Handoff{AgentID: "some-agent", HostKey: []byte("some-host-key")}
+
+	err := handoff.passHostKey()
+	c.Assert(err, IsNil)
+
+	defer handoff.release()
+
+	// the loaded handoff closes its own descriptor
+	fd, err := syscall.Dup(int(handoff.HostKeyFD))
+	c.Assert(err, IsNil)
+
+	handoff.HostKeyFD = uintptr(fd)
+
+	payload, err := json.Marshal(handoff)
+	c.Assert(err, IsNil)
+	c.Assert(string(payload), Not(Matches), ".*some-host-key.*")
+
+	os.Setenv(HandoffEnv, string(payload))
+
+	loaded, found, err := LoadHandoff()
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(string(loaded.HostKey), Equals, "some-host-key")
+}
+
+func (s *HSuite) TestResumedTaskReportsCompletion(c *C) {
+	command := exec.Command("bash", "-c", "read foo; exit 7")
+
+	tty, err := pty.Start(command)
+	c.Assert(err, IsNil)
+
+	container := &FakeContainer{}
+
+	task := ResumeTask(container, tty, command.Process)
+
+	c.Assert(task.State(), Equals, "running")
+
+	done := make(chan bool)
+
+	task.OnComplete(func() { done <- true })
+	task.Watch()
+
+	tty.Write([]byte("\n"))
+
+	select {
+	case <-done:
+		status, exited := task.ExitStatus()
+		c.Assert(exited, Equals, true)
+		c.Assert(status, Equals, 7)
+
+		c.Assert(container.IsDestroyed(), Equals, true)
+	case <-time.After(1 * time.Second):
+		c.Error("Was not notified of task completion!")
+	}
+}
+
+func (s *HSuite) TestAgentResumesPendingTasks(c *C) {
+	routerClient := fake_gibson.NewFakeRouterClient()
+
+	agent, err := NewAgent(FakeTaskBackend{}, routerClient, 42)
+	c.Assert(err, IsNil)
+
+	err = agent.ResumeTasks([]HandoffTask{
+		{
+			TaskRecord: TaskRecord{
+				Task:            "some-guid",
+				SecureTokenHash: HashSecureToken("some-token"),
+				ContainerHandle: "narc-some-guid",
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	task, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+
+	c.Assert(task.State(), Equals, "pending")
+	c.Assert(task.Authorize("some-token"), Equals, true)
+	c.Assert(routerClient.IsRegistered(42, "some-guid"), Equals, true)
+}
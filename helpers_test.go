@@ -5,10 +5,13 @@ import (
 	"code.google.com/p/goprotobuf/proto"
 	"errors"
 	"fmt"
+	"github.com/cloudfoundry/go_cfmessagebus/mock_cfmessagebus"
 	"github.com/cloudfoundry/gordon"
 	. "launchpad.net/gocheck"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -229,3 +232,67 @@ func waitReceive(from chan []byte, giveup time.Duration) []byte {
 		return nil
 	}
 }
+
+// waitForDestroy waits a while for a container to be destroyed, e.g. by a
+// task stopped in the background.
+func waitForDestroy(container *FakeContainer) {
+	for i := 0; i < 100 && !container.IsDestroyed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// queueMessageBus delivers messages on queue subscriptions to one member of
+// each queue group, in turn.
+type queueMessageBus struct {
+	*mock_cfmessagebus.MockMessageBus
+
+	queues map[string][]func([]byte)
+	next   map[string]int
+	lock   sync.Mutex
+}
+
+func newQueueMessageBus() *queueMessageBus {
+	return &queueMessageBus{
+		MockMessageBus: mock_cfmessagebus.NewMockMessageBus(),
+		queues:         make(map[string][]func([]byte)),
+		next:           make(map[string]int),
+	}
+}
+
+func (m *queueMessageBus) QueueSubscribe(subject, queue string, callback func([]byte)) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.queues[subject+" "+queue] = append(m.queues[subject+" "+queue], callback)
+
+	return nil
+}
+
+func (m *queueMessageBus) PublishSync(subject string, message []byte) error {
+	var callbacks []func([]byte)
+
+	m.lock.Lock()
+
+	for key, members := range m.queues {
+		if strings.HasPrefix(key, subject+" ") {
+			callbacks = append(callbacks, members[m.next[key]%len(members)])
+			m.next[key]++
+		}
+	}
+
+	m.lock.Unlock()
+
+	for _, callback := range callbacks {
+		callback(message)
+	}
+
+	return m.MockMessageBus.PublishSync(subject, message)
+}
+
+// completionCallbacks counts the callbacks waiting for the task to complete.
+func (t *Task) completionCallbacks() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return len(t.onCompleteCallbacks)
+}
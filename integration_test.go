@@ -1,6 +1,7 @@
 package narc
 
 import (
+	"github.com/cloudfoundry/gordon"
 	. "launchpad.net/gocheck"
 )
 
@@ -11,8 +12,11 @@ func init() {
 }
 
 func (w *WCISuite) TestNewWardenContainerSuccessEndToEnd(c *C) {
-	wardenContainer, err := NewWardenContainer("/tmp/warden.sock",
-		TaskLimits{MemoryLimitInBytes: 4, DiskLimitInBytes: 5}, &ContainerCreationRunnerInJson{})
+	wardenContainer, err := NewWardenContainer(&warden.ConnectionInfo{SocketPath: "/tmp/warden.sock"}, ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 4 * 1024 * 1024, DiskLimitInBytes: 5 * 1024 * 1024},
+	})
+	c.Assert(err, IsNil)
 	_, err = wardenContainer.Run("ls")
 	c.Assert(err, IsNil)
 	err = wardenContainer.Destroy()
@@ -0,0 +1,706 @@
+package narc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ContainerNotRunning = errors.New("container is not running")
+
+// LinuxContainer is a sandbox narc builds itself, without a container
+// daemon. A holder process keeps its PID, mount, UTS, IPC and network
+// namespaces alive; commands are run in them with nsenter(1).
+//
+// The root filesystem is an overlay of a shared, read-only root on a
+// loop-mounted ext4 scratch filesystem sized to the disk limit, and memory
+// is limited by a cgroup v2 leaf that every process in the sandbox is
+// placed in.
+type LinuxContainer struct {
+	Handle     string
+	Path       string
+	CgroupPath string
+	PID        int
+
+	UID int
+	GID int
+
+	// FDLimit is the number of files each process in the container may
+	// have open, or zero to inherit narc's limit.
+	FDLimit uint64
+
+	holder *exec.Cmd
+}
+
+// LinuxPaths says where a LinuxContainer's parts live on the host.
+type LinuxPaths struct {
+	// Containers is where each container's directory, holding its scratch
+	// filesystem and mounted root, is created.
+	Containers string
+
+	// RootFS is the read-only root filesystem containers are layered on,
+	// unless their spec names another as its image.
+	RootFS string
+
+	// Cgroup is the cgroup v2 directory containers' cgroups are created in.
+	Cgroup string
+}
+
+// NewLinuxContainer builds a container. Its network namespace is empty, so
+// only the default and "none" network policies can be honoured.
+func NewLinuxContainer(paths LinuxPaths, uid, gid int, spec ContainerSpec) (*LinuxContainer, error) {
+	if spec.Network.Mode != NetworkDefault && spec.Network.Mode != NetworkNone {
+		return nil, NetworkPolicyNotSupported
+	}
+
+	handle := spec.ContainerHandle()
+
+	container := &LinuxContainer{
+		Handle:     handle,
+		Path:       filepath.Join(paths.Containers, handle),
+		CgroupPath: filepath.Join(paths.Cgroup, handle),
+		UID:        uid,
+		GID:        gid,
+		FDLimit:    spec.Limits.FDLimit,
+	}
+
+	err := container.setUp(paths, spec)
+	if err != nil {
+		destroyErr := container.Destroy()
+		if destroyErr != nil {
+			log.Printf("failed to destroy container %s: %s\n", handle, destroyErr)
+		}
+
+		return nil, err
+	}
+
+	return container, nil
+}
+
+// RestoreLinuxContainer reconnects to a container, failing if its holder
+// process is gone, e.g. after a reboot.
+func RestoreLinuxContainer(paths LinuxPaths, uid, gid int, handle string) (*LinuxContainer, error) {
+	container := &LinuxContainer{
+		Handle:     handle,
+		Path:       filepath.Join(paths.Containers, handle),
+		CgroupPath: filepath.Join(paths.Cgroup, handle),
+		UID:        uid,
+		GID:        gid,
+	}
+
+	pid, err := ioutil.ReadFile(container.pidPath())
+	if err != nil {
+		return nil, err
+	}
+
+	container.PID, err = strconv.Atoi(strings.TrimSpace(string(pid)))
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Kill(container.PID, 0)
+	if err != nil {
+		return nil, ContainerNotRunning
+	}
+
+	fdLimit, err := ioutil.ReadFile(container.fdLimitPath())
+	if err == nil {
+		container.FDLimit, err = strconv.ParseUint(strings.TrimSpace(string(fdLimit)), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return container, nil
+}
+
+// ListLinuxContainers returns the containers narc created, whether or not
+// they are still running.
+func ListLinuxContainers(paths LinuxPaths, uid, gid int) ([]*LinuxContainer, error) {
+	entries, err := ioutil.ReadDir(paths.Containers)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	containers := []*LinuxContainer{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), ContainerHandlePrefix) {
+			continue
+		}
+
+		container, err := RestoreLinuxContainer(paths, uid, gid, entry.Name())
+		if err != nil {
+			container = &LinuxContainer{
+				Handle:     entry.Name(),
+				Path:       filepath.Join(paths.Containers, entry.Name()),
+				CgroupPath: filepath.Join(paths.Cgroup, entry.Name()),
+				UID:        uid,
+				GID:        gid,
+			}
+		}
+
+		containers = append(containers, container)
+	}
+
+	return containers, nil
+}
+
+func (c *LinuxContainer) ID() string {
+	return c.Handle
+}
+
+// Destroy kills every process in the container and tears down its
+// filesystems. Nothing is removed recursively, so that a bind mount that
+// failed to unmount can never be emptied.
+func (c *LinuxContainer) Destroy() error {
+	err := c.kill()
+	if err != nil {
+		return err
+	}
+
+	err = c.unmount(c.rootFSPath())
+	if err != nil {
+		return err
+	}
+
+	err = c.unmount(c.scratchPath())
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{
+		c.rootFSPath(),
+		c.scratchPath(),
+		c.diskImagePath(),
+		c.pidPath(),
+		c.fdLimitPath(),
+		c.Path,
+		c.CgroupPath,
+	} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run runs a script in the container with /bin/sh and waits for it to exit.
+func (c *LinuxContainer) Run(script string) (*JobInfo, error) {
+	return runJob(c.Command("/bin/sh", "-c", script))
+}
+
+func (c *LinuxContainer) StreamOut(paths []string) (io.ReadCloser, error) {
+	job, err := streamJob(c.Command("tar", tarArgs("/", paths)...))
+	if err != nil {
+		return nil, err
+	}
+
+	return newArchiveStream(job), nil
+}
+
+// Info reads usage from the container's cgroup and scratch filesystem. The
+// container has no network, so sends and receives nothing.
+func (c *LinuxContainer) Info() (*ContainerInfo, error) {
+	info := &ContainerInfo{}
+
+	memoryLimit, err := readCgroupFile(c.CgroupPath, "memory.max")
+	if err != nil {
+		return nil, err
+	}
+
+	// "max" means unlimited, which is left as zero.
+	info.MemoryLimitInBytes, _ = strconv.ParseUint(memoryLimit, 10, 64)
+
+	memoryUsage, err := readCgroupFile(c.CgroupPath, "memory.current")
+	if err != nil {
+		return nil, err
+	}
+
+	info.MemoryUsageInBytes, err = strconv.ParseUint(memoryUsage, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	memoryEvents, err := readCgroupFile(c.CgroupPath, "memory.events")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(memoryEvents, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+			info.OutOfMemory = true
+		}
+	}
+
+	cpuStat, err := readCgroupFile(c.CgroupPath, "cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(cpuStat, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usage, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+
+			info.CPUTime = time.Duration(usage) * time.Microsecond
+		}
+	}
+
+	procs, err := cgroupProcs(c.CgroupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Processes = len(procs)
+
+	var scratch syscall.Statfs_t
+
+	err = syscall.Statfs(c.scratchPath(), &scratch)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := os.Stat(c.diskImagePath())
+	if err != nil {
+		return nil, err
+	}
+
+	info.DiskLimitInBytes = uint64(image.Size())
+	info.DiskUsageInBytes = (scratch.Blocks - scratch.Bfree) * uint64(scratch.Bsize)
+	info.DiskQuotaExceeded = scratch.Bavail == 0
+
+	return info, nil
+}
+
+func (c *LinuxContainer) LimitMemory(limitInBytes uint64) error {
+	return writeCgroupFile(c.CgroupPath, "memory.max", strconv.FormatUint(limitInBytes, 10))
+}
+
+func (c *LinuxContainer) LimitDisk(limitInBytes uint64) error {
+	return DiskLimitNotChangeable
+}
+
+// Command returns a command that runs in the container's namespaces and
+// cgroup, as the container's user, limited to FDLimit open files.
+func (c *LinuxContainer) Command(name string, args ...string) *exec.Cmd {
+	script := `echo $$ > "$0" && exec nsenter "$@"`
+	if c.FDLimit > 0 {
+		script = fmt.Sprintf("ulimit -n %d && %s", c.FDLimit, script)
+	}
+
+	enter := []string{
+		"-c", script,
+		filepath.Join(c.CgroupPath, "cgroup.procs"),
+		"--target", strconv.Itoa(c.PID),
+		"--pid", "--mount", "--uts", "--ipc", "--net", "--root", "--wd",
+		"--setuid", strconv.Itoa(c.UID), "--setgid", strconv.Itoa(c.GID),
+		"--", name,
+	}
+
+	cmd := exec.Command("/bin/sh", append(enter, args...)...)
+	cmd.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin"}
+
+	return cmd
+}
+
+func (c *LinuxContainer) setUp(paths LinuxPaths, spec ContainerSpec) error {
+	err := os.MkdirAll(c.Path, 0700)
+	if err != nil {
+		return err
+	}
+
+	err = setUpCgroup(paths.Cgroup, c.CgroupPath, spec.Limits)
+	if err != nil {
+		return err
+	}
+
+	err = c.setUpDisk(spec.Limits.DiskLimitInBytes)
+	if err != nil {
+		return err
+	}
+
+	if c.FDLimit > 0 {
+		err = ioutil.WriteFile(c.fdLimitPath(), []byte(strconv.FormatUint(c.FDLimit, 10)), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	rootFS := spec.Image
+	if rootFS == "" {
+		rootFS = paths.RootFS
+	}
+
+	err = c.setUpRootFS(rootFS, spec.BindMounts)
+	if err != nil {
+		return err
+	}
+
+	return c.startHolder()
+}
+
+func (c *LinuxContainer) setUpDisk(limitInBytes uint64) error {
+	image, err := os.Create(c.diskImagePath())
+	if err != nil {
+		return err
+	}
+
+	err = image.Truncate(int64(limitInBytes))
+	image.Close()
+	if err != nil {
+		return err
+	}
+
+	err = runHostCommand("mkfs.ext4", "-q", "-F", c.diskImagePath())
+	if err != nil {
+		return err
+	}
+
+	err = os.Mkdir(c.scratchPath(), 0700)
+	if err != nil {
+		return err
+	}
+
+	return runHostCommand("mount", "-o", "loop", c.diskImagePath(), c.scratchPath())
+}
+
+func (c *LinuxContainer) setUpRootFS(lower string, bindMounts []BindMount) error {
+	upper := filepath.Join(c.scratchPath(), "upper")
+	work := filepath.Join(c.scratchPath(), "work")
+
+	for _, dir := range []string{upper, work, c.rootFSPath()} {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := syscall.Mount(
+		"overlay",
+		c.rootFSPath(),
+		"overlay",
+		0,
+		fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, mount := range bindMounts {
+		target := filepath.Join(c.rootFSPath(), mount.DstPath)
+
+		err := createMountPoint(mount.SrcPath, target)
+		if err != nil {
+			return err
+		}
+
+		err = syscall.Mount(mount.SrcPath, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err != nil {
+			return err
+		}
+
+		if mount.ReadOnly {
+			err = syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// startHolder starts the process that keeps the container's namespaces
+// alive. Its mount namespace is private, so mounting /proc in it does not
+// leak to the host.
+func (c *LinuxContainer) startHolder() error {
+	cgroup, err := os.Open(c.CgroupPath)
+	if err != nil {
+		return err
+	}
+
+	defer cgroup.Close()
+
+	holder := exec.Command("/bin/sh", "-c", "mount -t proc proc /proc && exec sleep 2147483647")
+	holder.Dir = "/"
+	holder.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin"}
+	holder.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWUTS |
+			syscall.CLONE_NEWIPC |
+			syscall.CLONE_NEWNET,
+		Unshareflags: syscall.CLONE_NEWNS,
+		Chroot:       c.rootFSPath(),
+		Setsid:       true,
+		UseCgroupFD:  true,
+		CgroupFD:     int(cgroup.Fd()),
+	}
+
+	err = holder.Start()
+	if err != nil {
+		return err
+	}
+
+	c.holder = holder
+	c.PID = holder.Process.Pid
+
+	go holder.Wait()
+
+	return ioutil.WriteFile(c.pidPath(), []byte(strconv.Itoa(c.PID)), 0600)
+}
+
+// kill kills every process in the container's cgroup and waits for them to
+// go away.
+func (c *LinuxContainer) kill() error {
+	_, err := os.Stat(c.CgroupPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	// cgroup.kill is only there since Linux 5.14
+	err = writeCgroupFile(c.CgroupPath, "cgroup.kill", "1")
+	if err != nil {
+		pids, err := cgroupProcs(c.CgroupPath)
+		if err != nil {
+			return err
+		}
+
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		pids, err := cgroupProcs(c.CgroupPath)
+		if err != nil || len(pids) == 0 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// holders started by a previous narc process that handed off to this
+	// one are still its children, and nothing else reaps them
+	if c.holder == nil && c.PID != 0 {
+		var status syscall.WaitStatus
+		syscall.Wait4(c.PID, &status, syscall.WNOHANG, nil)
+	}
+
+	return nil
+}
+
+func (c *LinuxContainer) unmount(path string) error {
+	err := syscall.Unmount(path, syscall.MNT_DETACH)
+	if err == syscall.EINVAL || err == syscall.ENOENT {
+		return nil
+	}
+
+	return err
+}
+
+func (c *LinuxContainer) rootFSPath() string {
+	return filepath.Join(c.Path, "rootfs")
+}
+
+func (c *LinuxContainer) scratchPath() string {
+	return filepath.Join(c.Path, "scratch")
+}
+
+func (c *LinuxContainer) diskImagePath() string {
+	return filepath.Join(c.Path, "disk.img")
+}
+
+func (c *LinuxContainer) fdLimitPath() string {
+	return filepath.Join(c.Path, "fd_limit")
+}
+
+func (c *LinuxContainer) pidPath() string {
+	return filepath.Join(c.Path, "pid")
+}
+
+// createMountPoint creates a directory, or an empty file if the source is
+// a file, to bind mount the source onto.
+func createMountPoint(src, target string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// setUpCgroup creates a container's cgroup under root, delegating the
+// memory controller to it, and the cpu and pids controllers if it has CPU
+// or PID limits.
+func setUpCgroup(root, path string, limits TaskLimits) error {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return err
+	}
+
+	controllers := "+memory"
+
+	if limits.CPUShares > 0 || limits.CPUQuotaInPercent > 0 {
+		controllers += " +cpu"
+	}
+
+	if limits.PIDLimit > 0 {
+		controllers += " +pids"
+	}
+
+	for _, dir := range []string{filepath.Dir(root), root} {
+		err := writeCgroupFile(dir, "cgroup.subtree_control", controllers)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Mkdir(path, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = writeCgroupFile(path, "memory.max", strconv.FormatUint(limits.MemoryLimitInBytes, 10))
+	if err != nil {
+		return err
+	}
+
+	if limits.CPUShares > 0 {
+		err = writeCgroupFile(path, "cpu.weight", strconv.FormatUint(cpuWeightFor(limits.CPUShares), 10))
+		if err != nil {
+			return err
+		}
+	}
+
+	if limits.CPUQuotaInPercent > 0 {
+		quota := cgroupCPUPeriod * limits.CPUQuotaInPercent / 100
+
+		err = writeCgroupFile(path, "cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod))
+		if err != nil {
+			return err
+		}
+	}
+
+	if limits.PIDLimit > 0 {
+		err = writeCgroupFile(path, "pids.max", strconv.FormatUint(limits.PIDLimit, 10))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeCgroupFile(path, "memory.swap.max", "0")
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// cgroupCPUPeriod is the period, in microseconds, CPU quotas are enforced
+// over.
+const cgroupCPUPeriod = 100000
+
+// cpuWeightFor converts cgroup v1 style CPU shares, 2 to 262144, to a
+// cgroup v2 weight, 1 to 10000.
+func cpuWeightFor(shares uint64) uint64 {
+	if shares < 2 {
+		shares = 2
+	}
+
+	if shares > 262144 {
+		shares = 262144
+	}
+
+	return 1 + (shares-2)*9999/262142
+}
+
+// writeCgroupFile writes to an existing cgroup interface file; they cannot
+// be created.
+func writeCgroupFile(cgroup, file, value string) error {
+	f, err := os.OpenFile(filepath.Join(cgroup, file), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write([]byte(value))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func readCgroupFile(cgroup, file string) (string, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(cgroup, file))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(contents)), nil
+}
+
+func cgroupProcs(cgroup string) ([]int, error) {
+	procs, err := ioutil.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+
+	pids := []int{}
+
+	for _, line := range strings.Fields(string(procs)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+
+		pids = append(pids, pid)
+	}
+
+	return pids, nil
+}
+
+func runHostCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s: %s", name, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
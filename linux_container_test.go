@@ -0,0 +1,139 @@
+package narc
+
+import (
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type LCSuite struct {
+	Paths LinuxPaths
+}
+
+func init() {
+	Suite(&LCSuite{})
+}
+
+func (s *LCSuite) SetUpTest(c *C) {
+	root := c.MkDir()
+
+	s.Paths = LinuxPaths{
+		Containers: filepath.Join(root, "containers"),
+		RootFS:     filepath.Join(root, "rootfs"),
+		Cgroup:     filepath.Join(root, "cgroup", "narc"),
+	}
+}
+
+func (s *LCSuite) TestCommandEntersTheContainer(c *C) {
+	container := &LinuxContainer{
+		Handle:     "narc-some-guid",
+		CgroupPath: "/sys/fs/cgroup/narc/narc-some-guid",
+		PID:        42,
+		UID:        10000,
+		GID:        10001,
+	}
+
+	cmd := container.Command("/bin/sh", "-l")
+
+	c.Assert(cmd.Args, DeepEquals, []string{
+		"/bin/sh", "-c", `echo $$ > "$0" && exec nsenter "$@"`,
+		"/sys/fs/cgroup/narc/narc-some-guid/cgroup.procs",
+		"--target", "42",
+		"--pid", "--mount", "--uts", "--ipc", "--net", "--root", "--wd",
+		"--setuid", "10000", "--setgid", "10001",
+		"--", "/bin/sh", "-l",
+	})
+}
+
+func (s *LCSuite) TestNewLinuxContainerRefusesNetworkAccess(c *C) {
+	for _, mode := range []NetworkMode{NetworkEgress, NetworkAllowList} {
+		_, err := NewLinuxContainer(s.Paths, 10000, 10000, ContainerSpec{
+			Task:    "some-guid",
+			Network: NetworkPolicy{Mode: mode},
+		})
+		c.Assert(err, Equals, NetworkPolicyNotSupported)
+	}
+}
+
+func (s *LCSuite) TestCommandAppliesTheFDLimit(c *C) {
+	container := &LinuxContainer{
+		CgroupPath: "/sys/fs/cgroup/narc/narc-some-guid",
+		PID:        42,
+		FDLimit:    256,
+	}
+
+	cmd := container.Command("/bin/sh", "-l")
+	c.Assert(cmd.Args[2], Equals, `ulimit -n 256 && echo $$ > "$0" && exec nsenter "$@"`)
+}
+
+func (s *LCSuite) TestCPUSharesConvertToCgroupWeights(c *C) {
+	c.Assert(cpuWeightFor(2), Equals, uint64(1))
+	c.Assert(cpuWeightFor(1024), Equals, uint64(39))
+	c.Assert(cpuWeightFor(262144), Equals, uint64(10000))
+	c.Assert(cpuWeightFor(1000000), Equals, uint64(10000))
+}
+
+func (s *LCSuite) TestLimitMemoryWritesTheCgroup(c *C) {
+	container := &LinuxContainer{CgroupPath: filepath.Join(s.Paths.Cgroup, "narc-some-guid")}
+	s.fakeCgroup(c, container.CgroupPath)
+
+	err := container.LimitMemory(1024)
+	c.Assert(err, IsNil)
+
+	c.Assert(s.readFile(c, container.CgroupPath, "memory.max"), Equals, "1024")
+
+	c.Assert(container.LimitDisk(1024), Equals, DiskLimitNotChangeable)
+}
+
+func (s *LCSuite) TestRestoreFindsTheHolderProcess(c *C) {
+	path := filepath.Join(s.Paths.Containers, "narc-some-guid")
+
+	err := os.MkdirAll(path, 0700)
+	c.Assert(err, IsNil)
+
+	err = ioutil.WriteFile(filepath.Join(path, "pid"), []byte(strconv.Itoa(os.Getpid())), 0600)
+	c.Assert(err, IsNil)
+
+	container, err := RestoreLinuxContainer(s.Paths, 1, 2, "narc-some-guid")
+	c.Assert(err, IsNil)
+	c.Assert(container.PID, Equals, os.Getpid())
+	c.Assert(container.CgroupPath, Equals, filepath.Join(s.Paths.Cgroup, "narc-some-guid"))
+
+	containers, err := ListLinuxContainers(s.Paths, 1, 2)
+	c.Assert(err, IsNil)
+	c.Assert(containers, HasLen, 1)
+	c.Assert(containers[0].PID, Equals, os.Getpid())
+}
+
+func (s *LCSuite) TestRestoreFailsWithoutAHolderProcess(c *C) {
+	_, err := RestoreLinuxContainer(s.Paths, 1, 2, "narc-some-guid")
+	c.Assert(err, NotNil)
+
+	err = os.MkdirAll(filepath.Join(s.Paths.Containers, "narc-some-guid"), 0700)
+	c.Assert(err, IsNil)
+
+	containers, err := ListLinuxContainers(s.Paths, 1, 2)
+	c.Assert(err, IsNil)
+	c.Assert(containers, HasLen, 1)
+	c.Assert(containers[0].PID, Equals, 0)
+}
+
+// fakeCgroup creates the interface files of a cgroup directory.
+func (s *LCSuite) fakeCgroup(c *C, path string) {
+	err := os.MkdirAll(path, 0755)
+	c.Assert(err, IsNil)
+
+	for _, file := range []string{"cgroup.subtree_control", "cgroup.procs", "memory.max"} {
+		err := ioutil.WriteFile(filepath.Join(path, file), nil, 0644)
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *LCSuite) readFile(c *C, dir, file string) string {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, file))
+	c.Assert(err, IsNil)
+
+	return string(contents)
+}
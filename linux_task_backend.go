@@ -0,0 +1,55 @@
+package narc
+
+import (
+	"log"
+	"os/exec"
+)
+
+// LinuxTaskBackend runs tasks in LinuxContainers, which narc builds itself
+// from namespaces, a cgroup v2 leaf and a loop-mounted scratch filesystem.
+// narc must run as root on a host with cgroup v2 mounted at Paths.Cgroup's
+// parent and nsenter, mount and mkfs.ext4 installed.
+type LinuxTaskBackend struct {
+	Paths LinuxPaths
+
+	// UID and GID are who sessions and scripts run as in containers.
+	UID int
+	GID int
+}
+
+func (p LinuxTaskBackend) ProvideContainer(spec ContainerSpec) (Container, error) {
+	return NewLinuxContainer(p.Paths, p.UID, p.GID, spec)
+}
+
+func (p LinuxTaskBackend) RestoreContainer(handle string) (Container, error) {
+	return RestoreLinuxContainer(p.Paths, p.UID, p.GID, handle)
+}
+
+func (p LinuxTaskBackend) ListContainers() ([]Container, error) {
+	linuxContainers, err := ListLinuxContainers(p.Paths, p.UID, p.GID)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := make([]Container, len(linuxContainers))
+	for i, container := range linuxContainers {
+		containers[i] = container
+	}
+
+	return containers, nil
+}
+
+func (p LinuxTaskBackend) ProvideCommand(container Container) *exec.Cmd {
+	linuxContainer, ok := container.(*LinuxContainer)
+	if !ok {
+		var err error
+
+		linuxContainer, err = RestoreLinuxContainer(p.Paths, p.UID, p.GID, container.ID())
+		if err != nil {
+			log.Printf("failed to find container %s: %s\n", container.ID(), err)
+			linuxContainer = &LinuxContainer{Handle: container.ID()}
+		}
+	}
+
+	return linuxContainer.Command("/bin/sh", "-l")
+}
@@ -3,6 +3,9 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/cloudfoundry/gibson"
 	"github.com/cloudfoundry/go_cfmessagebus"
@@ -12,6 +15,24 @@ import (
 var configFile = flag.String("config", "", "path to config file")
 
 func main() {
+	if os.Getenv(narc.RelayEnv) != "" {
+		err := narc.RunRelay()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		return
+	}
+
+	if os.Getenv(narc.DockerConsoleEnv) != "" {
+		status, err := narc.RunDockerConsole()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		os.Exit(status)
+	}
+
 	flag.Parse()
 
 	var config narc.Config
@@ -41,22 +62,70 @@ func main() {
 		return
 	}
 
-	containerProvider := narc.WardenTaskBackend{
-		WardenSocketPath:     config.WardenSocketPath,
-		WardenContainersPath: config.WardenContainersPath,
+	containerProvider, err := config.TaskBackend()
+	if err != nil {
+		log.Fatal(err.Error())
+		return
 	}
 
+	pool := narc.NewContainerPool(containerProvider, config.Pool.Size)
+
 	routerClient := gibson.NewCFRouterClient(config.Host, mbus)
 	routerClient.Greet()
 
 	proxyServerPort := 8081
 
-	agent, err := narc.NewAgent(containerProvider, routerClient, proxyServerPort)
+	agent, err := narc.NewAgent(pool, routerClient, proxyServerPort)
+	if err != nil {
+		log.Fatal(err.Error())
+		return
+	}
+
+	agent.Host = config.Host
+	agent.Capacity = config.Capacity
+	agent.Images = config.Images
+	agent.BindMountRoots = config.BindMountRoots
+	agent.DefaultLimits = config.Limits.Defaults
+	agent.MaximumLimits = config.Limits.Maximums
+	agent.StopGracePeriod = config.StopGracePeriod
+
+	if config.SnapshotPath != "" {
+		agent.Snapshots = &narc.DirectorySnapshotStore{Path: config.SnapshotPath}
+	}
+
+	handoff, handedOff, err := narc.LoadHandoff()
+	if err != nil {
+		log.Fatal(err.Error())
+		return
+	}
+
+	if config.StatePath != "" {
+		agent.Registry = narc.NewPersistentRegistry(&narc.FileRegistryStore{Path: config.StatePath})
+	}
+
+	if handedOff {
+		err = agent.Resume(handoff)
+	} else {
+		err = agent.RestoreTasks()
+	}
+
+	if err != nil {
+		log.Fatal(err.Error())
+		return
+	}
+
+	err = agent.ReconcileContainers(config.ReconcilePolicy)
 	if err != nil {
 		log.Fatal(err.Error())
 		return
 	}
 
+	if config.Pool.Size > 0 {
+		for _, class := range config.Pool.Classes {
+			pool.Warm(class.WithDefaults(config.Limits.Defaults))
+		}
+	}
+
 	err = agent.HandleStarts(mbus)
 	if err != nil {
 		log.Fatal(err.Error())
@@ -69,17 +138,91 @@ func main() {
 		return
 	}
 
-	server, err := narc.NewProxyServer(agent.Registry)
+	err = agent.HandleUpdates(mbus)
 	if err != nil {
 		log.Fatal(err.Error())
 		return
 	}
 
-	err = server.Start(proxyServerPort)
+	var relay *narc.Relay
+
+	if handedOff {
+		relay, err = narc.ResumeRelay(agent.Registry, handoff)
+	} else {
+		relay, err = narc.StartRelay(agent.Registry, proxyServerPort)
+	}
+
 	if err != nil {
 		log.Fatal(err.Error())
 		return
 	}
 
-	select {}
+	agent.HostKeyFingerprint, err = relay.HostKeyFingerprint()
+	if err != nil {
+		log.Fatal(err.Error())
+		return
+	}
+
+	err = agent.HandleDiscovers(mbus)
+	if err != nil {
+		log.Fatal(err.Error())
+		return
+	}
+
+	err = agent.HandleStatusRequests(mbus)
+	if err != nil {
+		log.Fatal(err.Error())
+		return
+	}
+
+	err = agent.HandleListRequests(mbus)
+	if err != nil {
+		log.Fatal(err.Error())
+		return
+	}
+
+	err = agent.HandleSnapshotRequests(mbus)
+	if err != nil {
+		log.Fatal(err.Error())
+		return
+	}
+
+	agent.AdvertisePeriodically(mbus, config.AdvertiseInterval)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	for sig := range signals {
+		if sig == syscall.SIGUSR2 {
+			log.Println("handing off to a new process")
+
+			handoff, err := narc.NewHandoff(agent, relay)
+			if err == nil {
+				err = handoff.Exec()
+			}
+
+			log.Println("handoff failed:", err)
+
+			continue
+		}
+
+		agent.Drain()
+
+		err := agent.Advertise(mbus)
+		if err != nil {
+			log.Println("failed to advertise:", err)
+		}
+
+		if sig == syscall.SIGUSR1 {
+			continue
+		}
+
+		agent.Shutdown(config.DrainTimeout)
+
+		pool.Close()
+
+		relay.Stop()
+
+		return
+	}
 }
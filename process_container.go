@@ -0,0 +1,188 @@
+package narc
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// UnshareArgs runs a command in new user, PID, mount, UTS and IPC
+// namespaces, as root within them, without needing privileges.
+var UnshareArgs = []string{
+	"unshare", "--user", "--map-root-user",
+	"--fork", "--pid", "--mount-proc", "--uts", "--ipc",
+}
+
+var ImageNotSupported = errors.New("images not supported by the task backend")
+var BindMountsNotSupported = errors.New("bind mounts not supported by the task backend")
+
+// ProcessContainer is a directory that tasks run in as plain local
+// processes, optionally in their own namespaces. Limits are recorded but
+// not enforced.
+type ProcessContainer struct {
+	Handle  string
+	Path    string
+	Unshare bool
+
+	Limits TaskLimits
+}
+
+// NewProcessContainer creates a container's directory. Tasks run on the
+// host's filesystem and network, so specs asking for an image, bind mounts
+// (which droplets are unpacked from) or a network policy are refused.
+func NewProcessContainer(root string, unshare bool, spec ContainerSpec) (*ProcessContainer, error) {
+	if spec.Image != "" {
+		return nil, ImageNotSupported
+	}
+
+	if len(spec.BindMounts) > 0 {
+		return nil, BindMountsNotSupported
+	}
+
+	if spec.Network.Mode != NetworkDefault {
+		return nil, NetworkPolicyNotSupported
+	}
+
+	container := &ProcessContainer{
+		Handle:  spec.ContainerHandle(),
+		Unshare: unshare,
+		Limits:  spec.Limits,
+	}
+
+	container.Path = filepath.Join(root, container.Handle)
+
+	err := os.MkdirAll(container.Path, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return container, nil
+}
+
+// RestoreProcessContainer reconnects to a container's directory, failing if
+// it is gone.
+func RestoreProcessContainer(root string, unshare bool, handle string) (*ProcessContainer, error) {
+	path := filepath.Join(root, handle)
+
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProcessContainer{Handle: handle, Path: path, Unshare: unshare}, nil
+}
+
+// ListProcessContainers returns the container directories narc created
+// under root.
+func ListProcessContainers(root string, unshare bool) ([]*ProcessContainer, error) {
+	entries, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	containers := []*ProcessContainer{}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), ContainerHandlePrefix) {
+			continue
+		}
+
+		containers = append(containers, &ProcessContainer{
+			Handle:  entry.Name(),
+			Path:    filepath.Join(root, entry.Name()),
+			Unshare: unshare,
+		})
+	}
+
+	return containers, nil
+}
+
+func (c *ProcessContainer) ID() string {
+	return c.Handle
+}
+
+func (c *ProcessContainer) Destroy() error {
+	return os.RemoveAll(c.Path)
+}
+
+// Run runs a script in the container's directory with /bin/sh and waits for
+// it to exit.
+func (c *ProcessContainer) Run(script string) (*JobInfo, error) {
+	return runJob(c.Command("/bin/sh", "-c", script))
+}
+
+// StreamOut archives paths relative to the container's directory, which
+// stands in for its root.
+func (c *ProcessContainer) StreamOut(paths []string) (io.ReadCloser, error) {
+	job, err := streamJob(c.Command("tar", tarArgs(c.Path, paths)...))
+	if err != nil {
+		return nil, err
+	}
+
+	return newArchiveStream(job), nil
+}
+
+// Info only reports the container directory's size, and the recorded
+// memory limit; processes are not tracked.
+func (c *ProcessContainer) Info() (*ContainerInfo, error) {
+	info := &ContainerInfo{
+		MemoryLimitInBytes: c.Limits.MemoryLimitInBytes,
+		DiskLimitInBytes:   c.Limits.DiskLimitInBytes,
+	}
+
+	err := filepath.Walk(c.Path, func(path string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if file.Mode().IsRegular() {
+			info.DiskUsageInBytes += uint64(file.Size())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (c *ProcessContainer) LimitMemory(limitInBytes uint64) error {
+	c.Limits.MemoryLimitInBytes = limitInBytes
+	return nil
+}
+
+func (c *ProcessContainer) LimitDisk(limitInBytes uint64) error {
+	c.Limits.DiskLimitInBytes = limitInBytes
+	return nil
+}
+
+func (c *ProcessContainer) RestoreLimits(limits TaskLimits) {
+	c.Limits = limits
+}
+
+// Command returns a command that runs in the container's directory, with
+// HOME set to it.
+func (c *ProcessContainer) Command(name string, args ...string) *exec.Cmd {
+	if c.Unshare {
+		unshareArgs := append([]string{}, UnshareArgs[1:]...)
+
+		args = append(append(unshareArgs, name), args...)
+		name = UnshareArgs[0]
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Dir = c.Path
+	cmd.Env = append(os.Environ(), "HOME="+c.Path)
+
+	return cmd
+}
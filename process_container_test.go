@@ -0,0 +1,195 @@
+package narc
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type PCSuite struct {
+	Root string
+}
+
+func init() {
+	Suite(&PCSuite{})
+}
+
+func (s *PCSuite) SetUpTest(c *C) {
+	s.Root = filepath.Join(c.MkDir(), "containers")
+}
+
+func (s *PCSuite) TestProvideContainerRefusesWhatItCannotIsolate(c *C) {
+	backend := ProcessTaskBackend{Root: s.Root}
+
+	_, err := backend.ProvideContainer(ContainerSpec{Task: "some-guid", Image: "ubuntu"})
+	c.Assert(err, Equals, ImageNotSupported)
+
+	_, err = backend.ProvideContainer(ContainerSpec{
+		Task:       "some-guid",
+		BindMounts: []BindMount{{SrcPath: "/var/droplets/app.tgz", DstPath: DropletMountPath}},
+	})
+	c.Assert(err, Equals, BindMountsNotSupported)
+
+	_, err = backend.ProvideContainer(ContainerSpec{Task: "some-guid", Network: NetworkPolicy{Mode: NetworkNone}})
+	c.Assert(err, Equals, NetworkPolicyNotSupported)
+
+	_, err = os.Stat(filepath.Join(s.Root, "narc-some-guid"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *PCSuite) TestProvideContainerCreatesADirectory(c *C) {
+	backend := ProcessTaskBackend{Root: s.Root}
+
+	container, err := backend.ProvideContainer(ContainerSpec{Task: "some-guid"})
+	c.Assert(err, IsNil)
+	c.Assert(container.ID(), Equals, "narc-some-guid")
+
+	info, err := os.Stat(filepath.Join(s.Root, "narc-some-guid"))
+	c.Assert(err, IsNil)
+	c.Assert(info.IsDir(), Equals, true)
+
+	err = container.Destroy()
+	c.Assert(err, IsNil)
+
+	_, err = os.Stat(filepath.Join(s.Root, "narc-some-guid"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *PCSuite) TestRunReturnsTheExitStatus(c *C) {
+	container, err := NewProcessContainer(s.Root, false, ContainerSpec{Task: "some-guid"})
+	c.Assert(err, IsNil)
+
+	info, err := container.Run("touch created-here; exit 3")
+	c.Assert(err, IsNil)
+	c.Assert(info.ExitStatus, Equals, uint32(3))
+
+	_, err = os.Stat(filepath.Join(container.Path, "created-here"))
+	c.Assert(err, IsNil)
+}
+
+func (s *PCSuite) TestRunCollectsTheOutput(c *C) {
+	container, err := NewProcessContainer(s.Root, false, ContainerSpec{Task: "some-guid"})
+	c.Assert(err, IsNil)
+
+	info, err := container.Run("echo out; echo err >&2")
+	c.Assert(err, IsNil)
+	c.Assert(string(info.Stdout), Equals, "out\n")
+	c.Assert(string(info.Stderr), Equals, "err\n")
+}
+
+func (s *PCSuite) TestInfoReportsTheDirectorysSize(c *C) {
+	container, err := NewProcessContainer(s.Root, false, ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 10},
+	})
+	c.Assert(err, IsNil)
+
+	_, err = container.Run("mkdir sub && printf 12345 > sub/file && printf 678 > other")
+	c.Assert(err, IsNil)
+
+	info, err := container.Info()
+	c.Assert(err, IsNil)
+	c.Assert(info.DiskUsageInBytes, Equals, uint64(8))
+	c.Assert(info.MemoryLimitInBytes, Equals, uint64(10))
+}
+
+func (s *PCSuite) TestProvideCommandRunsInTheContainer(c *C) {
+	backend := ProcessTaskBackend{Root: s.Root}
+
+	container, err := backend.ProvideContainer(ContainerSpec{Task: "some-guid"})
+	c.Assert(err, IsNil)
+
+	cmd := backend.ProvideCommand(container)
+	c.Assert(cmd.Dir, Equals, filepath.Join(s.Root, "narc-some-guid"))
+	c.Assert(cmd.Env[len(cmd.Env)-1], Equals, "HOME="+cmd.Dir)
+}
+
+func (s *PCSuite) TestCommandsRunInNamespacesWhenUnsharing(c *C) {
+	container := &ProcessContainer{Handle: "narc-some-guid", Path: s.Root, Unshare: true}
+
+	cmd := container.Command("/bin/bash", "-l")
+	c.Assert(strings.Join(cmd.Args, " "), Equals, strings.Join(UnshareArgs, " ")+" /bin/bash -l")
+}
+
+func (s *PCSuite) TestListAndRestoreContainers(c *C) {
+	backend := ProcessTaskBackend{Root: s.Root}
+
+	_, err := backend.ProvideContainer(ContainerSpec{Task: "some-guid"})
+	c.Assert(err, IsNil)
+
+	err = os.MkdirAll(filepath.Join(s.Root, "something-else"), 0700)
+	c.Assert(err, IsNil)
+
+	containers, err := backend.ListContainers()
+	c.Assert(err, IsNil)
+	c.Assert(containers, HasLen, 1)
+	c.Assert(containers[0].ID(), Equals, "narc-some-guid")
+
+	restored, err := backend.RestoreContainer("narc-some-guid")
+	c.Assert(err, IsNil)
+	c.Assert(restored.ID(), Equals, "narc-some-guid")
+
+	_, err = backend.RestoreContainer("narc-some-other-guid")
+	c.Assert(err, NotNil)
+}
+
+func (s *PCSuite) TestStreamOutArchivesPathsInTheContainer(c *C) {
+	container, err := NewProcessContainer(s.Root, false, ContainerSpec{Task: "some-guid"})
+	c.Assert(err, IsNil)
+
+	_, err = container.Run("mkdir logs && echo hello > logs/app.log")
+	c.Assert(err, IsNil)
+
+	archive, err := container.StreamOut([]string{"/logs"})
+	c.Assert(err, IsNil)
+
+	defer archive.Close()
+
+	names := []string{}
+
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		c.Assert(err, IsNil)
+
+		names = append(names, header.Name)
+	}
+
+	c.Assert(names, DeepEquals, []string{"logs/", "logs/app.log"})
+}
+
+func (s *PCSuite) TestStreamOutNeverTakesPathsForOptions(c *C) {
+	container, err := NewProcessContainer(s.Root, false, ContainerSpec{Task: "some-guid"})
+	c.Assert(err, IsNil)
+
+	_, err = container.Run("echo hello > ./--totals")
+	c.Assert(err, IsNil)
+
+	archive, err := container.StreamOut([]string{"/--totals"})
+	c.Assert(err, IsNil)
+
+	defer archive.Close()
+
+	header, err := tar.NewReader(archive).Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, "--totals")
+}
+
+func (s *PCSuite) TestStreamOutFailsIfAPathIsMissing(c *C) {
+	container, err := NewProcessContainer(s.Root, false, ContainerSpec{Task: "some-guid"})
+	c.Assert(err, IsNil)
+
+	archive, err := container.StreamOut([]string{"/missing"})
+	c.Assert(err, IsNil)
+
+	_, err = ioutil.ReadAll(archive)
+	c.Assert(err, ErrorMatches, "(?s)tar exited with status 2: .*missing.*")
+}
@@ -0,0 +1,47 @@
+package narc
+
+import (
+	"os/exec"
+	"path/filepath"
+)
+
+// ProcessTaskBackend runs tasks as local processes, each in its own
+// directory under Root. It isolates nothing unless Unshare is set, and even
+// then does not enforce limits, and refuses images, bind mounts and network
+// policies, so it is meant for development and tests.
+type ProcessTaskBackend struct {
+	Root    string
+	Unshare bool
+}
+
+func (p ProcessTaskBackend) ProvideContainer(spec ContainerSpec) (Container, error) {
+	return NewProcessContainer(p.Root, p.Unshare, spec)
+}
+
+func (p ProcessTaskBackend) RestoreContainer(handle string) (Container, error) {
+	return RestoreProcessContainer(p.Root, p.Unshare, handle)
+}
+
+func (p ProcessTaskBackend) ListContainers() ([]Container, error) {
+	processContainers, err := ListProcessContainers(p.Root, p.Unshare)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := make([]Container, len(processContainers))
+	for i, container := range processContainers {
+		containers[i] = container
+	}
+
+	return containers, nil
+}
+
+func (p ProcessTaskBackend) ProvideCommand(container Container) *exec.Cmd {
+	processContainer := &ProcessContainer{
+		Handle:  container.ID(),
+		Path:    filepath.Join(p.Root, container.ID()),
+		Unshare: p.Unshare,
+	}
+
+	return processContainer.Command("/bin/bash", "-l")
+}
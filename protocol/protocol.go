@@ -0,0 +1,530 @@
+// Package protocol defines the messages narc exchanges over the message bus.
+//
+// Every message carries a version. Payloads without one are treated as
+// version 1, which is the format narc has always accepted.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const Version = 1
+
+const (
+	StartSubject     = "task.start"
+	StopSubject      = "task.stop"
+	UpdateSubject    = "task.update"
+	ErrorSubject     = "task.error"
+	AdvertiseSubject = "task.advertise"
+	DiscoverSubject  = "task.discover"
+	StatusSubject    = "task.status"
+	ListSubject      = "task.list"
+	SnapshotSubject  = "task.snapshot"
+)
+
+// StartSubjectFor returns the start subject only the given agent subscribes
+// to.
+func StartSubjectFor(agentID string) string {
+	return StartSubject + "." + agentID
+}
+
+// StopSubjectFor returns the stop subject only the given agent subscribes to.
+func StopSubjectFor(agentID string) string {
+	return StopSubject + "." + agentID
+}
+
+// UpdateSubjectFor returns the update subject only the given agent
+// subscribes to.
+func UpdateSubjectFor(agentID string) string {
+	return UpdateSubject + "." + agentID
+}
+
+// StatusSubjectFor returns the status subject only the given agent
+// subscribes to.
+func StatusSubjectFor(agentID string) string {
+	return StatusSubject + "." + agentID
+}
+
+// SnapshotSubjectFor returns the snapshot subject only the given agent
+// subscribes to.
+func SnapshotSubjectFor(agentID string) string {
+	return SnapshotSubject + "." + agentID
+}
+
+type StartMessage struct {
+	Version                int         `json:"version,omitempty"`
+	Agent                  string      `json:"agent,omitempty"`
+	Task                   string      `json:"task"`
+	SecureToken            string      `json:"secure_token"`
+	MemoryLimitInMegabytes uint64      `json:"memory_limit"`
+	DiskLimitInMegabytes   uint64      `json:"disk_limit"`
+	CPUShares              uint64      `json:"cpu_shares,omitempty"`
+	CPUQuota               uint64      `json:"cpu_quota,omitempty"`
+	PIDLimit               uint64      `json:"pid_limit,omitempty"`
+	FDLimit                uint64      `json:"fd_limit,omitempty"`
+	InboundBandwidth       uint64      `json:"inbound_bandwidth,omitempty"`
+	OutboundBandwidth      uint64      `json:"outbound_bandwidth,omitempty"`
+	Network                *Network    `json:"network,omitempty"`
+	Image                  string      `json:"image,omitempty"`
+	BindMounts             []BindMount `json:"bind_mounts,omitempty"`
+	Droplet                string      `json:"droplet,omitempty"`
+	Setup                  []string    `json:"setup,omitempty"`
+	PreStop                string      `json:"pre_stop,omitempty"`
+	GracePeriod            uint64      `json:"grace_period,omitempty"`
+}
+
+// BindMount asks for a path on the agent's host to be mounted into the
+// task's container. Mode is "ro" (the default) or "rw".
+type BindMount struct {
+	SrcPath string `json:"src_path"`
+	DstPath string `json:"dst_path"`
+	Mode    string `json:"mode,omitempty"`
+}
+
+func (m BindMount) ReadOnly() bool {
+	return m.Mode != "rw"
+}
+
+// Network is the network policy of a task's container. Mode is "none",
+// "egress" or "allow"; Allow lists where an "allow" container may connect
+// to.
+type Network struct {
+	Mode  string        `json:"mode"`
+	Allow []NetworkRule `json:"allow,omitempty"`
+}
+
+// NetworkRule allows connections to a network in CIDR notation, on a port
+// or range of ports such as "8000-9000", or on any port if Ports is empty.
+type NetworkRule struct {
+	Network string `json:"network"`
+	Ports   string `json:"ports,omitempty"`
+}
+
+// UpdateMessage changes the limits of a running task. Limits that are left
+// out are not changed.
+type UpdateMessage struct {
+	Version                int    `json:"version,omitempty"`
+	Agent                  string `json:"agent,omitempty"`
+	Task                   string `json:"task"`
+	MemoryLimitInMegabytes uint64 `json:"memory_limit,omitempty"`
+	DiskLimitInMegabytes   uint64 `json:"disk_limit,omitempty"`
+}
+
+type StopMessage struct {
+	Version int    `json:"version,omitempty"`
+	Agent   string `json:"agent,omitempty"`
+	Task    string `json:"task"`
+}
+
+// StatusRequest asks for the status of a task. ReplyTo is the subject
+// broadcast requests are answered on, by the agent that knows the task.
+type StatusRequest struct {
+	Version int    `json:"version,omitempty"`
+	Task    string `json:"task"`
+	ReplyTo string `json:"reply_to,omitempty"`
+}
+
+// StatusResponse is sent in reply to a StatusRequest. Error is set, and
+// Status is nil, if the task is unknown or the request was invalid.
+type StatusResponse struct {
+	Version int         `json:"version"`
+	Status  *TaskStatus `json:"status,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// SnapshotRequest asks for an archive of paths inside a task's container.
+// ReplyTo is the subject broadcast requests are answered on, by the agent
+// running the task.
+type SnapshotRequest struct {
+	Version int      `json:"version,omitempty"`
+	Task    string   `json:"task"`
+	Paths   []string `json:"paths"`
+	ReplyTo string   `json:"reply_to,omitempty"`
+}
+
+// SnapshotResponse is sent in reply to a SnapshotRequest. Error is set, and
+// Snapshot is nil, if the task is unknown or the archive could not be
+// stored.
+type SnapshotResponse struct {
+	Version  int       `json:"version"`
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Snapshot describes a stored archive. Size is in bytes, and SHA256 is the
+// hex encoded checksum of the archive.
+type Snapshot struct {
+	Task     string `json:"task"`
+	Location string `json:"location"`
+	Size     uint64 `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+type ListRequest struct {
+	Version int `json:"version,omitempty"`
+}
+
+// ListResponse is sent in reply to a ListRequest, listing every task the
+// agent is running.
+type ListResponse struct {
+	Version int          `json:"version"`
+	Agent   string       `json:"agent"`
+	Tasks   []TaskStatus `json:"tasks"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// TaskStatus describes a task running on, or recently finished by, an agent.
+// Memory and disk are in megabytes.
+type TaskStatus struct {
+	Task             string     `json:"task"`
+	State            string     `json:"state"`
+	StartedAt        time.Time  `json:"started_at"`
+	ContainerHandle  string     `json:"container_handle"`
+	MemoryLimit      uint64     `json:"memory_limit"`
+	DiskLimit        uint64     `json:"disk_limit"`
+	AttachedSessions int        `json:"attached_sessions"`
+	ExitStatus       *int       `json:"exit_status,omitempty"`
+	ExitReason       string     `json:"exit_reason,omitempty"`
+	Usage            *TaskUsage `json:"usage,omitempty"`
+}
+
+// TaskUsage is what a running task's container is currently using. Memory
+// and disk are in megabytes, CPU time in seconds and network traffic in
+// bytes.
+type TaskUsage struct {
+	Memory    uint64  `json:"memory"`
+	Disk      uint64  `json:"disk"`
+	CPUTime   float64 `json:"cpu_time"`
+	Processes int     `json:"processes"`
+	NetworkRx uint64  `json:"network_rx"`
+	NetworkTx uint64  `json:"network_tx"`
+}
+
+// AdvertiseMessage is published periodically on AdvertiseSubject and sent
+// in reply to requests on DiscoverSubject. Memory and disk are in megabytes.
+type AdvertiseMessage struct {
+	Version            int         `json:"version"`
+	ID                 string      `json:"id"`
+	Host               string      `json:"host"`
+	Port               int         `json:"port"`
+	HostKeyFingerprint string      `json:"host_key_fingerprint"`
+	TotalMemory        uint64      `json:"total_memory"`
+	TotalDisk          uint64      `json:"total_disk"`
+	AvailableMemory    uint64      `json:"available_memory"`
+	AvailableDisk      uint64      `json:"available_disk"`
+	RunningTasks       int         `json:"running_tasks"`
+	Draining           bool        `json:"draining"`
+	Pools              []PoolStats `json:"pools,omitempty"`
+}
+
+// PoolStats describes the pre-created containers an agent keeps ready for
+// one class of limits, in megabytes.
+type PoolStats struct {
+	MemoryLimit uint64 `json:"memory_limit"`
+	DiskLimit   uint64 `json:"disk_limit"`
+	Ready       int    `json:"ready"`
+	Size        int    `json:"size"`
+}
+
+// ErrorMessage is published on ErrorSubject when a message could not be
+// handled.
+type ErrorMessage struct {
+	Version int    `json:"version"`
+	Subject string `json:"subject"`
+	Task    string `json:"task,omitempty"`
+	Error   string `json:"error"`
+}
+
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+func ParseStartMessage(payload []byte) (StartMessage, error) {
+	var start StartMessage
+
+	err := decode(payload, &start)
+	if err != nil {
+		return start, err
+	}
+
+	return start, start.Validate()
+}
+
+func ParseStopMessage(payload []byte) (StopMessage, error) {
+	var stop StopMessage
+
+	err := decode(payload, &stop)
+	if err != nil {
+		return stop, err
+	}
+
+	return stop, stop.Validate()
+}
+
+func ParseUpdateMessage(payload []byte) (UpdateMessage, error) {
+	var update UpdateMessage
+
+	err := decode(payload, &update)
+	if err != nil {
+		return update, err
+	}
+
+	return update, update.Validate()
+}
+
+func ParseStatusRequest(payload []byte) (StatusRequest, error) {
+	var request StatusRequest
+
+	err := decode(payload, &request)
+	if err != nil {
+		return request, err
+	}
+
+	return request, request.Validate()
+}
+
+func ParseSnapshotRequest(payload []byte) (SnapshotRequest, error) {
+	var request SnapshotRequest
+
+	err := decode(payload, &request)
+	if err != nil {
+		return request, err
+	}
+
+	return request, request.Validate()
+}
+
+// ParseListRequest accepts an empty payload as well as an empty object.
+func ParseListRequest(payload []byte) (ListRequest, error) {
+	var request ListRequest
+
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return request, nil
+	}
+
+	err := decode(payload, &request)
+	if err != nil {
+		return request, err
+	}
+
+	return request, validateVersion(request.Version)
+}
+
+func (m StartMessage) Validate() error {
+	err := validateVersion(m.Version)
+	if err != nil {
+		return err
+	}
+
+	if m.Task == "" {
+		return ValidationError{"task", "must be present"}
+	}
+
+	if m.SecureToken == "" {
+		return ValidationError{"secure_token", "must be present"}
+	}
+
+	if m.MemoryLimitInMegabytes == 0 {
+		return ValidationError{"memory_limit", "must be greater than zero"}
+	}
+
+	if m.DiskLimitInMegabytes == 0 {
+		return ValidationError{"disk_limit", "must be greater than zero"}
+	}
+
+	for _, mount := range m.BindMounts {
+		if !strings.HasPrefix(mount.SrcPath, "/") || !strings.HasPrefix(mount.DstPath, "/") {
+			return ValidationError{"bind_mounts", "paths must be absolute"}
+		}
+
+		if mount.Mode != "" && mount.Mode != "ro" && mount.Mode != "rw" {
+			return ValidationError{"bind_mounts", fmt.Sprintf("unknown mode %q", mount.Mode)}
+		}
+	}
+
+	if m.Network != nil {
+		err := m.Network.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.Droplet != "" && !strings.HasPrefix(m.Droplet, "/") {
+		return ValidationError{"droplet", "path must be absolute"}
+	}
+
+	for _, script := range m.Setup {
+		if strings.TrimSpace(script) == "" {
+			return ValidationError{"setup", "scripts must not be empty"}
+		}
+	}
+
+	return nil
+}
+
+func (m StopMessage) Validate() error {
+	err := validateVersion(m.Version)
+	if err != nil {
+		return err
+	}
+
+	if m.Task == "" {
+		return ValidationError{"task", "must be present"}
+	}
+
+	return nil
+}
+
+func (m UpdateMessage) Validate() error {
+	err := validateVersion(m.Version)
+	if err != nil {
+		return err
+	}
+
+	if m.Task == "" {
+		return ValidationError{"task", "must be present"}
+	}
+
+	if m.MemoryLimitInMegabytes == 0 && m.DiskLimitInMegabytes == 0 {
+		return ValidationError{"", "memory_limit or disk_limit must be present"}
+	}
+
+	return nil
+}
+
+func (m SnapshotRequest) Validate() error {
+	err := validateVersion(m.Version)
+	if err != nil {
+		return err
+	}
+
+	if m.Task == "" {
+		return ValidationError{"task", "must be present"}
+	}
+
+	if len(m.Paths) == 0 {
+		return ValidationError{"paths", "must be present"}
+	}
+
+	for _, path := range m.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return ValidationError{"paths", "paths must be absolute"}
+		}
+
+		for _, segment := range strings.Split(path, "/") {
+			if segment == ".." {
+				return ValidationError{"paths", "paths must not contain .."}
+			}
+
+			if strings.HasPrefix(segment, "-") {
+				return ValidationError{"paths", "path segments must not start with -"}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m StatusRequest) Validate() error {
+	err := validateVersion(m.Version)
+	if err != nil {
+		return err
+	}
+
+	if m.Task == "" {
+		return ValidationError{"task", "must be present"}
+	}
+
+	return nil
+}
+
+func NewErrorMessage(subject, task string, err error) ErrorMessage {
+	return ErrorMessage{
+		Version: Version,
+		Subject: subject,
+		Task:    task,
+		Error:   err.Error(),
+	}
+}
+
+func validateVersion(version int) error {
+	if version < 0 || version > Version {
+		return ValidationError{
+			"version",
+			fmt.Sprintf("unsupported version %d (max %d)", version, Version),
+		}
+	}
+
+	return nil
+}
+
+func decode(payload []byte, message interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(message)
+	if err != nil {
+		return ValidationError{"", fmt.Sprintf("malformed payload: %s", err)}
+	}
+
+	return nil
+}
+
+func (n Network) validate() error {
+	switch n.Mode {
+	case "none", "egress":
+		if len(n.Allow) > 0 {
+			return ValidationError{"network", "only an allow policy can have allowed networks"}
+		}
+
+	case "allow":
+		for _, rule := range n.Allow {
+			_, _, err := net.ParseCIDR(rule.Network)
+			if err != nil {
+				return ValidationError{"network", fmt.Sprintf("invalid network %q", rule.Network)}
+			}
+
+			if rule.Ports != "" && !validPorts(rule.Ports) {
+				return ValidationError{"network", fmt.Sprintf("invalid ports %q", rule.Ports)}
+			}
+		}
+
+	default:
+		return ValidationError{"network", fmt.Sprintf("unknown mode %q", n.Mode)}
+	}
+
+	return nil
+}
+
+// validPorts accepts a port, or a range of ports such as "8000-9000".
+func validPorts(ports string) bool {
+	bounds := strings.SplitN(ports, "-", 2)
+
+	previous := uint64(0)
+
+	for _, bound := range bounds {
+		port, err := strconv.ParseUint(bound, 10, 16)
+		if err != nil || port == 0 || port < previous {
+			return false
+		}
+
+		previous = port
+	}
+
+	return true
+}
@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	. "launchpad.net/gocheck"
+	"testing"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type PSuite struct{}
+
+func init() {
+	Suite(&PSuite{})
+}
+
+func (s *PSuite) TestParseStartMessageWithoutVersion(c *C) {
+	start, err := ParseStartMessage([]byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+	c.Assert(err, IsNil)
+
+	c.Assert(start, DeepEquals, StartMessage{
+		Task:                   "some-guid",
+		SecureToken:            "some-token",
+		MemoryLimitInMegabytes: 32,
+		DiskLimitInMegabytes:   1,
+	})
+}
+
+func (s *PSuite) TestParseStartMessageWithVersion(c *C) {
+	start, err := ParseStartMessage([]byte(`
+	    {"version":1,"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+	c.Assert(err, IsNil)
+	c.Assert(start.Version, Equals, 1)
+}
+
+func (s *PSuite) TestParseStartMessageRejectsNewerVersions(c *C) {
+	_, err := ParseStartMessage([]byte(`
+	    {"version":2,"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+	c.Assert(err, FitsTypeOf, ValidationError{})
+	c.Assert(err.(ValidationError).Field, Equals, "version")
+}
+
+func (s *PSuite) TestParseStartMessageRejectsUnknownFields(c *C) {
+	_, err := ParseStartMessage([]byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1,"bogus":true}
+	`))
+	c.Assert(err, ErrorMatches, `malformed payload: .*bogus.*`)
+}
+
+func (s *PSuite) TestParseStartMessageRejectsMalformedPayloads(c *C) {
+	_, err := ParseStartMessage([]byte(`{"task":`))
+	c.Assert(err, ErrorMatches, `malformed payload: .*`)
+}
+
+func (s *PSuite) TestParseStartMessageRequiresLimits(c *C) {
+	_, err := ParseStartMessage([]byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32}
+	`))
+	c.Assert(err, DeepEquals, ValidationError{"disk_limit", "must be greater than zero"})
+
+	_, err = ParseStartMessage([]byte(`
+	    {"task":"some-guid","secure_token":"some-token","disk_limit":32}
+	`))
+	c.Assert(err, DeepEquals, ValidationError{"memory_limit", "must be greater than zero"})
+}
+
+func (s *PSuite) TestParseStartMessageRequiresTaskAndToken(c *C) {
+	_, err := ParseStartMessage([]byte(`
+	    {"secure_token":"some-token","memory_limit":32,"disk_limit":1}
+	`))
+	c.Assert(err, DeepEquals, ValidationError{"task", "must be present"})
+
+	_, err = ParseStartMessage([]byte(`
+	    {"task":"some-guid","memory_limit":32,"disk_limit":1}
+	`))
+	c.Assert(err, DeepEquals, ValidationError{"secure_token", "must be present"})
+}
+
+func (s *PSuite) TestParseStopMessage(c *C) {
+	stop, err := ParseStopMessage([]byte(`{"task":"some-guid"}`))
+	c.Assert(err, IsNil)
+	c.Assert(stop, DeepEquals, StopMessage{Task: "some-guid"})
+
+	_, err = ParseStopMessage([]byte(`{}`))
+	c.Assert(err, DeepEquals, ValidationError{"task", "must be present"})
+}
+
+func (s *PSuite) TestParseStartMessageWithImage(c *C) {
+	start, err := ParseStartMessage([]byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1,"image":"some-image"}
+	`))
+	c.Assert(err, IsNil)
+	c.Assert(start.Image, Equals, "some-image")
+}
+
+func (s *PSuite) TestParseStartMessageValidatesBindMounts(c *C) {
+	start, err := ParseStartMessage([]byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1,
+	     "bind_mounts":[{"src_path":"/a","dst_path":"/b"},{"src_path":"/c","dst_path":"/d","mode":"rw"}]}
+	`))
+	c.Assert(err, IsNil)
+	c.Assert(start.BindMounts[0].ReadOnly(), Equals, true)
+	c.Assert(start.BindMounts[1].ReadOnly(), Equals, false)
+
+	_, err = ParseStartMessage([]byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1,
+	     "bind_mounts":[{"src_path":"a","dst_path":"/b"}]}
+	`))
+	c.Assert(err, DeepEquals, ValidationError{"bind_mounts", "paths must be absolute"})
+
+	_, err = ParseStartMessage([]byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1,
+	     "bind_mounts":[{"src_path":"/a","dst_path":"/b","mode":"wx"}]}
+	`))
+	c.Assert(err, DeepEquals, ValidationError{"bind_mounts", `unknown mode "wx"`})
+}
+
+func (s *PSuite) TestParseStartMessageRejectsEmptySetupScripts(c *C) {
+	_, err := ParseStartMessage([]byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1,"setup":[" "]}
+	`))
+	c.Assert(err, DeepEquals, ValidationError{"setup", "scripts must not be empty"})
+}
+
+func (s *PSuite) TestParseStartMessageValidatesTheNetworkPolicy(c *C) {
+	start, err := ParseStartMessage([]byte(`
+	    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1,
+	     "network":{"mode":"allow","allow":[{"network":"10.0.0.0/8","ports":"8000-9000"},{"network":"1.2.3.4/32"}]}}
+	`))
+	c.Assert(err, IsNil)
+	c.Assert(start.Network.Allow, HasLen, 2)
+
+	for payload, expected := range map[string]error{
+		`{"mode":"open"}`: ValidationError{"network", `unknown mode "open"`},
+		`{"mode":"none","allow":[{"network":"10.0.0.0/8"}]}`:                 ValidationError{"network", "only an allow policy can have allowed networks"},
+		`{"mode":"allow","allow":[{"network":"10.0.0.0"}]}`:                  ValidationError{"network", `invalid network "10.0.0.0"`},
+		`{"mode":"allow","allow":[{"network":"0.0.0.0/0","ports":"9-8"}]}`:   ValidationError{"network", `invalid ports "9-8"`},
+		`{"mode":"allow","allow":[{"network":"0.0.0.0/0","ports":"70000"}]}`: ValidationError{"network", `invalid ports "70000"`},
+	} {
+		_, err := ParseStartMessage([]byte(`
+		    {"task":"some-guid","secure_token":"some-token","memory_limit":32,"disk_limit":1,"network":` + payload + `}
+		`))
+		c.Assert(err, DeepEquals, expected)
+	}
+}
+
+func (s *PSuite) TestParseUpdateMessage(c *C) {
+	update, err := ParseUpdateMessage([]byte(`{"task":"some-guid","memory_limit":64}`))
+	c.Assert(err, IsNil)
+	c.Assert(update, DeepEquals, UpdateMessage{Task: "some-guid", MemoryLimitInMegabytes: 64})
+
+	_, err = ParseUpdateMessage([]byte(`{"task":"some-guid"}`))
+	c.Assert(err, DeepEquals, ValidationError{"", "memory_limit or disk_limit must be present"})
+}
+
+func (s *PSuite) TestParseSnapshotRequest(c *C) {
+	request, err := ParseSnapshotRequest([]byte(`{"task":"some-guid","paths":["/app/logs","/tmp"]}`))
+	c.Assert(err, IsNil)
+	c.Assert(request, DeepEquals, SnapshotRequest{Task: "some-guid", Paths: []string{"/app/logs", "/tmp"}})
+
+	_, err = ParseSnapshotRequest([]byte(`{"task":"some-guid"}`))
+	c.Assert(err, DeepEquals, ValidationError{"paths", "must be present"})
+
+	_, err = ParseSnapshotRequest([]byte(`{"task":"some-guid","paths":["app"]}`))
+	c.Assert(err, DeepEquals, ValidationError{"paths", "paths must be absolute"})
+
+	_, err = ParseSnapshotRequest([]byte(`{"task":"some-guid","paths":["/app/../etc"]}`))
+	c.Assert(err, DeepEquals, ValidationError{"paths", "paths must not contain .."})
+
+	_, err = ParseSnapshotRequest([]byte(`{"task":"some-guid","paths":["/--checkpoint-action=exec=sh"]}`))
+	c.Assert(err, DeepEquals, ValidationError{"paths", "path segments must not start with -"})
+
+	_, err = ParseSnapshotRequest([]byte(`{"task":"some-guid","paths":["/app/-rf"]}`))
+	c.Assert(err, DeepEquals, ValidationError{"paths", "path segments must not start with -"})
+}
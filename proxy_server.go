@@ -2,20 +2,32 @@ package narc
 
 import (
 	"code.google.com/p/go.crypto/ssh"
+	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"strings"
 )
 
 type ProxyServer struct {
-	registry *Registry
+	consoles Consoles
 	hostKey  []byte
 
-	listener *ssh.Listener
+	config   *ssh.ServerConfig
+	listener net.Listener
+}
+
+// Consoles is what a proxy server attaches SSH sessions to: the tasks in
+// the agent's registry, or those of the agent behind a console relay.
+type Consoles interface {
+	Authorize(task, password string) bool
+	Attach(task string, channel ssh.Channel) error
 }
 
 func NewProxyServer(registry *Registry) (*ProxyServer, error) {
@@ -24,13 +36,31 @@ func NewProxyServer(registry *Registry) (*ProxyServer, error) {
 		return nil, err
 	}
 
+	return NewProxyServerWithHostKey(&RegistryConsoles{registry}, key), nil
+}
+
+// NewProxyServerWithHostKey returns a proxy server using an existing
+// PEM-encoded RSA host key, e.g. the one its console relay was given.
+func NewProxyServerWithHostKey(consoles Consoles, hostKey []byte) *ProxyServer {
 	return &ProxyServer{
-		registry: registry,
-		hostKey:  key,
-	}, nil
+		consoles: consoles,
+		hostKey:  hostKey,
+	}
 }
 
 func (p *ProxyServer) Start(port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	log.Println("listening on port", port)
+
+	return p.Serve(l)
+}
+
+// Serve accepts SSH connections on an existing listener.
+func (p *ProxyServer) Serve(listener net.Listener) error {
 	config := &ssh.ServerConfig{
 		PasswordCallback: p.verifyTaskAccess,
 	}
@@ -40,14 +70,8 @@ func (p *ProxyServer) Start(port int) error {
 		return err
 	}
 
-	l, err := ssh.Listen("tcp", fmt.Sprintf(":%d", port), config)
-	if err != nil {
-		return err
-	}
-
-	p.listener = l
-
-	log.Println("listening on port", port)
+	p.config = config
+	p.listener = listener
 
 	go p.serveConnections()
 
@@ -62,21 +86,42 @@ func (p *ProxyServer) Stop() error {
 	return nil
 }
 
-func (p *ProxyServer) verifyTaskAccess(conn *ssh.ServerConn, user, password string) bool {
-	log.Println("verifying:", user, password)
+// HostKeyFingerprint returns the MD5 fingerprint of the server's public host
+// key, in the colon-separated form printed by ssh clients.
+func (p *ProxyServer) HostKeyFingerprint() (string, error) {
+	return hostKeyFingerprint(p.hostKey)
+}
 
-	task, found := p.registry.Lookup(user)
-	if !found {
-		log.Println("verify failed: task not found")
-		return false
+func hostKeyFingerprint(hostKey []byte) (string, error) {
+	blk, _ := pem.Decode(hostKey)
+	if blk == nil {
+		return "", errors.New("host key is not PEM-encoded")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(blk.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	sum := md5.Sum(ssh.MarshalPublicKey(&key.PublicKey))
+
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02x", b)
 	}
 
-	return task.SecureToken == password
+	return strings.Join(hex, ":"), nil
+}
+
+func (p *ProxyServer) verifyTaskAccess(conn *ssh.ServerConn, user, password string) bool {
+	log.Println("verifying:", user, password)
+
+	return p.consoles.Authorize(user, password)
 }
 
 func (p *ProxyServer) serveConnections() {
 	for {
-		conn, err := p.listener.Accept()
+		tcpConn, err := p.listener.Accept()
 		if err != nil {
 			log.Println("error accepting connection:", err)
 			break
@@ -84,9 +129,12 @@ func (p *ProxyServer) serveConnections() {
 
 		log.Println("accepted connection")
 
+		conn := ssh.Server(tcpConn, p.config)
+
 		err = conn.Handshake()
 		if err != nil {
 			log.Println("handshake failed:", err)
+			tcpConn.Close()
 			continue
 		}
 
@@ -124,19 +172,36 @@ func (p *ProxyServer) handleChannel(channel ssh.Channel, taskID string) {
 		return
 	}
 
-	task, found := p.registry.Lookup(taskID)
-	if !found {
-		log.Println("unknown task:", task)
+	err = p.consoles.Attach(taskID, channel)
+	if err != nil {
+		log.Println("failed to execute task:", err)
 		return
 	}
+}
 
-	task.OnComplete(func() { channel.Close() })
+// RegistryConsoles attaches SSH sessions to the tasks in a registry, in the
+// agent's own process.
+type RegistryConsoles struct {
+	Registry *Registry
+}
 
-	err = task.Attach(channel)
-	if err != nil {
-		log.Println("failed to execute task:", err)
-		return
+func (c *RegistryConsoles) Authorize(taskID, password string) bool {
+	task, found := c.Registry.Lookup(taskID)
+	if !found {
+		log.Println("verify failed: task not found")
+		return false
 	}
+
+	return task.Authorize(password)
+}
+
+func (c *RegistryConsoles) Attach(taskID string, channel ssh.Channel) error {
+	task, found := c.Registry.Lookup(taskID)
+	if !found {
+		return TaskNotRegistered
+	}
+
+	return task.Attach(channel)
 }
 
 func generateHostKey() ([]byte, error) {
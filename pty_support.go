@@ -28,3 +28,62 @@ func setWinSize(f *os.File, cols uint16, rows uint16) error {
 
 	return nil
 }
+
+func getWinSize(f *os.File) (ttySize, error) {
+	var size ttySize
+
+	_, _, e := syscall.Syscall6(
+		syscall.SYS_IOCTL,
+		uintptr(f.Fd()),
+		uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(&size)),
+		0, 0, 0,
+	)
+
+	if e != 0 {
+		return size, syscall.ENOTTY
+	}
+
+	return size, nil
+}
+
+// makeRaw turns off the line discipline of a terminal, like cfmakeraw(3).
+// Files that are not terminals are left alone.
+func makeRaw(f *os.File) error {
+	var termios syscall.Termios
+
+	_, _, e := syscall.Syscall6(
+		syscall.SYS_IOCTL,
+		uintptr(f.Fd()),
+		uintptr(syscall.TCGETS),
+		uintptr(unsafe.Pointer(&termios)),
+		0, 0, 0,
+	)
+
+	if e != 0 {
+		return syscall.ENOTTY
+	}
+
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag &^= syscall.CSIZE | syscall.PARENB
+	termios.Cflag |= syscall.CS8
+	termios.Cc[syscall.VMIN] = 1
+	termios.Cc[syscall.VTIME] = 0
+
+	_, _, e = syscall.Syscall6(
+		syscall.SYS_IOCTL,
+		uintptr(f.Fd()),
+		uintptr(syscall.TCSETS),
+		uintptr(unsafe.Pointer(&termios)),
+		0, 0, 0,
+	)
+
+	if e != 0 {
+		return e
+	}
+
+	return nil
+}
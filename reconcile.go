@@ -0,0 +1,172 @@
+package narc
+
+import (
+	"fmt"
+	"log"
+)
+
+// ReconcilePolicy decides what happens to containers narc created that are
+// not backing a registered task, e.g. because narc crashed.
+type ReconcilePolicy string
+
+const (
+	// ReconcileDestroy destroys orphaned containers.
+	ReconcileDestroy ReconcilePolicy = "destroy"
+
+	// ReconcileAdopt registers orphaned containers as tasks again, under the
+	// task they were created for, with the limits the container reports.
+	// Adopted tasks have no secure token, so they can be inspected and
+	// stopped but not attached to. Containers whose limits cannot be read
+	// are destroyed.
+	ReconcileAdopt ReconcilePolicy = "adopt"
+)
+
+func ParseReconcilePolicy(policy string) (ReconcilePolicy, error) {
+	switch ReconcilePolicy(policy) {
+	case ReconcileDestroy, ReconcileAdopt:
+		return ReconcilePolicy(policy), nil
+	}
+
+	return "", fmt.Errorf("unknown reconcile policy: %s", policy)
+}
+
+// ReconcileContainers finds containers left behind by a previous run and
+// destroys or adopts them according to the policy. Backends only list the
+// containers recorded with their owner, so agents sharing a backend leave
+// each other's containers alone. It does nothing if the task backend cannot
+// list its containers.
+func (agent *Agent) ReconcileContainers(policy ReconcilePolicy) error {
+	lister, ok := agent.taskBackend.(ContainerLister)
+	if !ok {
+		return nil
+	}
+
+	containers, err := lister.ListContainers()
+	if err != nil {
+		return err
+	}
+
+	inUse := map[string]bool{}
+	for _, task := range agent.Registry.Snapshot() {
+		inUse[task.container.ID()] = true
+	}
+
+	for _, container := range containers {
+		if inUse[container.ID()] {
+			continue
+		}
+
+		guid, _ := TaskForContainerHandle(container.ID())
+
+		_, found := agent.Registry.Lookup(guid)
+
+		switch policy {
+		case ReconcileAdopt:
+			if !found && guid != "" {
+				log.Printf("adopting container %s for task %s\n", container.ID(), guid)
+
+				err := agent.adoptContainer(guid, container)
+				if err == nil {
+					continue
+				}
+
+				log.Printf("failed to adopt container %s: %s\n", container.ID(), err)
+			}
+
+			fallthrough
+
+		default:
+			log.Printf("destroying orphaned container %s\n", container.ID())
+
+			err := container.Destroy()
+			if err != nil {
+				log.Printf("failed to destroy orphaned container %s: %s\n", container.ID(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// restoreContainer reconnects to a task's container, giving it back the
+// task's limits if it keeps them.
+func restoreContainer(restorer ContainerRestorer, record TaskRecord) (Container, error) {
+	container, err := restorer.RestoreContainer(record.ContainerHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	keeping, ok := container.(LimitsKeepingContainer)
+	if ok {
+		keeping.RestoreLimits(record.Limits)
+	}
+
+	return container, nil
+}
+
+// RestoreTasks registers the tasks persisted by the registry's store again,
+// reconnecting them to their containers. Tasks whose container is gone are
+// forgotten.
+func (agent *Agent) RestoreTasks() error {
+	records, err := agent.Registry.Records()
+	if err != nil {
+		return err
+	}
+
+	restorer, ok := agent.taskBackend.(ContainerRestorer)
+
+	for _, record := range records {
+		if !ok {
+			agent.Registry.Unregister(record.Task)
+			continue
+		}
+
+		container, err := restoreContainer(restorer, record)
+		if err != nil {
+			log.Printf("failed to restore task %s: %s\n", record.Task, err)
+			agent.Registry.Unregister(record.Task)
+			continue
+		}
+
+		task, err := NewTask(container, "", agent.taskBackend.ProvideCommand(container))
+		if err != nil {
+			log.Printf("failed to restore task %s: %s\n", record.Task, err)
+			agent.Registry.Unregister(record.Task)
+			continue
+		}
+
+		task.SecureTokenHash = record.SecureTokenHash
+		task.Limits = record.Limits
+		task.StopPolicy = record.StopPolicy
+		task.StartedAt = record.StartedAt
+
+		log.Printf("restored task %s in container %s\n", record.Task, container.ID())
+
+		agent.registerTask(record.Task, task)
+	}
+
+	return nil
+}
+
+// adoptContainer registers a task for the container, reserving the limits
+// the container reports so that it counts against the agent's capacity.
+func (agent *Agent) adoptContainer(guid string, container Container) error {
+	info, err := container.Info()
+	if err != nil {
+		return err
+	}
+
+	task, err := NewTask(container, "", agent.taskBackend.ProvideCommand(container))
+	if err != nil {
+		return err
+	}
+
+	task.Limits = TaskLimits{
+		MemoryLimitInBytes: info.MemoryLimitInBytes,
+		DiskLimitInBytes:   info.DiskLimitInBytes,
+	}
+
+	agent.registerTask(guid, task)
+
+	return nil
+}
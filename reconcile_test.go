@@ -0,0 +1,198 @@
+package narc
+
+import (
+	"errors"
+	"github.com/cloudfoundry/gibson/fake_router_client"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+)
+
+type RCSuite struct {
+	RouterClient *fake_gibson.FakeRouterClient
+}
+
+func init() {
+	Suite(&RCSuite{})
+}
+
+func (s *RCSuite) SetUpTest(c *C) {
+	s.RouterClient = fake_gibson.NewFakeRouterClient()
+}
+
+func (s *RCSuite) TestReconcileDestroysOrphanedContainers(c *C) {
+	orphan := &FakeContainer{Handle: "narc-some-guid"}
+
+	agent, err := NewAgent(FakeTaskBackend{Containers: []Container{orphan}}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	err = agent.ReconcileContainers(ReconcileDestroy)
+	c.Assert(err, IsNil)
+
+	c.Assert(orphan.IsDestroyed(), Equals, true)
+
+	_, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+}
+
+func (s *RCSuite) TestReconcileAdoptsOrphanedContainers(c *C) {
+	orphan := &FakeContainer{
+		Handle: "narc-some-guid",
+		Usage: ContainerInfo{
+			MemoryLimitInBytes: 32 * megabyte,
+			DiskLimitInBytes:   megabyte,
+		},
+	}
+
+	agent, err := NewAgent(FakeTaskBackend{Containers: []Container{orphan}}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	err = agent.ReconcileContainers(ReconcileAdopt)
+	c.Assert(err, IsNil)
+
+	c.Assert(orphan.IsDestroyed(), Equals, false)
+
+	task, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(task.container, Equals, orphan)
+	c.Assert(task.Authorize(""), Equals, false)
+	c.Assert(task.Limits, Equals, TaskLimits{MemoryLimitInBytes: 32 * megabyte, DiskLimitInBytes: megabyte})
+
+	reserved, _ := agent.reserved()
+	c.Assert(reserved, Equals, task.Limits)
+
+	c.Assert(s.RouterClient.IsRegistered(42, "some-guid"), Equals, true)
+}
+
+func (s *RCSuite) TestReconcileDestroysContainersItCannotAdopt(c *C) {
+	orphan := &FakeContainer{Handle: "narc-some-guid", ShouldError: true}
+
+	agent, err := NewAgent(FakeTaskBackend{Containers: []Container{orphan}}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	err = agent.ReconcileContainers(ReconcileAdopt)
+	c.Assert(err, IsNil)
+
+	c.Assert(orphan.IsDestroyed(), Equals, true)
+
+	_, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+}
+
+func (s *RCSuite) TestReconcileLeavesRegisteredTasksAlone(c *C) {
+	backend := FakeTaskBackend{}
+
+	agent, err := NewAgent(backend, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	task, err := agent.startTask("some-token", ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 1},
+	}, nil, StopPolicy{})
+	c.Assert(err, IsNil)
+
+	backend.Containers = []Container{task.container}
+	agent.taskBackend = backend
+
+	err = agent.ReconcileContainers(ReconcileDestroy)
+	c.Assert(err, IsNil)
+
+	c.Assert(task.container.(*FakeContainer).IsDestroyed(), Equals, false)
+}
+
+func (s *RCSuite) TestRestoreTasksReconnectsPersistedTasks(c *C) {
+	store := &FileRegistryStore{Path: filepath.Join(c.MkDir(), "tasks.json")}
+
+	err := store.Save(TaskRecord{
+		Task:            "some-guid",
+		SecureTokenHash: HashSecureToken("some-token"),
+		ContainerHandle: "narc-some-guid",
+		Limits:          TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 2},
+	})
+	c.Assert(err, IsNil)
+
+	agent, err := NewAgent(FakeTaskBackend{}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	agent.Registry = NewPersistentRegistry(store)
+
+	err = agent.RestoreTasks()
+	c.Assert(err, IsNil)
+
+	task, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+
+	c.Assert(task.container.ID(), Equals, "narc-some-guid")
+	c.Assert(task.Limits, Equals, TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 2})
+	c.Assert(task.Authorize("some-token"), Equals, true)
+	c.Assert(task.Authorize("bogus-token"), Equals, false)
+
+	c.Assert(s.RouterClient.IsRegistered(42, "some-guid"), Equals, true)
+}
+
+func (s *RCSuite) TestRestoreTasksGivesContainersBackTheirLimits(c *C) {
+	root := c.MkDir()
+
+	err := os.Mkdir(filepath.Join(root, "narc-some-guid"), 0700)
+	c.Assert(err, IsNil)
+
+	limits := TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 2, PIDLimit: 64, FDLimit: 1024}
+
+	store := &FileRegistryStore{Path: filepath.Join(c.MkDir(), "tasks.json")}
+
+	err = store.Save(TaskRecord{Task: "some-guid", ContainerHandle: "narc-some-guid", Limits: limits})
+	c.Assert(err, IsNil)
+
+	agent, err := NewAgent(ProcessTaskBackend{Root: root}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	agent.Registry = NewPersistentRegistry(store)
+
+	err = agent.RestoreTasks()
+	c.Assert(err, IsNil)
+
+	task, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+
+	c.Assert(task.container.(*ProcessContainer).Limits, Equals, limits)
+}
+
+func (s *RCSuite) TestRestoreTasksForgetsTasksWithoutContainers(c *C) {
+	store := &FileRegistryStore{Path: filepath.Join(c.MkDir(), "tasks.json")}
+
+	err := store.Save(TaskRecord{Task: "some-guid", ContainerHandle: "narc-some-guid"})
+	c.Assert(err, IsNil)
+
+	agent, err := NewAgent(FakeTaskBackend{RestoreError: errors.New("gone")}, s.RouterClient, 42)
+	c.Assert(err, IsNil)
+
+	agent.Registry = NewPersistentRegistry(store)
+
+	err = agent.RestoreTasks()
+	c.Assert(err, IsNil)
+
+	_, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, false)
+
+	records, err := store.Load()
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 0)
+}
+
+func (s *RCSuite) TestContainerHandlesIdentifyTasks(c *C) {
+	guid, ok := TaskForContainerHandle(ContainerHandleFor("some-guid"))
+	c.Assert(ok, Equals, true)
+	c.Assert(guid, Equals, "some-guid")
+
+	_, ok = TaskForContainerHandle("some-other-handle")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *RCSuite) TestParseReconcilePolicy(c *C) {
+	policy, err := ParseReconcilePolicy("adopt")
+	c.Assert(err, IsNil)
+	c.Assert(policy, Equals, ReconcileAdopt)
+
+	_, err = ParseReconcilePolicy("bogus")
+	c.Assert(err, NotNil)
+}
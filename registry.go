@@ -1,6 +1,7 @@
 package narc
 
 import (
+	"log"
 	"sync"
 )
 
@@ -8,7 +9,15 @@ type Tasks map[string]*Task
 
 type Registry struct {
 	tasks Tasks
+	store RegistryStore
 	lock  sync.RWMutex
+
+	// seq numbers the snapshots taken for the store, and written is the
+	// newest one written, so that a snapshot persisted late cannot
+	// overwrite a newer one.
+	seq         uint64
+	written     uint64
+	persistLock sync.Mutex
 }
 
 func NewRegistry() *Registry {
@@ -17,18 +26,129 @@ func NewRegistry() *Registry {
 	}
 }
 
+// NewPersistentRegistry returns a registry that records every registered
+// task in the store, so that tasks can be restored after a restart. The
+// store is written outside the registry's lock, so lookups never wait for
+// the disk.
+func NewPersistentRegistry(store RegistryStore) *Registry {
+	registry := NewRegistry()
+	registry.store = store
+	return registry
+}
+
 func (r *Registry) Register(id string, task *Task) {
 	r.lock.Lock()
-	defer r.lock.Unlock()
 
 	r.tasks[id] = task
+
+	records, seq := r.records()
+
+	r.lock.Unlock()
+
+	r.persist(records, seq)
+}
+
+// UpdateIfPresent changes a registered task and persists it again, unless
+// the task is no longer registered. It returns whether the task was found.
+func (r *Registry) UpdateIfPresent(id string, update func(*Task)) bool {
+	r.lock.Lock()
+
+	task, found := r.tasks[id]
+	if !found {
+		r.lock.Unlock()
+		return false
+	}
+
+	update(task)
+
+	records, seq := r.records()
+
+	r.lock.Unlock()
+
+	r.persist(records, seq)
+
+	return true
 }
 
 func (r *Registry) Unregister(id string) {
 	r.lock.Lock()
-	defer r.lock.Unlock()
 
 	delete(r.tasks, id)
+
+	records, seq := r.records()
+
+	r.lock.Unlock()
+
+	r.persist(records, seq)
+}
+
+// UnregisterIf unregisters a task only if it is still the one registered
+// under the id, so that a task restarted under the same id is left alone.
+// It returns whether the task was unregistered.
+func (r *Registry) UnregisterIf(id string, task *Task) bool {
+	r.lock.Lock()
+
+	if r.tasks[id] != task {
+		r.lock.Unlock()
+		return false
+	}
+
+	delete(r.tasks, id)
+
+	records, seq := r.records()
+
+	r.lock.Unlock()
+
+	r.persist(records, seq)
+
+	return true
+}
+
+// records snapshots the registered tasks for the store. It must be called
+// with the lock held.
+func (r *Registry) records() ([]TaskRecord, uint64) {
+	if r.store == nil {
+		return nil, 0
+	}
+
+	r.seq++
+
+	records := make([]TaskRecord, 0, len(r.tasks))
+	for id, task := range r.tasks {
+		records = append(records, NewTaskRecord(id, task))
+	}
+
+	return records, r.seq
+}
+
+func (r *Registry) persist(records []TaskRecord, seq uint64) {
+	if r.store == nil {
+		return
+	}
+
+	r.persistLock.Lock()
+	defer r.persistLock.Unlock()
+
+	if seq <= r.written {
+		return
+	}
+
+	r.written = seq
+
+	err := r.store.Replace(records)
+	if err != nil {
+		log.Printf("failed to persist tasks: %s\n", err)
+	}
+}
+
+// Records returns the task records persisted by a previous run, or nothing
+// if the registry is not persistent.
+func (r *Registry) Records() ([]TaskRecord, error) {
+	if r.store == nil {
+		return nil, nil
+	}
+
+	return r.store.Load()
 }
 
 func (r *Registry) Lookup(id string) (*Task, bool) {
@@ -38,3 +158,18 @@ func (r *Registry) Lookup(id string) (*Task, bool) {
 	val, ok := r.tasks[id]
 	return val, ok
 }
+
+// Snapshot returns a copy of the registered tasks, which is safe to iterate
+// over while tasks are registered and unregistered.
+func (r *Registry) Snapshot() Tasks {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	tasks := make(Tasks, len(r.tasks))
+
+	for id, task := range r.tasks {
+		tasks[id] = task
+	}
+
+	return tasks
+}
@@ -0,0 +1,166 @@
+package narc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TaskRecord is what a RegistryStore remembers about a task. The secure
+// token itself is never persisted, only its hash.
+type TaskRecord struct {
+	Task            string     `json:"task"`
+	SecureTokenHash string     `json:"secure_token_hash"`
+	ContainerHandle string     `json:"container_handle"`
+	Limits          TaskLimits `json:"limits"`
+	StopPolicy      StopPolicy `json:"stop_policy"`
+	StartedAt       time.Time  `json:"started_at"`
+}
+
+type RegistryStore interface {
+	Save(TaskRecord) error
+	Remove(task string) error
+
+	// Replace replaces every record with the given ones.
+	Replace([]TaskRecord) error
+
+	Load() ([]TaskRecord, error)
+}
+
+func NewTaskRecord(id string, task *Task) TaskRecord {
+	record := TaskRecord{
+		Task:            id,
+		SecureTokenHash: task.SecureTokenHash,
+		Limits:          task.CurrentLimits(),
+		StopPolicy:      task.StopPolicy,
+		StartedAt:       task.StartedAt,
+	}
+
+	if task.container != nil {
+		record.ContainerHandle = task.container.ID()
+	}
+
+	return record
+}
+
+// FileRegistryStore keeps task records in a JSON file. The file is rewritten
+// atomically on every change.
+type FileRegistryStore struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+func (s *FileRegistryStore) Save(record TaskRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	records[record.Task] = record
+
+	return s.write(records)
+}
+
+func (s *FileRegistryStore) Remove(task string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	_, found := records[task]
+	if !found {
+		return nil
+	}
+
+	delete(records, task)
+
+	return s.write(records)
+}
+
+func (s *FileRegistryStore) Replace(records []TaskRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	replaced := make(map[string]TaskRecord, len(records))
+	for _, record := range records {
+		replaced[record.Task] = record
+	}
+
+	return s.write(replaced)
+}
+
+func (s *FileRegistryStore) Load() ([]TaskRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]string, 0, len(records))
+	for task := range records {
+		tasks = append(tasks, task)
+	}
+
+	sort.Strings(tasks)
+
+	loaded := make([]TaskRecord, len(tasks))
+	for i, task := range tasks {
+		loaded[i] = records[task]
+	}
+
+	return loaded, nil
+}
+
+func (s *FileRegistryStore) read() (map[string]TaskRecord, error) {
+	records := make(map[string]TaskRecord)
+
+	payload, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(payload, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (s *FileRegistryStore) write(records map[string]TaskRecord) error {
+	payload, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.Path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.Path + ".tmp"
+
+	err = ioutil.WriteFile(tmp, payload, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.Path)
+}
@@ -0,0 +1,171 @@
+package narc
+
+import (
+	. "launchpad.net/gocheck"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+type RSSuite struct {
+	store *FileRegistryStore
+}
+
+func init() {
+	Suite(&RSSuite{})
+}
+
+func (s *RSSuite) SetUpTest(c *C) {
+	s.store = &FileRegistryStore{Path: filepath.Join(c.MkDir(), "state", "tasks.json")}
+}
+
+func (s *RSSuite) TestFileRegistryStoreStartsEmpty(c *C) {
+	records, err := s.store.Load()
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 0)
+}
+
+func (s *RSSuite) TestFileRegistryStoreSavesAndRemovesRecords(c *C) {
+	startedAt := time.Date(2013, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	record1 := TaskRecord{
+		Task:            "guid-1",
+		SecureTokenHash: "some-hash",
+		ContainerHandle: "narc-guid-1",
+		Limits:          TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 2},
+		StartedAt:       startedAt,
+	}
+
+	record2 := TaskRecord{Task: "guid-2", ContainerHandle: "narc-guid-2", StartedAt: startedAt}
+
+	c.Assert(s.store.Save(record2), IsNil)
+	c.Assert(s.store.Save(record1), IsNil)
+
+	reloaded := &FileRegistryStore{Path: s.store.Path}
+
+	records, err := reloaded.Load()
+	c.Assert(err, IsNil)
+	c.Assert(records, DeepEquals, []TaskRecord{record1, record2})
+
+	c.Assert(reloaded.Remove("guid-1"), IsNil)
+	c.Assert(reloaded.Remove("bogus-guid"), IsNil)
+
+	records, err = s.store.Load()
+	c.Assert(err, IsNil)
+	c.Assert(records, DeepEquals, []TaskRecord{record2})
+}
+
+func (s *RSSuite) TestPersistentRegistryRecordsTasks(c *C) {
+	registry := NewPersistentRegistry(s.store)
+
+	task, _ := NewTask(&FakeContainer{Handle: "some-handle"}, "some-token", exec.Command("ls"))
+	task.Limits = TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 2}
+
+	registry.Register("some-guid", task)
+
+	records, err := registry.Records()
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 1)
+
+	c.Assert(records[0].Task, Equals, "some-guid")
+	c.Assert(records[0].ContainerHandle, Equals, "some-handle")
+	c.Assert(records[0].SecureTokenHash, Equals, HashSecureToken("some-token"))
+	c.Assert(records[0].SecureTokenHash, Not(Equals), "some-token")
+	c.Assert(records[0].Limits, Equals, task.Limits)
+
+	registry.Unregister("some-guid")
+
+	records, err = registry.Records()
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 0)
+}
+
+func (s *RSSuite) TestUpdateIfPresentOnlyPersistsRegisteredTasks(c *C) {
+	registry := NewPersistentRegistry(s.store)
+
+	task, _ := NewTask(&FakeContainer{Handle: "some-handle"}, "some-token", exec.Command("ls"))
+	registry.Register("some-guid", task)
+
+	limits := TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 2}
+
+	updated := registry.UpdateIfPresent("some-guid", func(task *Task) { task.SetLimits(limits) })
+	c.Assert(updated, Equals, true)
+
+	records, err := registry.Records()
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].Limits, Equals, limits)
+
+	registry.Unregister("some-guid")
+
+	updated = registry.UpdateIfPresent("some-guid", func(task *Task) { c.Fatal("updated an unregistered task") })
+	c.Assert(updated, Equals, false)
+
+	records, err = registry.Records()
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 0)
+}
+
+func (s *RSSuite) TestPersistentRegistryDropsStaleSnapshots(c *C) {
+	registry := NewPersistentRegistry(s.store)
+
+	registry.persist([]TaskRecord{{Task: "newer-guid"}}, 2)
+	registry.persist([]TaskRecord{{Task: "older-guid"}}, 1)
+
+	records, err := registry.Records()
+	c.Assert(err, IsNil)
+	c.Assert(records, DeepEquals, []TaskRecord{{Task: "newer-guid"}})
+}
+
+// blockingRegistryStore holds up every Replace until it is released.
+type blockingRegistryStore struct {
+	FileRegistryStore
+
+	release chan bool
+}
+
+func (s *blockingRegistryStore) Replace(records []TaskRecord) error {
+	<-s.release
+	return s.FileRegistryStore.Replace(records)
+}
+
+func (s *RSSuite) TestPersistentRegistryLookupsDoNotWaitForTheStore(c *C) {
+	store := &blockingRegistryStore{FileRegistryStore: FileRegistryStore{Path: s.store.Path}, release: make(chan bool)}
+	registry := NewPersistentRegistry(store)
+
+	task, _ := NewTask(&FakeContainer{Handle: "some-handle"}, "some-token", exec.Command("ls"))
+
+	registered := make(chan bool)
+
+	go func() {
+		registry.Register("some-guid", task)
+		registered <- true
+	}()
+
+	looked := make(chan bool)
+
+	go func() {
+		for {
+			_, found := registry.Lookup("some-guid")
+			if found {
+				looked <- true
+				return
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-looked:
+	case <-time.After(1 * time.Second):
+		c.Error("Lookup waited for the store.")
+	}
+
+	store.release <- true
+	<-registered
+
+	records, err := registry.Records()
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 1)
+}
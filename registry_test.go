@@ -34,3 +34,41 @@ func (s *RSuite) TestRegistryCRUD(c *C) {
 	c.Assert(sess, Equals, task2)
 	c.Assert(sess, Not(Equals), task1)
 }
+
+func (s *RSuite) TestRegistrySnapshot(c *C) {
+	registry := NewRegistry()
+
+	task1 := &Task{}
+	task2 := &Task{}
+
+	registry.Register("123", task1)
+	registry.Register("456", task2)
+
+	snapshot := registry.Snapshot()
+	c.Assert(snapshot, DeepEquals, Tasks{"123": task1, "456": task2})
+
+	registry.Unregister("123")
+
+	c.Assert(snapshot, HasLen, 2)
+	c.Assert(registry.Snapshot(), DeepEquals, Tasks{"456": task2})
+}
+
+func (s *RSuite) TestRegistryUnregisterIf(c *C) {
+	registry := NewRegistry()
+
+	task1 := &Task{}
+	task2 := &Task{}
+
+	registry.Register("123", task2)
+
+	c.Assert(registry.UnregisterIf("123", task1), Equals, false)
+
+	sess, ok := registry.Lookup("123")
+	c.Assert(ok, Equals, true)
+	c.Assert(sess, Equals, task2)
+
+	c.Assert(registry.UnregisterIf("123", task2), Equals, true)
+
+	_, ok = registry.Lookup("123")
+	c.Assert(ok, Equals, false)
+}
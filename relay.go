@@ -0,0 +1,485 @@
+package narc
+
+import (
+	"bytes"
+	"code.google.com/p/go.crypto/ssh"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// RelayEnv marks a narc process started as the console relay of another.
+const RelayEnv = "NARC_RELAY"
+
+var InvalidSecureToken = errors.New("invalid secure token")
+
+// the relay finds its end of the control socket after stdin, stdout and
+// stderr
+const relayControlFD = 3
+
+// how long the relay waits for the agent to answer, e.g. while the agent
+// hands off to a new process
+const relayTimeout = 30 * time.Second
+
+// requests, replies and notices are all much smaller than this
+const relayPacketSize = 32 * 1024
+
+// Relay is the agent's end of its console relay: a narc child process that
+// runs the SSH proxy server. The relay outlives handoffs, so SSH sessions
+// are kept while the agent re-executes itself.
+//
+// For every login and every session, the relay passes the agent one end of
+// a new socket pair over the control socket, and asks for the task on it.
+// The agent answers with the task's pty. It then writes notices for the
+// session to the socket, and closes it once the task completes. The relay
+// shuts the socket down once the session's input ends.
+type Relay struct {
+	hostKey []byte
+	process *os.Process
+
+	registry *Registry
+	control  *net.UnixConn
+}
+
+type relayConfig struct {
+	HostKey []byte `json:"host_key"`
+	Port    int    `json:"port"`
+}
+
+// relayRequest asks the agent to check a login, or, for a session of a
+// connection that has logged in, to attach it to the task.
+type relayRequest struct {
+	Task     string `json:"task"`
+	Password string `json:"password,omitempty"`
+	Attach   bool   `json:"attach,omitempty"`
+}
+
+type relayReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+// StartRelay generates a host key and starts a console relay serving SSH on
+// the given port, for the tasks in the registry.
+func StartRelay(registry *Registry, port int) (*Relay, error) {
+	hostKey, err := generateHostKey()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := json.Marshal(relayConfig{HostKey: hostKey, Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	control, relayEnd, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+
+	defer relayEnd.Close()
+
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(), RelayEnv+"=1")
+	cmd.Stdin = bytes.NewReader(config)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{relayEnd}
+
+	// keep signals meant for narc, e.g. ^C, from reaching the relay; it
+	// exits once narc is gone
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	return newRelay(registry, hostKey, cmd.Process, control)
+}
+
+// ResumeRelay takes over the console relay of the agent that handed off.
+func ResumeRelay(registry *Registry, handoff *Handoff) (*Relay, error) {
+	process, err := os.FindProcess(handoff.RelayPID)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRelay(registry, handoff.HostKey, process, os.NewFile(handoff.RelayFD, "narc-relay"))
+}
+
+func newRelay(registry *Registry, hostKey []byte, process *os.Process, control *os.File) (*Relay, error) {
+	conn, err := unixConn(control)
+	if err != nil {
+		return nil, err
+	}
+
+	relay := &Relay{
+		hostKey: hostKey,
+		process: process,
+
+		registry: registry,
+		control:  conn,
+	}
+
+	if process != nil {
+		go relay.reap()
+	}
+
+	go relay.serve()
+
+	return relay, nil
+}
+
+func (r *Relay) HostKey() []byte {
+	return r.hostKey
+}
+
+func (r *Relay) HostKeyFingerprint() (string, error) {
+	return hostKeyFingerprint(r.hostKey)
+}
+
+// PID returns the process id of the relay, or 0 if it is not known.
+func (r *Relay) PID() int {
+	if r.process == nil {
+		return 0
+	}
+
+	return r.process.Pid
+}
+
+// File returns a duplicate of the control socket, e.g. to hand it off to
+// another process.
+func (r *Relay) File() (*os.File, error) {
+	return r.control.File()
+}
+
+// Stop closes the control socket. The relay then stops serving SSH and
+// exits, unless the socket was handed off to a process that still runs.
+func (r *Relay) Stop() error {
+	return r.control.Close()
+}
+
+func (r *Relay) reap() {
+	state, err := r.process.Wait()
+	if err != nil {
+		log.Println("failed to wait for the console relay:", err)
+		return
+	}
+
+	log.Println("console relay exited:", state)
+}
+
+func (r *Relay) serve() {
+	for {
+		_, session, err := readPacket(r.control)
+		if err != nil {
+			log.Println("stopped serving the console relay:", err)
+			return
+		}
+
+		if session != nil {
+			go r.serveSession(session)
+		}
+	}
+}
+
+func (r *Relay) serveSession(file *os.File) {
+	session, err := unixConn(file)
+	if err != nil {
+		log.Println("failed to open console relay session:", err)
+		return
+	}
+
+	var pty *os.File
+
+	payload, _, err := readPacket(session)
+	if err == nil {
+		var request relayRequest
+
+		err = json.Unmarshal(payload, &request)
+		if err == nil {
+			pty, err = r.open(request, session)
+		}
+	}
+
+	reply := relayReply{}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+
+	payload, err = json.Marshal(reply)
+	if err == nil {
+		err = writePacket(session, payload, pty)
+	}
+
+	if err != nil {
+		log.Println("failed to answer the console relay:", err)
+	}
+
+	if err != nil || pty == nil {
+		session.Close()
+	}
+}
+
+// open checks a login, or attaches a session to its task and returns the
+// task's pty. The relay only asks to attach sessions that logged in.
+func (r *Relay) open(request relayRequest, session *net.UnixConn) (*os.File, error) {
+	task, found := r.registry.Lookup(request.Task)
+	if !found {
+		return nil, TaskNotRegistered
+	}
+
+	if !request.Attach {
+		if !task.Authorize(request.Password) {
+			return nil, InvalidSecureToken
+		}
+
+		return nil, nil
+	}
+
+	return task.attachConsole(session)
+}
+
+// RunRelay is the console relay process started by StartRelay. It reads
+// its config from stdin and serves SSH until narc, and every process narc
+// handed off to, is gone.
+func RunRelay() error {
+	var config relayConfig
+
+	err := json.NewDecoder(os.Stdin).Decode(&config)
+	if err != nil {
+		return err
+	}
+
+	control, err := unixConn(os.NewFile(relayControlFD, "narc-relay"))
+	if err != nil {
+		return err
+	}
+
+	server := NewProxyServerWithHostKey(&relayConsoles{control}, config.HostKey)
+
+	err = server.Start(config.Port)
+	if err != nil {
+		return err
+	}
+
+	// narc never writes to the control socket, so reading only ends once
+	// it has been closed by every process that had it
+	io.Copy(ioutil.Discard, control)
+
+	return server.Stop()
+}
+
+// relayConsoles attaches SSH sessions through the control socket, in the
+// relay process.
+type relayConsoles struct {
+	control *net.UnixConn
+}
+
+func (c *relayConsoles) Authorize(task, password string) bool {
+	session, _, err := c.request(relayRequest{Task: task, Password: password})
+	if err != nil {
+		log.Println("verify failed:", err)
+		return false
+	}
+
+	session.Close()
+
+	return true
+}
+
+func (c *relayConsoles) Attach(task string, channel ssh.Channel) error {
+	session, pty, err := c.request(relayRequest{Task: task, Attach: true})
+	if err != nil {
+		return err
+	}
+
+	if pty == nil {
+		session.Close()
+		return errors.New("no pty for task " + task)
+	}
+
+	go func() {
+		io.Copy(channel, pty)
+		pty.Close()
+	}()
+
+	// notices, until the agent closes the session as the task completes
+	go func() {
+		io.Copy(channel, session)
+		session.Close()
+		channel.Close()
+	}()
+
+	go func() {
+		handleChannelRequests(pty, channel)
+		session.CloseWrite()
+	}()
+
+	return nil
+}
+
+// request passes the agent a new session over the control socket and sends
+// the request on it. It returns the session and the pty the agent answered
+// with, if any.
+func (c *relayConsoles) request(request relayRequest) (*net.UnixConn, *os.File, error) {
+	local, remote, err := socketPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = writePacket(c.control, []byte("session"), remote)
+	remote.Close()
+	if err != nil {
+		local.Close()
+		return nil, nil, err
+	}
+
+	session, err := unixConn(local)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := json.Marshal(request)
+	if err == nil {
+		_, err = session.Write(payload)
+	}
+
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	session.SetReadDeadline(time.Now().Add(relayTimeout))
+
+	payload, pty, err := readPacket(session)
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	session.SetReadDeadline(time.Time{})
+
+	var reply relayReply
+
+	err = json.Unmarshal(payload, &reply)
+	if err == nil && reply.Error != "" {
+		err = errors.New(reply.Error)
+	}
+
+	if err != nil {
+		if pty != nil {
+			pty.Close()
+		}
+
+		session.Close()
+
+		return nil, nil, err
+	}
+
+	return session, pty, nil
+}
+
+// socketPair returns both ends of a new packet socket pair, so that every
+// write is read whole.
+func socketPair() (*os.File, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return os.NewFile(uintptr(fds[0]), "narc-relay"), os.NewFile(uintptr(fds[1]), "narc-relay"), nil
+}
+
+// unixConn returns a connection for a socket, closing the file.
+func unixConn(file *os.File) (*net.UnixConn, error) {
+	defer file.Close()
+
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, err
+	}
+
+	unix, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("not a unix socket")
+	}
+
+	return unix, nil
+}
+
+// writePacket writes a packet, passing a descriptor along if file is set.
+func writePacket(conn *net.UnixConn, payload []byte, file *os.File) error {
+	var rights []byte
+
+	if file != nil {
+		raw, err := file.SyscallConn()
+		if err != nil {
+			return err
+		}
+
+		err = raw.Control(func(fd uintptr) {
+			rights = syscall.UnixRights(int(fd))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, _, err := conn.WriteMsgUnix(payload, rights, nil)
+	return err
+}
+
+// readPacket reads a packet and the descriptor passed along with it, if
+// any.
+func readPacket(conn *net.UnixConn) ([]byte, *os.File, error) {
+	payload := make([]byte, relayPacketSize)
+	oob := make([]byte, syscall.CmsgSpace(4))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(payload, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if n == 0 && oobn == 0 {
+		return nil, nil, io.EOF
+	}
+
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var file *os.File
+
+	for _, message := range messages {
+		fds, err := syscall.ParseUnixRights(&message)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			if file == nil {
+				file = os.NewFile(uintptr(fd), "narc-relay")
+			} else {
+				syscall.Close(fd)
+			}
+		}
+	}
+
+	return payload[:n], file, nil
+}
@@ -0,0 +1,195 @@
+package narc
+
+import (
+	"code.google.com/p/go.crypto/ssh"
+	"github.com/cloudfoundry/gibson/fake_router_client"
+	"github.com/kr/pty"
+	"io"
+	. "launchpad.net/gocheck"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+type CRSuite struct {
+	Registry *Registry
+	Relay    *Relay
+	Consoles *relayConsoles
+}
+
+func init() {
+	Suite(&CRSuite{})
+}
+
+// heldChannel is a FakeChannel whose input only ends once released.
+type heldChannel struct {
+	*FakeChannel
+
+	release chan bool
+}
+
+func newHeldChannel() *heldChannel {
+	return &heldChannel{
+		FakeChannel: NewFakeChannel([]ssh.ChannelRequest{}),
+		release:     make(chan bool),
+	}
+}
+
+func (c *heldChannel) Read(data []byte) (int, error) {
+	<-c.release
+	return 0, io.EOF
+}
+
+func (s *CRSuite) SetUpTest(c *C) {
+	s.Registry = NewRegistry()
+
+	control, relayEnd, err := socketPair()
+	c.Assert(err, IsNil)
+
+	s.Relay, err = newRelay(s.Registry, nil, nil, control)
+	c.Assert(err, IsNil)
+
+	conn, err := unixConn(relayEnd)
+	c.Assert(err, IsNil)
+
+	s.Consoles = &relayConsoles{conn}
+}
+
+func (s *CRSuite) TearDownTest(c *C) {
+	s.Relay.Stop()
+	s.Consoles.control.Close()
+}
+
+func (s *CRSuite) TestRelayChecksLoginsWithTheAgent(c *C) {
+	task, _ := NewTask(&FakeContainer{}, "some-token", exec.Command("ls"))
+	s.Registry.Register("some-guid", task)
+
+	c.Assert(s.Consoles.Authorize("some-guid", "some-token"), Equals, true)
+	c.Assert(s.Consoles.Authorize("some-guid", "bogus-token"), Equals, false)
+	c.Assert(s.Consoles.Authorize("bogus-guid", "some-token"), Equals, false)
+}
+
+func (s *CRSuite) TestRelayAttachesSessionsToTheTaskConsole(c *C) {
+	task, _ := NewTask(&FakeContainer{}, "some-token", exec.Command("bash", "-c", "echo hi; sleep 100"))
+	s.Registry.Register("some-guid", task)
+
+	defer task.Stop()
+
+	channel := newHeldChannel()
+
+	reader := NewExpector(channel.readPipe, 1*time.Second)
+
+	err := s.Consoles.Attach("some-guid", channel)
+	c.Assert(err, IsNil)
+
+	expect(c, reader, `hi\r\n`)
+
+	c.Assert(task.AttachedSessions(), Equals, 1)
+
+	task.Broadcast("some notice")
+
+	expect(c, reader, `some notice`)
+
+	close(channel.release)
+
+	for i := 0; i < 100 && task.AttachedSessions() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(task.AttachedSessions(), Equals, 0)
+}
+
+func (s *CRSuite) TestRelayReportsUnknownTasks(c *C) {
+	err := s.Consoles.Attach("bogus-guid", newHeldChannel())
+	c.Assert(err, ErrorMatches, "task not registered")
+}
+
+func (s *CRSuite) TestHandoffPassesRelayedSessions(c *C) {
+	agent, err := NewAgent(FakeTaskBackend{}, fake_gibson.NewFakeRouterClient(), 42)
+	c.Assert(err, IsNil)
+
+	agent.Registry = s.Registry
+
+	task, _ := NewTask(&FakeContainer{}, "some-token", exec.Command("sleep", "100"))
+	s.Registry.Register("some-guid", task)
+
+	defer task.Stop()
+
+	channel := newHeldChannel()
+	defer close(channel.release)
+
+	err = s.Consoles.Attach("some-guid", channel)
+	c.Assert(err, IsNil)
+
+	handoff, err := NewHandoff(agent, s.Relay)
+	c.Assert(err, IsNil)
+
+	c.Assert(handoff.RelayFD, Not(Equals), uintptr(0))
+	c.Assert(handoff.Tasks, HasLen, 1)
+	c.Assert(handoff.Tasks[0].PtyFD, Not(Equals), uintptr(0))
+	c.Assert(handoff.Tasks[0].SessionFDs, HasLen, 1)
+
+	handoff.release()
+
+	// the session is still attached in this process
+	c.Assert(task.AttachedSessions(), Equals, 1)
+}
+
+func (s *CRSuite) TestAgentResumesRelayedSessions(c *C) {
+	agent, err := NewAgent(FakeTaskBackend{}, fake_gibson.NewFakeRouterClient(), 42)
+	c.Assert(err, IsNil)
+
+	command := exec.Command("sleep", "100")
+
+	tty, err := pty.Start(command)
+	c.Assert(err, IsNil)
+
+	local, remote, err := socketPair()
+	c.Assert(err, IsNil)
+
+	// the resumed task owns its descriptors, as if they were inherited
+	ptyFD, err := syscall.Dup(int(tty.Fd()))
+	c.Assert(err, IsNil)
+
+	tty.Close()
+
+	sessionFD, err := syscall.Dup(int(local.Fd()))
+	c.Assert(err, IsNil)
+
+	local.Close()
+
+	relayed, err := unixConn(remote)
+	c.Assert(err, IsNil)
+
+	defer relayed.Close()
+
+	err = agent.ResumeTasks([]HandoffTask{
+		{
+			TaskRecord: TaskRecord{Task: "some-guid", ContainerHandle: "narc-some-guid"},
+			PtyFD:      uintptr(ptyFD),
+			PID:        command.Process.Pid,
+			SessionFDs: []uintptr{uintptr(sessionFD)},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	task, found := agent.Registry.Lookup("some-guid")
+	c.Assert(found, Equals, true)
+	c.Assert(task.AttachedSessions(), Equals, 1)
+
+	defer task.Stop()
+
+	task.Broadcast("some notice")
+
+	notice, _, err := readPacket(relayed)
+	c.Assert(err, IsNil)
+	c.Assert(string(notice), Equals, "some notice")
+
+	relayed.Close()
+
+	for i := 0; i < 100 && task.AttachedSessions() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(task.AttachedSessions(), Equals, 0)
+}
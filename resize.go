@@ -0,0 +1,169 @@
+package narc
+
+import (
+	"errors"
+	"log"
+
+	"github.com/cloudfoundry/go_cfmessagebus"
+	"github.com/cloudfoundry/narc/protocol"
+)
+
+var InsufficientCapacity = errors.New("not enough capacity")
+
+// HandleUpdates subscribes to both the broadcast update subject and the
+// update subject directed at this agent. Broadcast updates for tasks this
+// agent is not running are ignored.
+func (agent *Agent) HandleUpdates(mbus cfmessagebus.MessageBus) error {
+	err := mbus.Subscribe(protocol.UpdateSubject, agent.updateHandler(mbus, protocol.UpdateSubject, false))
+	if err != nil {
+		return err
+	}
+
+	directed := protocol.UpdateSubjectFor(agent.ID.String())
+
+	return mbus.Subscribe(directed, agent.updateHandler(mbus, directed, true))
+}
+
+// ResizeTask changes the memory and disk limits of a running task's
+// container without restarting it. Zero limits are left as they are. The
+// task may only grow into capacity no other task has reserved.
+func (agent *Agent) ResizeTask(guid string, limits TaskLimits) error {
+	task, found := agent.Registry.Lookup(guid)
+	if !found {
+		return TaskNotRegistered
+	}
+
+	container, limitable := task.container.(LimitableContainer)
+	if !limitable {
+		return ContainerNotLimitable
+	}
+
+	previous := task.CurrentLimits()
+
+	resized := previous
+	if limits.MemoryLimitInBytes > 0 {
+		resized.MemoryLimitInBytes = limits.MemoryLimitInBytes
+	}
+
+	if limits.DiskLimitInBytes > 0 {
+		resized.DiskLimitInBytes = limits.DiskLimitInBytes
+	}
+
+	err := agent.reserveResize(guid, previous, resized)
+	if err != nil {
+		return err
+	}
+
+	err = resizeContainer(container, previous, resized)
+	if err != nil {
+		agent.reserve(guid, previous)
+		return err
+	}
+
+	// the new limits are persisted, unless the task completed while it was
+	// being resized
+	agent.Registry.UpdateIfPresent(guid, func(registered *Task) {
+		registered.SetLimits(resized)
+	})
+
+	return nil
+}
+
+// reserveResize replaces a task's reservation, unless that would reserve
+// more than the agent's capacity.
+func (agent *Agent) reserveResize(guid string, previous, resized TaskLimits) error {
+	agent.reservationsLock.Lock()
+	defer agent.reservationsLock.Unlock()
+
+	_, reserved := agent.reservations[guid]
+	if !reserved {
+		return TaskNotRegistered
+	}
+
+	others := agent.pooled()
+
+	for reserved, limits := range agent.reservations {
+		if reserved != guid {
+			others.MemoryLimitInBytes += limits.MemoryLimitInBytes
+			others.DiskLimitInBytes += limits.DiskLimitInBytes
+		}
+	}
+
+	growsMemory := resized.MemoryLimitInBytes > previous.MemoryLimitInBytes
+	if growsMemory && others.MemoryLimitInBytes+resized.MemoryLimitInBytes > agent.Capacity.MemoryInBytes {
+		return InsufficientCapacity
+	}
+
+	growsDisk := resized.DiskLimitInBytes > previous.DiskLimitInBytes
+	if growsDisk && others.DiskLimitInBytes+resized.DiskLimitInBytes > agent.Capacity.DiskInBytes {
+		return InsufficientCapacity
+	}
+
+	agent.reservations[guid] = resized
+
+	return nil
+}
+
+// resizeContainer only changes the limits that differ, so that backends
+// that cannot change disk limits can still change memory limits.
+func resizeContainer(container LimitableContainer, previous, resized TaskLimits) error {
+	if resized.MemoryLimitInBytes != previous.MemoryLimitInBytes {
+		err := container.LimitMemory(resized.MemoryLimitInBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if resized.DiskLimitInBytes != previous.DiskLimitInBytes {
+		err := container.LimitDisk(resized.DiskLimitInBytes)
+		if err != nil {
+			// keep the container consistent with its reservation
+			memoryErr := container.LimitMemory(previous.MemoryLimitInBytes)
+			if memoryErr != nil {
+				log.Printf("failed to restore memory limit of container %s: %s\n", container.ID(), memoryErr)
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (agent *Agent) updateHandler(mbus cfmessagebus.MessageBus, subject string, directed bool) func([]byte) {
+	return func(payload []byte) {
+		update, err := protocol.ParseUpdateMessage(payload)
+		if err != nil {
+			log.Printf("invalid task update: %s\n", err)
+			agent.reportError(mbus, subject, update.Task, err)
+			return
+		}
+
+		if !directed && !agent.isPlacedHere(update.Agent) {
+			return
+		}
+
+		err = agent.handleUpdate(update)
+		if err == TaskNotRegistered && !directed && update.Agent == "" {
+			return
+		}
+
+		if err != nil {
+			agent.reportError(mbus, subject, update.Task, err)
+		}
+	}
+}
+
+func (agent *Agent) handleUpdate(update protocol.UpdateMessage) error {
+	log.Printf("resizing task %s\n", update.Task)
+
+	err := agent.ResizeTask(update.Task, TaskLimits{
+		MemoryLimitInBytes: update.MemoryLimitInMegabytes * megabyte,
+		DiskLimitInBytes:   update.DiskLimitInMegabytes * megabyte,
+	})
+	if err != nil {
+		log.Printf("failed to resize task: %s\n", err)
+	}
+
+	return err
+}
@@ -0,0 +1,97 @@
+package narc
+
+import (
+	"encoding/json"
+	"github.com/cloudfoundry/gibson/fake_router_client"
+	"github.com/cloudfoundry/go_cfmessagebus/mock_cfmessagebus"
+	"github.com/cloudfoundry/narc/protocol"
+	. "launchpad.net/gocheck"
+	"os/exec"
+	"time"
+)
+
+type RZSuite struct {
+	Agent *Agent
+
+	MessageBus *mock_cfmessagebus.MockMessageBus
+}
+
+func init() {
+	Suite(&RZSuite{})
+}
+
+func (s *RZSuite) SetUpTest(c *C) {
+	agent, err := NewAgent(FakeTaskBackend{Command: exec.Command("sleep", "100")}, fake_gibson.NewFakeRouterClient(), 42)
+	c.Assert(err, IsNil)
+
+	agent.Capacity = CapacityConfig{MemoryInBytes: 64 * 1024 * 1024, DiskInBytes: 64 * 1024 * 1024}
+
+	s.Agent = agent
+
+	s.MessageBus = mock_cfmessagebus.NewMockMessageBus()
+
+	err = agent.HandleUpdates(s.MessageBus)
+	c.Assert(err, IsNil)
+}
+
+func (s *RZSuite) startTask(c *C, guid string, memory, disk uint64) *Task {
+	task, err := s.Agent.startTask("some-token", ContainerSpec{
+		Task:   guid,
+		Limits: TaskLimits{MemoryLimitInBytes: memory * 1024 * 1024, DiskLimitInBytes: disk * 1024 * 1024},
+	}, nil, StopPolicy{})
+	c.Assert(err, IsNil)
+
+	return task
+}
+
+func (s *RZSuite) TestUpdateResizesContainer(c *C) {
+	task := s.startTask(c, "some-guid", 16, 8)
+
+	s.MessageBus.PublishSync("task.update", []byte(`{"task":"some-guid","memory_limit":32}`))
+
+	container := task.container.(*FakeContainer)
+	c.Assert(*container.LimitedMemory, Equals, uint64(32*1024*1024))
+	c.Assert(*container.LimitedDisk, Equals, uint64(8*1024*1024))
+
+	c.Assert(task.Limits.MemoryLimitInBytes, Equals, uint64(32*1024*1024))
+	c.Assert(s.Agent.Advertisement().AvailableMemory, Equals, uint64(32))
+}
+
+func (s *RZSuite) TestResizeRefusesToExceedCapacity(c *C) {
+	s.startTask(c, "some-guid", 16, 8)
+	task := s.startTask(c, "other-guid", 32, 8)
+
+	err := s.Agent.ResizeTask("other-guid", TaskLimits{MemoryLimitInBytes: 64 * 1024 * 1024})
+	c.Assert(err, Equals, InsufficientCapacity)
+
+	c.Assert(task.Limits.MemoryLimitInBytes, Equals, uint64(32*1024*1024))
+	c.Assert(s.Agent.Advertisement().AvailableMemory, Equals, uint64(16))
+
+	err = s.Agent.ResizeTask("other-guid", TaskLimits{MemoryLimitInBytes: 48 * 1024 * 1024})
+	c.Assert(err, IsNil)
+	c.Assert(s.Agent.Advertisement().AvailableMemory, Equals, uint64(0))
+}
+
+func (s *RZSuite) TestDirectedUpdateReportsUnknownTasks(c *C) {
+	reported := make(chan []byte, 1)
+
+	s.MessageBus.Subscribe("task.error", func(payload []byte) {
+		reported <- payload
+	})
+
+	s.MessageBus.PublishSync("task.update", []byte(`{"task":"some-guid","memory_limit":32}`))
+
+	s.MessageBus.PublishSync("task.update."+s.Agent.ID.String(), []byte(`{"task":"some-guid","memory_limit":32}`))
+
+	select {
+	case payload := <-reported:
+		var message protocol.ErrorMessage
+		err := json.Unmarshal(payload, &message)
+		c.Assert(err, IsNil)
+
+		c.Assert(message.Subject, Equals, "task.update."+s.Agent.ID.String())
+		c.Assert(message.Error, Equals, TaskNotRegistered.Error())
+	case <-time.After(1 * time.Second):
+		c.Error("did not report the unknown task")
+	}
+}
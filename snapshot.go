@@ -0,0 +1,178 @@
+package narc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cloudfoundry/go_cfmessagebus"
+	"github.com/cloudfoundry/narc/protocol"
+)
+
+var SnapshotsNotConfigured = errors.New("snapshots are not configured")
+var ContainerNotStreamable = errors.New("container cannot stream out its files")
+
+// SnapshotStore keeps snapshot archives. DirectorySnapshotStore keeps them
+// on local disk; a blobstore can be used instead by implementing Store.
+type SnapshotStore interface {
+	// Store saves an archive under the given name and returns where it can
+	// be found. Nothing should be kept if reading the archive fails.
+	Store(name string, archive io.Reader) (string, error)
+}
+
+type DirectorySnapshotStore struct {
+	Path string
+}
+
+// Store writes the archive to a temporary file first, so that a failed
+// snapshot does not leave a partial archive behind.
+func (s *DirectorySnapshotStore) Store(name string, archive io.Reader) (string, error) {
+	err := os.MkdirAll(s.Path, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := ioutil.TempFile(s.Path, "."+name)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(file, archive)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	err = file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	path := filepath.Join(s.Path, name)
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	return path, nil
+}
+
+// HandleSnapshotRequests replies to snapshot requests once the archive has
+// been stored. Broadcast requests are answered on their reply_to subject,
+// and only by the agent running the task, so that the others do not answer
+// first with an unknown task; requests directed at this agent are always
+// answered.
+func (agent *Agent) HandleSnapshotRequests(mbus cfmessagebus.MessageBus) error {
+	err := mbus.Subscribe(protocol.SnapshotSubject, func(payload []byte) {
+		request, err := protocol.ParseSnapshotRequest(payload)
+		if err != nil {
+			log.Printf("invalid snapshot request: %s\n", err)
+			return
+		}
+
+		if request.ReplyTo == "" {
+			log.Printf("ignoring snapshot request without reply_to: %s\n", request.Task)
+			return
+		}
+
+		_, found := agent.Registry.Lookup(request.Task)
+		if !found {
+			return
+		}
+
+		// streaming the archive must not hold up the subscription
+		go func() {
+			mbus.Publish(request.ReplyTo, marshalReply(agent.snapshotResponse(request)))
+		}()
+	})
+	if err != nil {
+		return err
+	}
+
+	return mbus.ReplyToChannel(protocol.SnapshotSubjectFor(agent.ID.String()), func(payload []byte) []byte {
+		return marshalReply(agent.handleSnapshotRequest(payload))
+	})
+}
+
+// SnapshotTask streams a tar archive of the given paths out of a task's
+// container into the agent's snapshot store.
+func (agent *Agent) SnapshotTask(guid string, paths []string) (protocol.Snapshot, error) {
+	snapshot := protocol.Snapshot{Task: guid}
+
+	if agent.Snapshots == nil {
+		return snapshot, SnapshotsNotConfigured
+	}
+
+	task, found := agent.Registry.Lookup(guid)
+	if !found {
+		return snapshot, TaskNotRegistered
+	}
+
+	container, streamable := task.container.(StreamOutContainer)
+	if !streamable {
+		return snapshot, ContainerNotStreamable
+	}
+
+	archive, err := container.StreamOut(paths)
+	if err != nil {
+		return snapshot, err
+	}
+
+	defer archive.Close()
+
+	checksum := sha256.New()
+	size := &byteCounter{}
+
+	name := fmt.Sprintf("%s-%s.tar", guid, time.Now().UTC().Format("20060102T150405.000000000Z"))
+
+	snapshot.Location, err = agent.Snapshots.Store(name, io.TeeReader(archive, io.MultiWriter(checksum, size)))
+	if err != nil {
+		return snapshot, err
+	}
+
+	snapshot.Size = size.count
+	snapshot.SHA256 = hex.EncodeToString(checksum.Sum(nil))
+
+	return snapshot, nil
+}
+
+func (agent *Agent) handleSnapshotRequest(payload []byte) protocol.SnapshotResponse {
+	request, err := protocol.ParseSnapshotRequest(payload)
+	if err != nil {
+		return protocol.SnapshotResponse{Version: protocol.Version, Error: err.Error()}
+	}
+
+	return agent.snapshotResponse(request)
+}
+
+func (agent *Agent) snapshotResponse(request protocol.SnapshotRequest) protocol.SnapshotResponse {
+	log.Printf("snapshotting task %s\n", request.Task)
+
+	snapshot, err := agent.SnapshotTask(request.Task, request.Paths)
+	if err != nil {
+		log.Printf("failed to snapshot task %s: %s\n", request.Task, err)
+		return protocol.SnapshotResponse{Version: protocol.Version, Error: err.Error()}
+	}
+
+	return protocol.SnapshotResponse{Version: protocol.Version, Snapshot: &snapshot}
+}
+
+type byteCounter struct {
+	count uint64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.count += uint64(len(p))
+	return len(p), nil
+}
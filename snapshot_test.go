@@ -0,0 +1,126 @@
+package narc
+
+import (
+	"encoding/json"
+	"github.com/cloudfoundry/gibson/fake_router_client"
+	"github.com/cloudfoundry/go_cfmessagebus/mock_cfmessagebus"
+	"github.com/cloudfoundry/narc/protocol"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+type SNSuite struct {
+	Agent     *Agent
+	Container *FakeContainer
+	Path      string
+}
+
+func init() {
+	Suite(&SNSuite{})
+}
+
+func (s *SNSuite) SetUpTest(c *C) {
+	s.Container = &FakeContainer{Handle: "narc-some-guid", Archive: []byte("some-archive")}
+
+	agent, err := NewAgent(FakeTaskBackend{Container: s.Container, Command: exec.Command("sleep", "100")}, fake_gibson.NewFakeRouterClient(), 42)
+	c.Assert(err, IsNil)
+
+	agent.Capacity = CapacityConfig{MemoryInBytes: 64 * 1024 * 1024, DiskInBytes: 64 * 1024 * 1024}
+
+	s.Path = filepath.Join(c.MkDir(), "snapshots")
+	agent.Snapshots = &DirectorySnapshotStore{Path: s.Path}
+
+	s.Agent = agent
+
+	_, err = agent.startTask("some-token", ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 1},
+	}, nil, StopPolicy{})
+	c.Assert(err, IsNil)
+}
+
+func (s *SNSuite) TestSnapshotStoresTheArchive(c *C) {
+	snapshot, err := s.Agent.SnapshotTask("some-guid", []string{"/app/logs"})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.Container.StreamedPaths, DeepEquals, []string{"/app/logs"})
+
+	c.Assert(snapshot.Task, Equals, "some-guid")
+	c.Assert(snapshot.Size, Equals, uint64(len("some-archive")))
+	c.Assert(snapshot.SHA256, Equals, "4bd51f0fb046e4b390a4f4e8a85880b287dd1265c8d5e4534399ae10258ccbc4")
+	c.Assert(filepath.Dir(snapshot.Location), Equals, s.Path)
+
+	contents, err := ioutil.ReadFile(snapshot.Location)
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Equals, "some-archive")
+}
+
+func (s *SNSuite) TestSnapshotRequestReportsUnknownTasks(c *C) {
+	response := s.Agent.handleSnapshotRequest([]byte(`{"task":"other-guid","paths":["/app"]}`))
+	c.Assert(response, DeepEquals, protocol.SnapshotResponse{
+		Version: protocol.Version,
+		Error:   TaskNotRegistered.Error(),
+	})
+}
+
+func (s *SNSuite) TestOnlyTheAgentRunningATaskAnswersBroadcastSnapshotRequests(c *C) {
+	mbus := mock_cfmessagebus.NewMockMessageBus()
+
+	other, err := NewAgent(FakeTaskBackend{}, fake_gibson.NewFakeRouterClient(), 42)
+	c.Assert(err, IsNil)
+
+	other.Snapshots = s.Agent.Snapshots
+
+	err = other.HandleSnapshotRequests(mbus)
+	c.Assert(err, IsNil)
+
+	err = s.Agent.HandleSnapshotRequests(mbus)
+	c.Assert(err, IsNil)
+
+	replies := make(chan []byte, 2)
+
+	mbus.Subscribe("some-inbox", func(payload []byte) {
+		replies <- payload
+	})
+
+	mbus.PublishSync("task.snapshot", []byte(`{"task":"some-guid","paths":["/app"],"reply_to":"some-inbox"}`))
+
+	var response protocol.SnapshotResponse
+	err = json.Unmarshal(waitReceive(replies, 1*time.Second), &response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Error, Equals, "")
+	c.Assert(response.Snapshot.Task, Equals, "some-guid")
+
+	mbus.PublishSync("task.snapshot", []byte(`{"task":"bogus-guid","paths":["/app"],"reply_to":"some-inbox"}`))
+
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(replies, HasLen, 0)
+}
+
+func (s *SNSuite) TestAgentAnswersDirectedSnapshotRequestsForUnknownTasks(c *C) {
+	mbus := mock_cfmessagebus.NewMockMessageBus()
+
+	err := s.Agent.HandleSnapshotRequests(mbus)
+	c.Assert(err, IsNil)
+
+	replies := make(chan []byte, 1)
+
+	mbus.Request(protocol.SnapshotSubjectFor(s.Agent.ID.String()), []byte(`{"task":"bogus-guid","paths":["/app"]}`), func(payload []byte) {
+		replies <- payload
+	})
+
+	var response protocol.SnapshotResponse
+	err = json.Unmarshal(waitReceive(replies, 1*time.Second), &response)
+	c.Assert(err, IsNil)
+	c.Assert(response.Error, Equals, TaskNotRegistered.Error())
+}
+
+func (s *SNSuite) TestSnapshotIsRefusedWithoutAStore(c *C) {
+	s.Agent.Snapshots = nil
+
+	_, err := s.Agent.SnapshotTask("some-guid", []string{"/app"})
+	c.Assert(err, Equals, SnapshotsNotConfigured)
+}
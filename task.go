@@ -2,35 +2,105 @@ package narc
 
 import (
 	"code.google.com/p/go.crypto/ssh"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
 	"github.com/kr/pty"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type Task struct {
-	SecureToken  string
-	ProcessState *os.ProcessState
+	SecureToken     string
+	SecureTokenHash string
+	ProcessState    *os.ProcessState
+
+	Limits     TaskLimits
+	StopPolicy StopPolicy
+	StartedAt  time.Time
 
 	container Container
 	command   *exec.Cmd
 
-	onCompleteCallbacks []func()
+	onCompleteCallbacks map[int]func()
+	nextCallback        int
+	completed           bool
 
 	pty *os.File
+
+	exitReason string
+
+	// sessions are told about the task, see Broadcast
+	sessions []io.Writer
+
+	destroyOnce sync.Once
+	destroyErr  error
+
+	lock sync.RWMutex
+}
+
+const (
+	TaskStatePending   = "pending"
+	TaskStateRunning   = "running"
+	TaskStateCompleted = "completed"
+)
+
+// Exit reasons, for tasks that ran into their limits.
+const (
+	ExitReasonOutOfMemory       = "out_of_memory"
+	ExitReasonDiskQuotaExceeded = "disk_quota_exceeded"
+)
+
+// StopPolicy is how a task is stopped. PreStop is a script run in the
+// task's container once its process has been told to hang up, and
+// GracePeriod how long the process and the script have to finish before
+// the process is killed and the container destroyed.
+type StopPolicy struct {
+	PreStop     string        `json:"pre_stop,omitempty"`
+	GracePeriod time.Duration `json:"grace_period,omitempty"`
 }
 
 func NewTask(container Container, secureToken string, command *exec.Cmd) (*Task, error) {
 	return &Task{
-		SecureToken: secureToken,
+		SecureToken:     secureToken,
+		SecureTokenHash: HashSecureToken(secureToken),
+		StartedAt:       time.Now(),
 
 		container: container,
 		command:   command,
 	}, nil
 }
 
+// ResumeTask returns a task for a process that is already running on the
+// given pty, e.g. one started before narc re-executed itself. Call Watch
+// once the task's completion callbacks are in place.
+func ResumeTask(container Container, pty *os.File, process *os.Process) *Task {
+	return &Task{
+		StartedAt: time.Now(),
+
+		container: container,
+		command:   &exec.Cmd{Process: process},
+
+		pty: pty,
+	}
+}
+
+// Watch reports the completion of a resumed task.
+func (t *Task) Watch() {
+	go t.reportExit()
+}
+
 func (t *Task) Start() (io.Writer, io.Reader, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	if t.pty == nil {
 		pty, err := pty.Start(t.command)
 		if err != nil {
@@ -46,43 +116,363 @@ func (t *Task) Start() (io.Writer, io.Reader, error) {
 }
 
 func (t *Task) Attach(channel ssh.Channel) error {
-	in, out, err := t.Start()
+	_, out, err := t.Start()
 	if err != nil {
 		return err
 	}
 
+	t.lock.Lock()
+	t.sessions = append(t.sessions, channel)
+	pty := t.pty
+	t.lock.Unlock()
+
+	remove := t.OnComplete(func() { channel.Close() })
+
 	go io.Copy(channel, out)
-	go t.handleChannelRequests(in, channel)
+
+	go func() {
+		handleChannelRequests(pty, channel)
+		t.detach(channel)
+		remove()
+	}()
 
 	return nil
 }
 
+// attachConsole starts the task if it is pending and returns its pty, for a
+// session served by another process, e.g. the console relay. The session
+// is told about the task until reading from it ends, and is closed when
+// the task completes.
+func (t *Task) attachConsole(session io.ReadWriteCloser) (*os.File, error) {
+	_, _, err := t.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	t.follow(session)
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.pty, nil
+}
+
+// follow adds a session that already has the task's pty, e.g. one handed
+// off by a previous process, until reading from it ends. The session is
+// closed when the task completes.
+func (t *Task) follow(session io.ReadWriteCloser) {
+	t.lock.Lock()
+	t.sessions = append(t.sessions, session)
+	t.lock.Unlock()
+
+	remove := t.OnComplete(func() { session.Close() })
+
+	go func() {
+		io.Copy(ioutil.Discard, session)
+		t.detach(session)
+		remove()
+	}()
+}
+
+// HashSecureToken returns the hex-encoded SHA-256 of a secure token, which
+// is what gets persisted instead of the token itself.
+func HashSecureToken(secureToken string) string {
+	if secureToken == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(secureToken))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Authorize reports whether the password grants access to the task. Tasks
+// without a secure token cannot be accessed.
+func (t *Task) Authorize(password string) bool {
+	if t.SecureTokenHash == "" {
+		return false
+	}
+
+	hash := HashSecureToken(password)
+
+	return subtle.ConstantTimeCompare([]byte(t.SecureTokenHash), []byte(hash)) == 1
+}
+
+// Broadcast writes a message to every attached session.
+func (t *Task) Broadcast(message string) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for _, session := range t.sessions {
+		_, err := session.Write([]byte(message))
+		if err != nil {
+			log.Println("failed to write to session:", err)
+		}
+	}
+}
+
+func (t *Task) AttachedSessions() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return len(t.sessions)
+}
+
+func (t *Task) State() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	switch {
+	case t.ProcessState != nil:
+		return TaskStateCompleted
+	case t.pty != nil:
+		return TaskStateRunning
+	default:
+		return TaskStatePending
+	}
+}
+
+// ExitStatus returns the exit status of the task's process, and false if it
+// has not exited yet.
+func (t *Task) ExitStatus() (int, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.ProcessState == nil {
+		return 0, false
+	}
+
+	return t.ProcessState.Sys().(syscall.WaitStatus).ExitStatus(), true
+}
+
+// CurrentLimits returns the task's limits, which change if it is resized.
+func (t *Task) CurrentLimits() TaskLimits {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.Limits
+}
+
+// SetLimits records the limits a running task was resized to.
+func (t *Task) SetLimits(limits TaskLimits) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.Limits = limits
+}
+
+// ExitReason returns why the task's process exited, if it ran into one of
+// its limits, and an empty string otherwise.
+func (t *Task) ExitReason() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.exitReason
+}
+
+// running returns the pty and process of a started task that has not
+// completed.
+func (t *Task) running() (*os.File, *os.Process) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.ProcessState != nil {
+		return nil, nil
+	}
+
+	return t.pty, t.command.Process
+}
+
+// attached returns the sessions attached to the task.
+func (t *Task) attached() []io.Writer {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return append([]io.Writer{}, t.sessions...)
+}
+
+func (t *Task) detach(session io.Writer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i, attached := range t.sessions {
+		if attached == session {
+			t.sessions = append(t.sessions[:i], t.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Stop warns attached sessions, sends the task's process SIGHUP and
+// SIGTERM, and runs the pre-stop script. Whatever is still running when the
+// grace period is over is killed along with the container.
 func (t *Task) Stop() error {
-	if t.command.Process != nil {
-		t.command.Process.Kill()
+	deadline := time.Now().Add(t.StopPolicy.GracePeriod)
+
+	if t.StopPolicy.GracePeriod > 0 {
+		t.Broadcast(fmt.Sprintf("\r\nnarc: this task is being stopped; this session will end in %s\r\n", t.StopPolicy.GracePeriod))
+	} else {
+		t.Broadcast("\r\nnarc: this task is being stopped\r\n")
+	}
+
+	_, process := t.running()
+	if process != nil {
+		process.Signal(syscall.SIGHUP)
+		process.Signal(syscall.SIGTERM)
+	}
+
+	if t.StopPolicy.PreStop != "" {
+		t.runPreStop(deadline)
+	}
+
+	if process != nil {
+		for time.Now().Before(deadline) && t.State() != TaskStateCompleted {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if t.State() != TaskStateCompleted {
+			process.Kill()
+		}
 	}
 
-	return t.container.Destroy()
+	return t.destroy()
 }
 
-func (t *Task) OnComplete(callback func()) {
-	t.onCompleteCallbacks = append(t.onCompleteCallbacks, callback)
+// destroy destroys the task's container once, whether the task is stopped
+// or its process exits first.
+func (t *Task) destroy() error {
+	t.destroyOnce.Do(func() {
+		t.destroyErr = t.container.Destroy()
+	})
+
+	return t.destroyErr
+}
+
+// runPreStop runs the pre-stop script, waiting for it no longer than the
+// deadline. A script still running then is ended by destroying the
+// container.
+func (t *Task) runPreStop(deadline time.Time) {
+	done := make(chan bool, 1)
+
+	go func() {
+		info, err := t.container.Run(t.StopPolicy.PreStop)
+		if err != nil {
+			log.Printf("failed to run pre-stop script in container %s: %s\n", t.container.ID(), err)
+		} else if info.ExitStatus != 0 {
+			log.Printf("pre-stop script in container %s exited with status %d\n", t.container.ID(), info.ExitStatus)
+		}
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(deadline.Sub(time.Now())):
+		log.Printf("pre-stop script in container %s did not finish in time\n", t.container.ID())
+	}
+}
+
+// OnComplete calls the callback once the task has completed and its
+// container is destroyed, or right away if it already has. The returned
+// function removes the callback again.
+func (t *Task) OnComplete(callback func()) func() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.completed {
+		go callback()
+		return func() {}
+	}
+
+	if t.onCompleteCallbacks == nil {
+		t.onCompleteCallbacks = make(map[int]func())
+	}
+
+	id := t.nextCallback
+	t.nextCallback++
+
+	t.onCompleteCallbacks[id] = callback
+
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+
+		delete(t.onCompleteCallbacks, id)
+	}
 }
 
 func (t *Task) reportExit() {
 	t.command.Wait()
+
+	reason := t.limitReached()
+
+	t.lock.Lock()
 	t.ProcessState = t.command.ProcessState
+	t.exitReason = reason
+	t.lock.Unlock()
+
+	if reason != "" {
+		t.Broadcast(t.exitBanner(reason))
+	}
+
+	t.destroy()
 
-	t.container.Destroy()
+	t.lock.Lock()
+	t.completed = true
+	callbacks := t.onCompleteCallbacks
+	t.onCompleteCallbacks = nil
+	t.lock.Unlock()
 
-	for _, callback := range t.onCompleteCallbacks {
+	for _, callback := range callbacks {
 		go callback()
 	}
 }
 
-func (t *Task) handleChannelRequests(in io.Writer, channel ssh.Channel) error {
+// limitReached asks the container whether the task ran into its memory or
+// disk limit.
+func (t *Task) limitReached() string {
+	info, err := t.container.Info()
+	if err != nil {
+		log.Printf("failed to get info for container %s: %s\n", t.container.ID(), err)
+		return ""
+	}
+
+	switch {
+	case info.OutOfMemory:
+		return ExitReasonOutOfMemory
+
+	case info.DiskQuotaExceeded:
+		return ExitReasonDiskQuotaExceeded
+	}
+
+	return ""
+}
+
+func (t *Task) exitBanner(reason string) string {
+	limits := t.CurrentLimits()
+
+	switch reason {
+	case ExitReasonOutOfMemory:
+		return fmt.Sprintf(
+			"\r\nnarc: this session ended after a process was killed for exceeding the memory limit of %d MB\r\n",
+			limits.MemoryLimitInBytes/megabyte,
+		)
+
+	case ExitReasonDiskQuotaExceeded:
+		return fmt.Sprintf(
+			"\r\nnarc: this session ended with its disk quota of %d MB used up\r\n",
+			limits.DiskLimitInBytes/megabyte,
+		)
+	}
+
+	return ""
+}
+
+// handleChannelRequests copies a session's input to a pty, resizing the pty
+// as the session asks, until the input ends.
+func handleChannelRequests(pty *os.File, channel ssh.Channel) error {
 	for {
-		_, err := io.Copy(in, channel)
+		_, err := io.Copy(pty, channel)
 		if err == nil {
 			return err
 		}
@@ -95,13 +485,13 @@ func (t *Task) handleChannelRequests(in io.Writer, channel ssh.Channel) error {
 		ok = false
 		switch req.Request {
 		case "pty-req":
-			ok = t.handlePtyRequest(req.Payload)
+			ok = handlePtyRequest(pty, req.Payload)
 
 		case "shell":
 			ok = true
 
 		case "window-change":
-			ok = t.handleWindowChange(req.Payload)
+			ok = handleWindowChange(pty, req.Payload)
 
 		case "env":
 			ok = true
@@ -118,13 +508,13 @@ func (t *Task) handleChannelRequests(in io.Writer, channel ssh.Channel) error {
 	panic("unreachable")
 }
 
-func (t *Task) handlePtyRequest(payload []byte) bool {
+func handlePtyRequest(pty *os.File, payload []byte) bool {
 	cols, rows, ok := parsePtyRequest(payload)
 	if !ok {
 		return false
 	}
 
-	err := setWinSize(t.pty, cols, rows)
+	err := setWinSize(pty, cols, rows)
 	if err != nil {
 		return false
 	}
@@ -132,13 +522,13 @@ func (t *Task) handlePtyRequest(payload []byte) bool {
 	return true
 }
 
-func (t *Task) handleWindowChange(payload []byte) (ok bool) {
+func handleWindowChange(pty *os.File, payload []byte) (ok bool) {
 	cols, rows, ok := parseWindowChange(payload)
 	if !ok {
 		return
 	}
 
-	err := setWinSize(t.pty, cols, rows)
+	err := setWinSize(pty, cols, rows)
 	if err != nil {
 		ok = false
 	}
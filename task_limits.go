@@ -1,10 +1,66 @@
 package narc
 
+// TaskLimits are the resources a task's container may use. Memory and disk
+// are required; the other limits are left to the backend when zero.
 type TaskLimits struct {
 	MemoryLimitInBytes uint64
 	DiskLimitInBytes   uint64
+
+	// CPUShares weighs the task's CPU time against other tasks'.
+	CPUShares uint64
+
+	// CPUQuotaInPercent caps the task's CPU time, in percent of one CPU.
+	CPUQuotaInPercent uint64
+
+	// PIDLimit caps the number of processes in the task's container.
+	PIDLimit uint64
+
+	// FDLimit caps the number of files each of the task's processes may
+	// have open.
+	FDLimit uint64
+
+	// InboundBandwidth and OutboundBandwidth cap the task's network
+	// traffic, in bytes per second.
+	InboundBandwidth  uint64
+	OutboundBandwidth uint64
 }
 
 func (limits *TaskLimits) IsValid() bool {
 	return limits.MemoryLimitInBytes > 0 && limits.DiskLimitInBytes > 0
 }
+
+// WithDefaults returns the limits with any unset CPU, PID and file
+// descriptor limit taken from defaults.
+func (limits TaskLimits) WithDefaults(defaults TaskLimits) TaskLimits {
+	if limits.CPUShares == 0 {
+		limits.CPUShares = defaults.CPUShares
+	}
+
+	if limits.CPUQuotaInPercent == 0 {
+		limits.CPUQuotaInPercent = defaults.CPUQuotaInPercent
+	}
+
+	if limits.PIDLimit == 0 {
+		limits.PIDLimit = defaults.PIDLimit
+	}
+
+	if limits.FDLimit == 0 {
+		limits.FDLimit = defaults.FDLimit
+	}
+
+	return limits
+}
+
+// Exceeds reports whether any CPU, PID or file descriptor limit is above
+// its maximum, or unset where a maximum is. Unset maximums are not
+// enforced.
+func (limits TaskLimits) Exceeds(maximums TaskLimits) bool {
+	return exceeds(limits.CPUShares, maximums.CPUShares) ||
+		exceeds(limits.CPUQuotaInPercent, maximums.CPUQuotaInPercent) ||
+		exceeds(limits.PIDLimit, maximums.PIDLimit) ||
+		exceeds(limits.FDLimit, maximums.FDLimit)
+}
+
+func exceeds(limit, maximum uint64) bool {
+	return maximum > 0 && (limit == 0 || limit > maximum)
+}
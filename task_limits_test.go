@@ -25,3 +25,25 @@ func (s *TLSuite) TestTaskLimitsInvalidWhenDiskIsNonPositive(c *C) {
 	task := TaskLimits{MemoryLimitInBytes: 999, DiskLimitInBytes: 0}
 	c.Assert(task.IsValid(), Equals, false)
 }
+
+func (s *TLSuite) TestTaskLimitsWithDefaultsOnlyFillsUnsetLimits(c *C) {
+	limits := TaskLimits{MemoryLimitInBytes: 1, DiskLimitInBytes: 2, CPUShares: 10, FDLimit: 20}
+
+	c.Assert(limits.WithDefaults(TaskLimits{CPUShares: 1, CPUQuotaInPercent: 2, PIDLimit: 3, FDLimit: 4}), DeepEquals, TaskLimits{
+		MemoryLimitInBytes: 1,
+		DiskLimitInBytes:   2,
+		CPUShares:          10,
+		CPUQuotaInPercent:  2,
+		PIDLimit:           3,
+		FDLimit:            20,
+	})
+}
+
+func (s *TLSuite) TestTaskLimitsExceedMaximums(c *C) {
+	limits := TaskLimits{CPUShares: 10, PIDLimit: 100}
+
+	c.Assert(limits.Exceeds(TaskLimits{}), Equals, false)
+	c.Assert(limits.Exceeds(TaskLimits{CPUShares: 10, PIDLimit: 100}), Equals, false)
+	c.Assert(limits.Exceeds(TaskLimits{PIDLimit: 99}), Equals, true)
+	c.Assert(limits.Exceeds(TaskLimits{FDLimit: 1024}), Equals, true)
+}
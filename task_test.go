@@ -2,7 +2,10 @@ package narc
 
 import (
 	"code.google.com/p/go.crypto/ssh"
+	"io"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
+	"net"
 	"os"
 	"os/exec"
 	"syscall"
@@ -253,3 +256,293 @@ func (s *TSuite) TestTaskStopDoesNotReportCompletionOfUnstartedTasks(c *C) {
 	case <-time.After(100 * time.Millisecond):
 	}
 }
+
+func (s *TSuite) TestTaskReportsCompletionToLateCallbacks(c *C) {
+	task, _ := NewTask(&FakeContainer{}, "floofy_flubber", exec.Command("bash", "-c", "exit 0"))
+
+	done := make(chan bool)
+
+	task.OnComplete(func() { done <- true })
+
+	_, _, err := task.Start()
+	c.Assert(err, IsNil)
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		c.Fatal("Was not notified of task completion!")
+	}
+
+	called := make(chan bool)
+
+	task.OnComplete(func() { called <- true })
+
+	select {
+	case <-called:
+	case <-time.After(1 * time.Second):
+		c.Error("Late callback was not called!")
+	}
+}
+
+func (s *TSuite) TestTaskClosesFollowingSessionsWhenItCompletes(c *C) {
+	task, _ := NewTask(&FakeContainer{}, "floofy_flubber", exec.Command("sleep", "100"))
+
+	_, _, err := task.Start()
+	c.Assert(err, IsNil)
+
+	session, peer := net.Pipe()
+
+	closed := make(chan bool)
+
+	go func() {
+		ioutil.ReadAll(peer)
+		closed <- true
+	}()
+
+	task.follow(session)
+
+	task.Stop()
+
+	select {
+	case <-closed:
+	case <-time.After(1 * time.Second):
+		c.Error("Session was not closed!")
+	}
+}
+
+func (s *TSuite) TestTaskForgetsDetachedSessions(c *C) {
+	task, _ := NewTask(&FakeContainer{}, "floofy_flubber", exec.Command("sleep", "100"))
+
+	_, _, err := task.Start()
+	c.Assert(err, IsNil)
+
+	defer task.Stop()
+
+	session, peer := net.Pipe()
+
+	task.follow(session)
+
+	c.Assert(task.AttachedSessions(), Equals, 1)
+
+	peer.Close()
+
+	for i := 0; i < 100 && task.completionCallbacks() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(task.AttachedSessions(), Equals, 0)
+	c.Assert(task.completionCallbacks(), Equals, 0)
+}
+
+func (s *TSuite) TestTaskStopWarnsSessionsAndRunsThePreStopScript(c *C) {
+	container := &FakeContainer{}
+
+	task, _ := NewTask(container, "floofy_flubber", exec.Command("sleep", "100"))
+	task.StopPolicy = StopPolicy{PreStop: "some-cleanup", GracePeriod: 1 * time.Second}
+
+	channel := NewFakeChannel([]ssh.ChannelRequest{})
+
+	reader := NewExpector(channel.readPipe, 1*time.Second)
+
+	// the fake channel detaches as soon as it is attached
+	task.sessions = []io.Writer{channel}
+
+	_, _, err := task.Start()
+	c.Assert(err, IsNil)
+
+	go task.Stop()
+
+	expect(c, reader, `this task is being stopped; this session will end in 1s`)
+
+	for i := 0; i < 10 && !container.IsDestroyed(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	c.Assert(container.IsDestroyed(), Equals, true)
+	c.Assert(container.LastCommand, Equals, "some-cleanup")
+}
+
+func (s *TSuite) TestTaskDestroysItsContainerOnce(c *C) {
+	container := &FakeContainer{}
+
+	task, _ := NewTask(container, "floofy_flubber", exec.Command("sleep", "100"))
+
+	done := make(chan bool)
+
+	task.OnComplete(func() { done <- true })
+
+	_, _, err := task.Start()
+	c.Assert(err, IsNil)
+
+	err = task.Stop()
+	c.Assert(err, IsNil)
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		c.Fatal("Was not notified of task completion!")
+	}
+
+	c.Assert(container.Destroys(), Equals, 1)
+}
+
+func (s *TSuite) TestTaskStopGivesTheProcessTheGracePeriodToExit(c *C) {
+	container := &FakeContainer{}
+
+	task, _ := NewTask(container, "floofy_flubber", exec.Command("bash", "-c", `trap "sleep 0.2; exit 7" HUP TERM; sleep 100 & wait`))
+	task.StopPolicy = StopPolicy{GracePeriod: 2 * time.Second}
+
+	_, _, err := task.Start()
+	c.Assert(err, IsNil)
+
+	// give bash time to set up its trap
+	time.Sleep(100 * time.Millisecond)
+
+	err = task.Stop()
+	c.Assert(err, IsNil)
+
+	status, exited := task.ExitStatus()
+	c.Assert(exited, Equals, true)
+	c.Assert(status, Equals, 7)
+}
+
+func (s *TSuite) TestTaskStopKillsTheProcessAfterTheGracePeriod(c *C) {
+	container := &FakeContainer{}
+
+	task, _ := NewTask(container, "floofy_flubber", exec.Command("bash", "-c", `trap "" HUP TERM; sleep 100`))
+	task.StopPolicy = StopPolicy{GracePeriod: 200 * time.Millisecond}
+
+	done := make(chan bool)
+
+	task.OnComplete(func() { done <- true })
+
+	_, _, err := task.Start()
+	c.Assert(err, IsNil)
+
+	time.Sleep(100 * time.Millisecond)
+
+	err = task.Stop()
+	c.Assert(err, IsNil)
+
+	select {
+	case <-done:
+		c.Assert(task.ProcessState.Sys().(syscall.WaitStatus).Signal(), Equals, syscall.SIGKILL)
+	case <-time.After(1 * time.Second):
+		c.Error("Was not notified of task completion!")
+	}
+}
+
+func (s *TSuite) TestTaskReportsStateAndExitStatus(c *C) {
+	container := &FakeContainer{}
+	task, _ := NewTask(
+		container,
+		"floofy_flubber",
+		exec.Command("bash", "-c", "read foo; exit 3"),
+	)
+
+	c.Assert(task.State(), Equals, "pending")
+
+	_, found := task.ExitStatus()
+	c.Assert(found, Equals, false)
+
+	done := make(chan bool)
+
+	task.OnComplete(func() { done <- true })
+
+	in, _, err := task.Start()
+	c.Assert(err, IsNil)
+
+	c.Assert(task.State(), Equals, "running")
+
+	in.Write([]byte("\n"))
+
+	select {
+	case <-done:
+		c.Assert(task.State(), Equals, "completed")
+
+		status, found := task.ExitStatus()
+		c.Assert(found, Equals, true)
+		c.Assert(status, Equals, 3)
+	case <-time.After(1 * time.Second):
+		c.Error("Was not notified of task completion!")
+	}
+}
+
+func (s *TSuite) TestTaskReportsRunningOutOfMemory(c *C) {
+	container := &FakeContainer{Usage: ContainerInfo{OutOfMemory: true}}
+	task, _ := NewTask(container, "floofy_flubber", exec.Command("sleep", "0.1"))
+	task.Limits = TaskLimits{MemoryLimitInBytes: 256 * megabyte, DiskLimitInBytes: megabyte}
+
+	done := make(chan bool)
+
+	task.OnComplete(func() { done <- true })
+
+	channel := NewFakeChannel([]ssh.ChannelRequest{})
+
+	reader := NewExpector(channel.readPipe, 1*time.Second)
+
+	// the fake channel detaches as soon as it is attached
+	task.sessions = []io.Writer{channel}
+
+	_, _, err := task.Start()
+	c.Assert(err, IsNil)
+
+	expect(c, reader, `exceeding the memory limit of 256 MB`)
+
+	select {
+	case <-done:
+		c.Assert(task.ExitReason(), Equals, ExitReasonOutOfMemory)
+	case <-time.After(1 * time.Second):
+		c.Error("Was not notified of task completion!")
+	}
+}
+
+func (s *TSuite) TestTaskReportsAFullDisk(c *C) {
+	container := &FakeContainer{Usage: ContainerInfo{DiskUsageInBytes: 2 * megabyte}}
+	task, _ := NewTask(container, "floofy_flubber", exec.Command("true"))
+	task.Limits = TaskLimits{MemoryLimitInBytes: megabyte, DiskLimitInBytes: megabyte}
+
+	// usage past the nominal limit is not a full disk unless the backend
+	// enforces the quota and says so
+	c.Assert(task.limitReached(), Equals, "")
+
+	container.Usage.DiskQuotaExceeded = true
+	c.Assert(task.limitReached(), Equals, ExitReasonDiskQuotaExceeded)
+}
+
+func (s *TSuite) TestTaskCountsAttachedSessions(c *C) {
+	container := &FakeContainer{}
+	task, _ := NewTask(container, "floofy_flubber", exec.Command("sleep", "100"))
+
+	defer task.Stop()
+
+	channel := NewFakeChannel([]ssh.ChannelRequest{})
+
+	err := task.Attach(channel)
+	c.Assert(err, IsNil)
+
+	detached := make(chan bool)
+
+	go func() {
+		for task.AttachedSessions() != 0 {
+			time.Sleep(1 * time.Millisecond)
+		}
+
+		detached <- true
+	}()
+
+	select {
+	case <-detached:
+	case <-time.After(1 * time.Second):
+		c.Error("Session was not detached when its input ended.")
+	}
+}
+
+func (s *TSuite) TestTaskAuthorize(c *C) {
+	task, _ := NewTask(&FakeContainer{}, "floofy_flubber", exec.Command("ls"))
+	c.Assert(task.Authorize("floofy_flubber"), Equals, true)
+	c.Assert(task.Authorize("bogus"), Equals, false)
+
+	tokenless, _ := NewTask(&FakeContainer{}, "", exec.Command("ls"))
+	c.Assert(tokenless.Authorize(""), Equals, false)
+}
@@ -1,35 +1,160 @@
 package narc
 
 import (
+	"code.google.com/p/goprotobuf/proto"
 	"github.com/cloudfoundry/gordon"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type WardenContainer struct {
-	Handle           string
-	client           *warden.Client
-	wardenSocketPath string
+	Handle        string
+	HostPort      uint32
+	ContainerPort uint32
+
+	// Limits are the limits the container was created with. Warden cannot
+	// limit processes or open files per container, so sessions apply the
+	// PID and file descriptor limits as rlimits.
+	Limits TaskLimits
+
+	client             *warden.Client
+	connectionProvider warden.ConnectionProvider
+}
+
+// NewWardenContainer creates a container through the warden server,
+// limiting its memory and disk and mapping a port into it.
+func NewWardenContainer(connectionProvider warden.ConnectionProvider, spec ContainerSpec) (*WardenContainer, error) {
+	conn, err := connectionProvider.ProvideConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	createResponse := &warden.CreateResponse{}
+
+	_, err = conn.RoundTrip(createRequest(spec), createResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	container := &WardenContainer{
+		Handle:             createResponse.GetHandle(),
+		Limits:             spec.Limits,
+		connectionProvider: connectionProvider,
+	}
+
+	err = container.setUp(conn, spec)
+	if err != nil {
+		destroyErr := container.Destroy()
+		if destroyErr != nil {
+			log.Printf("failed to destroy container %s: %s\n", container.Handle, destroyErr)
+		}
+
+		return nil, err
+	}
+
+	return container, nil
 }
 
-func NewWardenContainer(wardenSocketPath string, limits TaskLimits, cmdRunner ContainerCreationRunner) (*WardenContainer, error) {
+// NewScriptedWardenContainer creates a container by running an external
+// executable, which is given a CreateContainerMessage as JSON on stdin and
+// must print a CreateContainerResponse as JSON on stdout.
+func NewScriptedWardenContainer(wardenSocketPath string, spec ContainerSpec, cmdRunner ContainerCreationRunner, executable string) (*WardenContainer, error) {
 	message := CreateContainerMessage{
 		WardenSocketPath: wardenSocketPath,
-		MemoryLimit:      limits.MemoryLimitInBytes,
-		DiskLimit:        limits.DiskLimitInBytes,
-		Network:          true,
+		Handle:           spec.ContainerHandle(),
+		Properties:       containerProperties(spec),
+		Image:            spec.Image,
+		BindMounts:       bindMountMessages(spec.BindMounts),
+		MemoryLimit:      spec.Limits.MemoryLimitInBytes,
+		DiskLimit:        spec.Limits.DiskLimitInBytes,
+		CPUShares:        spec.Limits.CPUShares,
+		CPUQuota:         spec.Limits.CPUQuotaInPercent,
+		PIDLimit:         spec.Limits.PIDLimit,
+		FDLimit:          spec.Limits.FDLimit,
+
+		InboundBandwidth:  spec.Limits.InboundBandwidth,
+		OutboundBandwidth: spec.Limits.OutboundBandwidth,
+
+		Network:      spec.Network.Mode != NetworkNone,
+		NetworkMode:  string(spec.Network.Mode),
+		NetworkAllow: networkRuleMessages(spec.Network.Allow),
 	}
 	var response CreateContainerResponse
-	err := cmdRunner.Run(&message, &response, "create_warden_container.sh")
+	err := cmdRunner.Run(&message, &response, executable)
 
 	if err != nil {
 		return nil, err
 	}
 
 	return &WardenContainer{
-		Handle:           response.Handle,
-		wardenSocketPath: wardenSocketPath,
+		Handle:             response.Handle,
+		HostPort:           uint32(response.HostPort),
+		ContainerPort:      uint32(response.ContainerPort),
+		Limits:             spec.Limits,
+		connectionProvider: &warden.ConnectionInfo{SocketPath: wardenSocketPath},
 	}, nil
 }
 
+// RestoreWardenContainer reconnects to an existing container, failing if
+// the warden server no longer knows about it.
+func RestoreWardenContainer(connectionProvider warden.ConnectionProvider, handle string) (*WardenContainer, error) {
+	container := &WardenContainer{
+		Handle:             handle,
+		connectionProvider: connectionProvider,
+	}
+
+	client, err := container.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = client.Info(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	return container, nil
+}
+
+// ListWardenContainers returns the containers the given agent created in
+// the warden server.
+func ListWardenContainers(connectionProvider warden.ConnectionProvider, owner string) ([]*WardenContainer, error) {
+	conn, err := connectionProvider.ProvideConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	res := &warden.ListResponse{}
+
+	_, err = conn.RoundTrip(listRequest(owner), res)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := []*WardenContainer{}
+
+	for _, handle := range res.GetHandles() {
+		if !strings.HasPrefix(handle, ContainerHandlePrefix) {
+			continue
+		}
+
+		containers = append(containers, &WardenContainer{
+			Handle:             handle,
+			connectionProvider: connectionProvider,
+		})
+	}
+
+	return containers, nil
+}
+
 func (c *WardenContainer) ID() string {
 	return c.Handle
 }
@@ -56,15 +181,183 @@ func (c *WardenContainer) Run(script string) (*JobInfo, error) {
 
 	return &JobInfo{
 		ExitStatus: res.GetExitStatus(),
+		Stdout:     []byte(res.GetStdout()),
+		Stderr:     []byte(res.GetStderr()),
+	}, nil
+}
+
+func (c *WardenContainer) Spawn(script string) (uint32, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := client.Spawn(c.Handle, script, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.GetJobId(), nil
+}
+
+func (c *WardenContainer) Stream(jobID uint32) (*JobStream, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	responses, err := client.Stream(c.Handle, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamWardenJob(responses), nil
+}
+
+// StreamOut spawns tar in the container and streams its output.
+func (c *WardenContainer) StreamOut(paths []string) (io.ReadCloser, error) {
+	jobID, err := c.Spawn(tarScript(paths))
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := c.Stream(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	return newArchiveStream(job), nil
+}
+
+func (c *WardenContainer) Link(jobID uint32) (*JobInfo, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Link(c.Handle, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JobInfo{
+		ExitStatus: res.GetExitStatus(),
+		Stdout:     []byte(res.GetStdout()),
+		Stderr:     []byte(res.GetStderr()),
 	}, nil
 }
 
+func (c *WardenContainer) LimitMemory(limitInBytes uint64) error {
+	client, err := c.getClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.LimitMemory(c.Handle, limitInBytes)
+	return err
+}
+
+func (c *WardenContainer) LimitDisk(limitInBytes uint64) error {
+	client, err := c.getClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.LimitDisk(c.Handle, limitInBytes)
+	return err
+}
+
+func (c *WardenContainer) RestoreLimits(limits TaskLimits) {
+	c.Limits = limits
+}
+
+func (c *WardenContainer) Info() (*ContainerInfo, error) {
+	client, err := c.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Info(c.Handle)
+	if err != nil {
+		return nil, err
+	}
+
+	info := wardenContainerInfo(res)
+
+	// warden's info does not include the container's limits
+	info.MemoryLimitInBytes, err = client.GetMemoryLimit(c.Handle)
+	if err != nil {
+		return nil, err
+	}
+
+	info.DiskLimitInBytes, err = client.GetDiskLimit(c.Handle)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// wardenContainerInfo converts warden's info. Warden does not count network
+// traffic, only reports its configured rates.
+func wardenContainerInfo(res *warden.InfoResponse) *ContainerInfo {
+	memory := res.GetMemoryStat()
+
+	info := &ContainerInfo{
+		MemoryUsageInBytes: memory.GetTotalRss() + memory.GetTotalCache(),
+		DiskUsageInBytes:   res.GetDiskStat().GetBytesUsed(),
+		CPUTime:            time.Duration(res.GetCpuStat().GetUsage()),
+		Processes:          len(res.GetJobIds()),
+	}
+
+	for _, event := range res.GetEvents() {
+		if event == "out of memory" {
+			info.OutOfMemory = true
+		}
+	}
+
+	return info
+}
+
+// streamWardenJob copies a job's streamed output to a JobStream until the
+// warden server sends its exit status.
+func streamWardenJob(responses chan *warden.StreamResponse) *JobStream {
+	stream, stdout, stderr := newJobStream()
+
+	go func() {
+		for response := range responses {
+			switch response.GetName() {
+			case "stdout":
+				stdout.Write([]byte(response.GetData()))
+			case "stderr":
+				stderr.Write([]byte(response.GetData()))
+			}
+
+			if response.ExitStatus != nil {
+				stdout.Close()
+				stderr.Close()
+
+				stream.exited <- jobExit{status: response.GetExitStatus()}
+
+				return
+			}
+		}
+
+		stdout.CloseWithError(JobStreamInterrupted)
+		stderr.CloseWithError(JobStreamInterrupted)
+
+		stream.exited <- jobExit{err: JobStreamInterrupted}
+	}()
+
+	return stream
+}
+
 func (c *WardenContainer) getClient() (*warden.Client, error) {
 	if c.client != nil {
 		return c.client, nil
 	}
 
-	c.client = warden.NewClient(&warden.ConnectionInfo{SocketPath: c.wardenSocketPath})
+	c.client = warden.NewClient(c.connectionProvider)
 
 	err := c.client.Connect()
 	if err != nil {
@@ -73,3 +366,225 @@ func (c *WardenContainer) getClient() (*warden.Client, error) {
 
 	return c.client, nil
 }
+
+func (c *WardenContainer) setUp(conn *warden.Connection, spec ContainerSpec) error {
+	_, err := conn.RoundTrip(
+		&warden.LimitMemoryRequest{
+			Handle:       proto.String(c.Handle),
+			LimitInBytes: proto.Uint64(spec.Limits.MemoryLimitInBytes),
+		},
+		&warden.LimitMemoryResponse{},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.RoundTrip(
+		&warden.LimitDiskRequest{
+			Handle:    proto.String(c.Handle),
+			ByteLimit: proto.Uint64(spec.Limits.DiskLimitInBytes),
+		},
+		&warden.LimitDiskResponse{},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Warden only weighs CPU time; it has no quota.
+	if spec.Limits.CPUShares > 0 {
+		_, err = conn.RoundTrip(
+			&warden.LimitCpuRequest{
+				Handle:        proto.String(c.Handle),
+				LimitInShares: proto.Uint64(spec.Limits.CPUShares),
+			},
+			&warden.LimitCpuResponse{},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	rate := wardenBandwidthRate(spec.Limits)
+	if rate > 0 {
+		_, err = conn.RoundTrip(
+			&warden.LimitBandwidthRequest{
+				Handle: proto.String(c.Handle),
+				Rate:   proto.Uint64(rate),
+				Burst:  proto.Uint64(rate),
+			},
+			&warden.LimitBandwidthResponse{},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.setUpNetwork(conn, spec.Network)
+}
+
+// setUpNetwork maps a port into containers with the default network, and
+// allows outbound traffic from egress and allow-list containers. Anything
+// else is denied by the warden server's own rules; WardenTaskBackend only
+// asks for the "none" and "allow" policies if it checked that they are.
+func (c *WardenContainer) setUpNetwork(conn *warden.Connection, policy NetworkPolicy) error {
+	switch policy.Mode {
+	case NetworkDefault:
+		netInResponse := &warden.NetInResponse{}
+
+		_, err := conn.RoundTrip(
+			&warden.NetInRequest{Handle: proto.String(c.Handle)},
+			netInResponse,
+		)
+		if err != nil {
+			return err
+		}
+
+		c.HostPort = netInResponse.GetHostPort()
+		c.ContainerPort = netInResponse.GetContainerPort()
+
+	case NetworkEgress:
+		return c.netOut(conn, NetworkRule{Network: "0.0.0.0/0"})
+
+	case NetworkAllowList:
+		for _, rule := range policy.Allow {
+			err := c.netOut(conn, rule)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *WardenContainer) netOut(conn *warden.Connection, rule NetworkRule) error {
+	request := &warden.NetOutRequest{
+		Handle:  proto.String(c.Handle),
+		Network: proto.String(rule.Network),
+	}
+
+	if strings.Contains(rule.Ports, "-") {
+		request.PortRange = proto.String(strings.Replace(rule.Ports, "-", ":", 1))
+	} else if rule.Ports != "" {
+		port, err := strconv.ParseUint(rule.Ports, 10, 16)
+		if err != nil {
+			return err
+		}
+
+		request.Port = proto.Uint32(uint32(port))
+	}
+
+	_, err := conn.RoundTrip(request, &warden.NetOutResponse{})
+
+	return err
+}
+
+// wardenBandwidthRate returns the rate to limit a container's bandwidth to.
+// Warden limits both directions to the same rate, so the lower of the two
+// limits is used.
+func wardenBandwidthRate(limits TaskLimits) uint64 {
+	rate := limits.InboundBandwidth
+
+	if rate == 0 || (limits.OutboundBandwidth > 0 && limits.OutboundBandwidth < rate) {
+		rate = limits.OutboundBandwidth
+	}
+
+	return rate
+}
+
+func createRequest(spec ContainerSpec) *warden.CreateRequest {
+	request := &warden.CreateRequest{
+		Handle: proto.String(spec.ContainerHandle()),
+	}
+
+	if spec.Image != "" {
+		request.Rootfs = proto.String(spec.Image)
+	}
+
+	properties := containerProperties(spec)
+
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		request.Properties = append(request.Properties, &warden.Property{
+			Key:   proto.String(key),
+			Value: proto.String(properties[key]),
+		})
+	}
+
+	for _, mount := range spec.BindMounts {
+		mode := warden.CreateRequest_BindMount_RW
+		if mount.ReadOnly {
+			mode = warden.CreateRequest_BindMount_RO
+		}
+
+		request.BindMounts = append(request.BindMounts, &warden.CreateRequest_BindMount{
+			SrcPath: proto.String(mount.SrcPath),
+			DstPath: proto.String(mount.DstPath),
+			Mode:    mode.Enum(),
+		})
+	}
+
+	return request
+}
+
+func listRequest(owner string) *warden.ListRequest {
+	return &warden.ListRequest{
+		Properties: []*warden.Property{
+			{Key: proto.String("agent"), Value: proto.String(owner)},
+		},
+	}
+}
+
+func networkRuleMessages(rules []NetworkRule) []NetworkRuleMessage {
+	var messages []NetworkRuleMessage
+
+	for _, rule := range rules {
+		messages = append(messages, NetworkRuleMessage{
+			Network: rule.Network,
+			Ports:   rule.Ports,
+		})
+	}
+
+	return messages
+}
+
+func bindMountMessages(mounts []BindMount) []BindMountMessage {
+	var messages []BindMountMessage
+
+	for _, mount := range mounts {
+		mode := "rw"
+		if mount.ReadOnly {
+			mode = "ro"
+		}
+
+		messages = append(messages, BindMountMessage{
+			SrcPath: mount.SrcPath,
+			DstPath: mount.DstPath,
+			Mode:    mode,
+		})
+	}
+
+	return messages
+}
+
+// containerProperties are recorded on containers when they are created.
+// The agent property names the agent that owns the container, so agents
+// sharing a backend only reconcile their own containers.
+func containerProperties(spec ContainerSpec) map[string]string {
+	properties := map[string]string{
+		"owner": "narc",
+		"task":  spec.Task,
+	}
+
+	if spec.Owner != "" {
+		properties["agent"] = spec.Owner
+	}
+
+	return properties
+}
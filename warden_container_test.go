@@ -1,7 +1,11 @@
 package narc
 
 import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
 	"errors"
+	"github.com/cloudfoundry/gordon"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
 )
 
@@ -37,36 +41,212 @@ func init() {
 }
 
 func (s *WCSuite) TestNewWardenSendCorrectMessage(c *C) {
-	NewWardenContainer("a_socket", TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20}, &s.fakeCmdWithJson)
+	NewScriptedWardenContainer("a_socket", ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20},
+	}, &s.fakeCmdWithJson, "create_warden_container.sh")
 
 	c.Assert(s.fakeCmdWithJson.cmd, Equals, "create_warden_container.sh")
 	c.Assert(s.fakeCmdWithJson.request, DeepEquals, &CreateContainerMessage{
 		WardenSocketPath: "a_socket",
-		DiskLimit:        20,
-		MemoryLimit:      10,
-		Network:          true,
+		Handle:           "narc-some-guid",
+		Properties: map[string]string{
+			"owner": "narc",
+			"task":  "some-guid",
+		},
+		DiskLimit:   20,
+		MemoryLimit: 10,
+		Network:     true,
 	})
 }
 
+func (s *WCSuite) TestNewWardenSendsTheNetworkPolicy(c *C) {
+	NewScriptedWardenContainer("a_socket", ContainerSpec{
+		Task: "some-guid",
+		Limits: TaskLimits{
+			MemoryLimitInBytes: 10,
+			DiskLimitInBytes:   20,
+			InboundBandwidth:   100,
+			OutboundBandwidth:  200,
+		},
+		Network: NetworkPolicy{
+			Mode:  NetworkAllowList,
+			Allow: []NetworkRule{{Network: "10.0.0.0/8", Ports: "443"}},
+		},
+	}, &s.fakeCmdWithJson, "create_warden_container.sh")
+
+	request := s.fakeCmdWithJson.request
+	c.Assert(request.InboundBandwidth, Equals, uint64(100))
+	c.Assert(request.OutboundBandwidth, Equals, uint64(200))
+	c.Assert(request.Network, Equals, true)
+	c.Assert(request.NetworkMode, Equals, "allow")
+	c.Assert(request.NetworkAllow, DeepEquals, []NetworkRuleMessage{{Network: "10.0.0.0/8", Ports: "443"}})
+
+	NewScriptedWardenContainer("a_socket", ContainerSpec{
+		Task:    "some-guid",
+		Network: NetworkPolicy{Mode: NetworkNone},
+	}, &s.fakeCmdWithJson, "create_warden_container.sh")
+
+	c.Assert(s.fakeCmdWithJson.request.Network, Equals, false)
+}
+
+func (s *WCSuite) TestWardenBackendRefusesUnenforceableNetworkPolicies(c *C) {
+	backend := WardenTaskBackend{ContainerCreationScript: "create_warden_container.sh"}
+
+	for _, mode := range []NetworkMode{NetworkNone, NetworkAllowList} {
+		_, err := backend.ProvideContainer(ContainerSpec{Task: "some-guid", Network: NetworkPolicy{Mode: mode}})
+		c.Assert(err, Equals, NetworkPolicyNotSupported)
+	}
+}
+
+func (s *WCSuite) TestWardenBandwidthRateIsTheLowerLimit(c *C) {
+	c.Assert(wardenBandwidthRate(TaskLimits{}), Equals, uint64(0))
+	c.Assert(wardenBandwidthRate(TaskLimits{InboundBandwidth: 100}), Equals, uint64(100))
+	c.Assert(wardenBandwidthRate(TaskLimits{OutboundBandwidth: 200}), Equals, uint64(200))
+	c.Assert(wardenBandwidthRate(TaskLimits{InboundBandwidth: 300, OutboundBandwidth: 200}), Equals, uint64(200))
+}
+
 func (s *WCSuite) TestNewWardenHandlesErrorsInResponse(c *C) {
 	expectedError := errors.New("adad")
 	s.fakeCmdWithJson.stubErr = expectedError
-	_, err := NewWardenContainer("a_socket", TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20}, &s.fakeCmdWithJson)
+	_, err := NewScriptedWardenContainer("a_socket", ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20},
+	}, &s.fakeCmdWithJson, "create_warden_container.sh")
 	c.Assert(err, Equals, expectedError)
 }
 
 func (s *WCSuite) TestNewWardenHandlesNoErrorsInResponse(c *C) {
 	s.fakeCmdWithJson.stubHandle = "abc"
 	s.fakeCmdWithJson.stubErr = nil
-	container, err := NewWardenContainer("a_socket",
-		TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20},
-		&s.fakeCmdWithJson)
+	container, err := NewScriptedWardenContainer("a_socket", ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20},
+	}, &s.fakeCmdWithJson, "create_warden_container.sh")
 	c.Assert(err, IsNil)
 	c.Assert(container.ID(), Equals, "abc")
 }
 
+func (s *WCSuite) TestNewWardenContainerCreatesThroughWarden(c *C) {
+	writeBuffer := bytes.NewBuffer([]byte{})
+
+	provider := &FakeConnectionProvider{
+		ReadBuffer: messages(
+			&warden.CreateResponse{Handle: proto.String("narc-some-guid")},
+			&warden.LimitMemoryResponse{LimitInBytes: proto.Uint64(10)},
+			&warden.LimitDiskResponse{ByteLimit: proto.Uint64(20)},
+			&warden.NetInResponse{HostPort: proto.Uint32(7331), ContainerPort: proto.Uint32(8080)},
+		),
+		WriteBuffer: writeBuffer,
+	}
+
+	container, err := NewWardenContainer(provider, ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20},
+		BindMounts: []BindMount{
+			{SrcPath: "/var/droplets/app", DstPath: "/home/vcap/app", ReadOnly: true},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	c.Assert(container.ID(), Equals, "narc-some-guid")
+	c.Assert(container.HostPort, Equals, uint32(7331))
+	c.Assert(container.ContainerPort, Equals, uint32(8080))
+
+	c.Assert(string(writeBuffer.Bytes()), Equals, string(messages(
+		&warden.CreateRequest{
+			Handle: proto.String("narc-some-guid"),
+			Properties: []*warden.Property{
+				{Key: proto.String("owner"), Value: proto.String("narc")},
+				{Key: proto.String("task"), Value: proto.String("some-guid")},
+			},
+			BindMounts: []*warden.CreateRequest_BindMount{
+				{
+					SrcPath: proto.String("/var/droplets/app"),
+					DstPath: proto.String("/home/vcap/app"),
+					Mode:    warden.CreateRequest_BindMount_RO.Enum(),
+				},
+			},
+		},
+		&warden.LimitMemoryRequest{
+			Handle:       proto.String("narc-some-guid"),
+			LimitInBytes: proto.Uint64(10),
+		},
+		&warden.LimitDiskRequest{
+			Handle:    proto.String("narc-some-guid"),
+			ByteLimit: proto.Uint64(20),
+		},
+		&warden.NetInRequest{Handle: proto.String("narc-some-guid")},
+	).Bytes()))
+}
+
+func (s *WCSuite) TestCreateRequestUsesTheImageAsRootfs(c *C) {
+	c.Assert(createRequest(ContainerSpec{Task: "some-guid"}).Rootfs, IsNil)
+
+	request := createRequest(ContainerSpec{Task: "some-guid", Image: "/some/rootfs"})
+	c.Assert(request.GetRootfs(), Equals, "/some/rootfs")
+}
+
+func (s *WCSuite) TestContainersAreListedByTheAgentThatCreatedThem(c *C) {
+	request := createRequest(ContainerSpec{Task: "some-guid", Owner: "some-agent"})
+	c.Assert(request.Properties, DeepEquals, []*warden.Property{
+		{Key: proto.String("agent"), Value: proto.String("some-agent")},
+		{Key: proto.String("owner"), Value: proto.String("narc")},
+		{Key: proto.String("task"), Value: proto.String("some-guid")},
+	})
+
+	c.Assert(listRequest("some-agent").Properties, DeepEquals, []*warden.Property{
+		{Key: proto.String("agent"), Value: proto.String("some-agent")},
+	})
+}
+
+func (s *WCSuite) TestNewWardenContainerFailsWithoutConnection(c *C) {
+	_, err := NewWardenContainer(&FailingConnectionProvider{}, ContainerSpec{
+		Task:   "some-guid",
+		Limits: TaskLimits{MemoryLimitInBytes: 10, DiskLimitInBytes: 20},
+	})
+	c.Assert(err, NotNil)
+}
+
 // Run
 //fileInfor, _ := os.Stat("/opt/warden/containers/" + wardenContainer.ID())
 // _, err = wardenContainer.Run("ls")
 
 // Destroy
+
+func (s *WCSuite) TestStreamWardenJobSplitsOutputUntilExit(c *C) {
+	responses := make(chan *warden.StreamResponse, 3)
+	responses <- &warden.StreamResponse{Name: proto.String("stdout"), Data: proto.String("out\n")}
+	responses <- &warden.StreamResponse{Name: proto.String("stderr"), Data: proto.String("err\n")}
+	responses <- &warden.StreamResponse{ExitStatus: proto.Uint32(7)}
+
+	stream := streamWardenJob(responses)
+
+	stderr := make(chan []byte)
+	go func() {
+		output, _ := ioutil.ReadAll(stream.Stderr)
+		stderr <- output
+	}()
+
+	stdout, err := ioutil.ReadAll(stream.Stdout)
+	c.Assert(err, IsNil)
+	c.Assert(string(stdout), Equals, "out\n")
+	c.Assert(string(<-stderr), Equals, "err\n")
+
+	status, err := stream.Wait()
+	c.Assert(err, IsNil)
+	c.Assert(status, Equals, uint32(7))
+}
+
+func (s *WCSuite) TestStreamWardenJobFailsIfTheStreamEndsEarly(c *C) {
+	responses := make(chan *warden.StreamResponse)
+	close(responses)
+
+	stream := streamWardenJob(responses)
+
+	_, err := ioutil.ReadAll(stream.Stdout)
+	c.Assert(err, Equals, JobStreamInterrupted)
+
+	_, err = stream.Wait()
+	c.Assert(err, Equals, JobStreamInterrupted)
+}
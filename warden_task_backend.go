@@ -2,16 +2,109 @@ package narc
 
 import (
 	"fmt"
+	"github.com/cloudfoundry/gordon"
+	"github.com/kylelemons/go-gypsy/yaml"
 	"os/exec"
+	"strings"
 )
 
 type WardenTaskBackend struct {
 	WardenContainersPath string
 	WardenSocketPath     string
+
+	// ContainerCreationScript, if set, is run to create containers instead
+	// of creating them through the warden server directly. It is given a
+	// CreateContainerMessage as JSON on stdin and must print a
+	// CreateContainerResponse as JSON.
+	ContainerCreationScript string
+
+	// DeniesOutbound is set if the warden server is known to deny outbound
+	// traffic unless it is allowed per container. Otherwise nothing would
+	// enforce the "none" and "allow" network policies, so they are refused.
+	DeniesOutbound bool
+
+	// Owner is recorded on the containers this backend creates, and only
+	// containers recorded with it are listed.
+	Owner string
+}
+
+func (p WardenTaskBackend) ProvideContainer(spec ContainerSpec) (Container, error) {
+	restricted := spec.Network.Mode == NetworkNone || spec.Network.Mode == NetworkAllowList
+	if restricted && !p.DeniesOutbound {
+		return nil, NetworkPolicyNotSupported
+	}
+
+	spec.Owner = p.Owner
+
+	if p.ContainerCreationScript != "" {
+		return NewScriptedWardenContainer(
+			p.WardenSocketPath,
+			spec,
+			&ContainerCreationRunnerInJson{},
+			p.ContainerCreationScript,
+		)
+	}
+
+	return NewWardenContainer(p.connectionProvider(), spec)
+}
+
+func (p WardenTaskBackend) RestoreContainer(handle string) (Container, error) {
+	return RestoreWardenContainer(p.connectionProvider(), handle)
+}
+
+func (p WardenTaskBackend) ListContainers() ([]Container, error) {
+	wardenContainers, err := ListWardenContainers(p.connectionProvider(), p.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	containers := make([]Container, len(wardenContainers))
+	for i, container := range wardenContainers {
+		containers[i] = container
+	}
+
+	return containers, nil
+}
+
+// WardenDeniesOutbound reads a warden server's config, and reports whether
+// it denies containers outbound traffic to anywhere, with no networks
+// allowed to every container.
+func WardenDeniesOutbound(configPath string) (bool, error) {
+	file, err := yaml.ReadFile(configPath)
+	if err != nil {
+		return false, err
+	}
+
+	denied, err := file.Count("network.deny_networks")
+	if err != nil {
+		return false, nil
+	}
+
+	deniesEverywhere := false
+
+	for i := 0; i < denied; i++ {
+		network, _ := file.Get(fmt.Sprintf("network.deny_networks[%d]", i))
+		if network == "0.0.0.0/0" {
+			deniesEverywhere = true
+		}
+	}
+
+	allowed, err := file.Count("network.allow_networks")
+	if err != nil {
+		// left out, or an empty flow sequence
+		value, _ := file.Get("network.allow_networks")
+		if value != "" && value != "[]" {
+			return false, nil
+		}
+	} else if allowed > 0 {
+		return false, nil
+	}
+
+	return deniesEverywhere, nil
 }
 
-func (p WardenTaskBackend) ProvideContainer(limits TaskLimits) (Container, error) {
-	return NewWardenContainer(p.WardenSocketPath, limits, &ContainerCreationRunnerInJson{})
+func (p WardenTaskBackend) connectionProvider() warden.ConnectionProvider {
+	return &warden.ConnectionInfo{SocketPath: p.WardenSocketPath}
 }
 
 func (p WardenTaskBackend) ProvideCommand(container Container) *exec.Cmd {
@@ -27,9 +120,37 @@ func (p WardenTaskBackend) ProvideCommand(container Container) *exec.Cmd {
 		container.ID(),
 	)
 
-	return exec.Command(
-		"sudo", wshBin,
+	args := []string{
+		wshBin,
 		"--socket", wshdSocket,
 		"--user", "vcap",
-	)
+	}
+
+	wardenContainer, ok := container.(*WardenContainer)
+	if ok {
+		args = append(args, rlimitedShell(wardenContainer.Limits)...)
+	}
+
+	return exec.Command("sudo", args...)
+}
+
+// rlimitedShell returns a login shell limited to the PID and file
+// descriptor limits, or nothing, leaving wsh to start its default shell, if
+// neither is set.
+func rlimitedShell(limits TaskLimits) []string {
+	ulimits := []string{}
+
+	if limits.PIDLimit > 0 {
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -u %d", limits.PIDLimit))
+	}
+
+	if limits.FDLimit > 0 {
+		ulimits = append(ulimits, fmt.Sprintf("ulimit -n %d", limits.FDLimit))
+	}
+
+	if len(ulimits) == 0 {
+		return nil
+	}
+
+	return []string{"/bin/bash", "-c", strings.Join(ulimits, " && ") + " && exec /bin/bash -l"}
 }